@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/songgao/water"
+
+	"go-mesh-hub/internal/protocol"
+	"go-mesh-hub/internal/security"
+	"go-mesh-hub/internal/tun"
+)
+
+// Direct tunnels between Agents.
+//
+// When the Hub relays traffic between two Agents it introduces them to each
+// other (ControlPeer). Both sides then send packets to the endpoint the Hub
+// observed for the other one, which opens the mapping in their own NAT. The
+// Agent with the lower public key also sends Noise IK initiations; the other
+// one only answers. Once a handshake completes, packets for the peer's
+// allowed IPs go straight to it.
+//
+// If nothing is heard from the peer for directTimeout the path is considered
+// broken and packets go back through the Hub, which never stopped relaying,
+// so the switch doesn't drop traffic.
+const (
+	punchInterval   = time.Second
+	punchAttempts   = 15
+	directRetry     = 3 * time.Second
+	directKeepalive = 10 * time.Second
+	directTimeout   = 30 * time.Second
+)
+
+// directPeer is another Agent we may exchange traffic with without the Hub
+type directPeer struct {
+	*tunnel
+
+	// Guarded by the peerSet lock
+	allowed  []*net.IPNet       // Inner source addresses of the peer, sent by the Hub
+	lastInit security.Timestamp // Newest accepted initiation from the peer
+	punching bool
+	up       bool // Last state reported in the logs
+}
+
+// alive reports whether the direct path can carry traffic
+func (p *directPeer) alive() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.keys.Current() != nil && time.Since(p.lastRecv) < directTimeout
+}
+
+// touch records an authenticated packet from addr (the peer may roam)
+func (p *directPeer) touch(addr *net.UDPAddr) {
+	p.Lock()
+	p.lastRecv = time.Now()
+	p.addr = addr
+	p.Unlock()
+}
+
+// punch sends an empty cleartext packet to open our NAT towards the peer
+func (p *directPeer) punch() error {
+	return p.write(protocol.NewHeader(protocol.TypePunch, 0).AppendTo(nil))
+}
+
+// peerSet holds the Agents introduced by the Hub
+type peerSet struct {
+	sync.Mutex
+	local  security.PrivateKey
+	conn   *net.UDPConn
+	limits security.Limits
+	stats  *agentMetrics
+	peers  map[security.PublicKey]*directPeer
+}
+
+func newPeerSet(local security.PrivateKey, conn *net.UDPConn, limits security.Limits, stats *agentMetrics) *peerSet {
+	return &peerSet{
+		local:  local,
+		conn:   conn,
+		limits: limits,
+		stats:  stats,
+		peers:  make(map[security.PublicKey]*directPeer),
+	}
+}
+
+// introduce handles a ControlPeer message from the Hub and starts punching
+func (ps *peerSet) introduce(attrs []protocol.Attr) {
+	keyAttr, ok := protocol.Find(attrs, protocol.AttrPublicKey)
+	if !ok || len(keyAttr.Value) != security.KeySize {
+		return
+	}
+	endpointAttr, ok := protocol.Find(attrs, protocol.AttrEndpoint)
+	if !ok {
+		return
+	}
+	endpoint, err := endpointAttr.Endpoint()
+	if err != nil {
+		return
+	}
+	var key security.PublicKey
+	copy(key[:], keyAttr.Value)
+	if key == ps.local.PublicKey() {
+		return
+	}
+
+	ps.Lock()
+	p, ok := ps.peers[key]
+	if !ok {
+		p = &directPeer{tunnel: &tunnel{conn: ps.conn, remote: key, keys: security.NewKeyring(ps.limits)}}
+		ps.peers[key] = p
+	}
+	p.allowed = protocol.Prefixes(attrs, protocol.AttrAllowedIP)
+	start := !p.punching
+	p.punching = true
+	ps.Unlock()
+
+	p.Lock()
+	p.addr = endpoint
+	p.Unlock()
+
+	if start {
+		log.Printf("[P2P] Hub introduced peer %s at %s, trying a direct tunnel", key, endpoint)
+		go ps.punch(p)
+	}
+}
+
+// drop handles a ControlDropPeer message: the Hub no longer allows a
+// direct tunnel with that peer, so its session is torn down and its
+// traffic goes back through the Hub
+func (ps *peerSet) drop(attrs []protocol.Attr) {
+	keyAttr, ok := protocol.Find(attrs, protocol.AttrPublicKey)
+	if !ok || len(keyAttr.Value) != security.KeySize {
+		return
+	}
+	var key security.PublicKey
+	copy(key[:], keyAttr.Value)
+
+	ps.Lock()
+	p, ok := ps.peers[key]
+	delete(ps.peers, key)
+	ps.Unlock()
+	if !ok {
+		return
+	}
+	p.keys.Clear()
+	log.Printf("[P2P] Hub withdrew peer %s, direct tunnel closed", key)
+}
+
+// has reports whether p is still one of our peers (the Hub may drop it)
+func (ps *peerSet) has(p *directPeer) bool {
+	ps.Lock()
+	defer ps.Unlock()
+	return ps.peers[p.remote] == p
+}
+
+// initiator decides which side of a pair sends the handshake, so two
+// simultaneous initiations don't keep replacing each other
+func (ps *peerSet) initiator(p *directPeer) bool {
+	local := ps.local.PublicKey()
+	return bytes.Compare(local[:], p.remote[:]) < 0
+}
+
+// punch keeps knocking on the peer's endpoint until the tunnel is up or
+// the attempts run out (traffic keeps flowing through the Hub meanwhile)
+func (ps *peerSet) punch(p *directPeer) {
+	defer func() {
+		ps.Lock()
+		p.punching = false
+		ps.Unlock()
+	}()
+
+	for i := 0; i < punchAttempts; i++ {
+		if !ps.has(p) || p.alive() {
+			return
+		}
+		p.punch()
+		if ps.initiator(p) {
+			p.Lock()
+			waiting := p.pending != nil && time.Since(p.pendingSent) < directRetry
+			p.Unlock()
+			if !waiting {
+				p.initiate(ps.local)
+			}
+		}
+		time.Sleep(punchInterval)
+	}
+	if ps.has(p) && !p.alive() {
+		log.Printf("[P2P] Could not reach %s directly, relaying through the Hub", p.remote)
+	}
+}
+
+// route returns the peer that owns dst if its direct path is working
+func (ps *peerSet) route(dst net.IP) *directPeer {
+	ps.Lock()
+	defer ps.Unlock()
+	for _, p := range ps.peers {
+		for _, prefix := range p.allowed {
+			if prefix.Contains(dst) && p.alive() {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// allows applies the Hub's anti-spoofing rule to direct traffic
+func (ps *peerSet) allows(p *directPeer, src net.IP) bool {
+	ps.Lock()
+	defer ps.Unlock()
+	for _, prefix := range p.allowed {
+		if prefix.Contains(src) {
+			return true
+		}
+	}
+	return false
+}
+
+// byIndex finds the peer owning one of our local session indexes
+func (ps *peerSet) byIndex(index uint32, pending bool) *directPeer {
+	ps.Lock()
+	defer ps.Unlock()
+	for _, p := range ps.peers {
+		if pending {
+			p.Lock()
+			match := p.pending != nil && p.pendingIndex == index
+			p.Unlock()
+			if match {
+				return p
+			}
+		} else if p.keys.Owns(index) {
+			return p
+		}
+	}
+	return nil
+}
+
+// handle processes a datagram that didn't come from the Hub
+func (ps *peerSet) handle(packet []byte, from *net.UDPAddr, ifce *water.Interface) {
+	header, body, err := protocol.Parse(packet)
+	if err != nil {
+		return
+	}
+
+	switch header.Type {
+	case protocol.TypePunch:
+		return // Only there to open the NAT
+	case protocol.TypeHandshakeInit:
+		ps.respond(packet, header, body, from)
+		return
+	case protocol.TypeHandshakeResponse:
+		p := ps.byIndex(header.Receiver, true)
+		if p == nil {
+			return
+		}
+		session, _, err := p.complete(packet, header, body)
+		if err != nil {
+			return
+		}
+		p.touch(from)
+		// Confirm the keys so the responder starts using them
+		p.send(protocol.TypeKeepalive, nil)
+		ps.report(p, session)
+		return
+	}
+
+	p := ps.byIndex(header.Receiver, false)
+	if p == nil {
+		return
+	}
+	plaintext, session, err := p.keys.Decrypt(header.Receiver, packet[:protocol.HeaderSize], body)
+	if err != nil {
+		ps.stats.decryptFailures.Inc()
+		return
+	}
+	p.touch(from)
+	ps.report(p, session)
+
+	switch header.Type {
+	case protocol.TypeData:
+		src, _, ok := tun.Addresses(plaintext)
+		if !ok {
+			return
+		}
+		if !ps.allows(p, src) {
+			log.Printf("[SEC] Spoofing attempt: direct peer %s sent packet from %s", p.remote, src)
+			ps.stats.drops.With(dropSpoofed).Inc()
+			return
+		}
+		p.rx.count(len(plaintext))
+		ps.stats.writeTUN(ifce, plaintext)
+	case protocol.TypeDisconnect:
+		log.Printf("[P2P] Peer %s closed the direct tunnel", p.remote)
+		p.keys.Clear()
+		ps.Lock()
+		p.up = false
+		ps.Unlock()
+	}
+}
+
+// respond answers a handshake initiation from an Agent the Hub introduced
+func (ps *peerSet) respond(packet []byte, header protocol.Header, body []byte, from *net.UDPAddr) {
+	sender, msg, err := protocol.SplitHandshake(body)
+	if err != nil {
+		return
+	}
+	prologue := packet[:protocol.HeaderSize+protocol.IndexSize]
+
+	hs, ts, _, err := security.ConsumeInitiation(ps.local, prologue, msg)
+	if err != nil {
+		return
+	}
+
+	ps.Lock()
+	p, ok := ps.peers[hs.Remote()]
+	if ok && !ts.After(p.lastInit) {
+		ps.Unlock()
+		log.Printf("[SEC] Rejected replayed handshake from peer %s (%s)", hs.Remote(), from)
+		return
+	}
+	if ok {
+		p.lastInit = ts
+	}
+	ps.Unlock()
+	if !ok {
+		// Only Agents vouched for by the Hub may open a direct tunnel
+		log.Printf("[SEC] Rejected direct handshake from unknown key %s at %s", hs.Remote(), from)
+		return
+	}
+
+	index := security.RandomIndex()
+	respHeader := protocol.Header{Version: header.Version, Type: protocol.TypeHandshakeResponse, Receiver: sender}
+	response, session, err := hs.CreateResponse(protocol.AppendHandshake(nil, respHeader, index), nil)
+	if err != nil {
+		return
+	}
+	session.LocalIndex = index
+	session.RemoteIndex = sender
+	// Used for sending once the initiator's first packet confirms it
+	p.keys.Install(session, false)
+
+	p.Lock()
+	p.addr = from
+	p.Unlock()
+	p.write(response)
+}
+
+// report logs the transition of a peer to the direct path
+func (ps *peerSet) report(p *directPeer, session *security.Session) {
+	ps.Lock()
+	defer ps.Unlock()
+	if p.up || p.keys.Current() != session {
+		return
+	}
+	p.up = true
+	p.Lock()
+	addr := p.addr
+	p.Unlock()
+	log.Printf("[P2P] Direct tunnel to %s established via %s", p.remote, addr)
+}
+
+// maintain keeps the direct paths open, rekeys them and notices when one
+// breaks (traffic then falls back to the Hub on its own)
+func (ps *peerSet) maintain() {
+	ticker := time.NewTicker(directKeepalive)
+	for range ticker.C {
+		ps.Lock()
+		peers := make([]*directPeer, 0, len(ps.peers))
+		for _, p := range ps.peers {
+			peers = append(peers, p)
+		}
+		ps.Unlock()
+
+		for _, p := range peers {
+			alive := p.alive()
+			ps.Lock()
+			lost := p.up && !alive
+			if lost {
+				p.up = false
+			}
+			ps.Unlock()
+			if lost {
+				log.Printf("[P2P] Direct path to %s lost, relaying through the Hub", p.remote)
+				continue
+			}
+			if !alive {
+				continue
+			}
+
+			p.send(protocol.TypeKeepalive, nil)
+			if ps.initiator(p) && p.keys.NeedsRekey() {
+				p.Lock()
+				waiting := p.pending != nil && time.Since(p.pendingSent) < directRetry
+				p.Unlock()
+				if !waiting {
+					p.initiate(ps.local)
+				}
+			}
+		}
+	}
+}
+
+// close tells every direct peer we are leaving
+func (ps *peerSet) close() {
+	ps.Lock()
+	defer ps.Unlock()
+	for _, p := range ps.peers {
+		p.send(protocol.TypeDisconnect, nil)
+	}
+}
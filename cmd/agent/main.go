@@ -1,150 +1,409 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/sha256"
-	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
-	"os/exec"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
-	"golang.org/x/crypto/chacha20poly1305"
+	"go-mesh-hub/internal/config"
+	"go-mesh-hub/internal/protocol"
+	"go-mesh-hub/internal/security"
 	"go-mesh-hub/internal/tun"
 )
 
-var (
-	hubIP       = flag.String("hub-ip", "", "Public IP of the Hub Server")
-	hubPort     = flag.Int("hub-port", 5000, "UDP port of the Hub")
-	tunIP       = flag.String("tun-ip", "", "My Virtual IP (e.g. 10.0.0.2)")
-	isExitNode  = flag.Bool("exit-node", false, "Act as an Exit Node (Route internet traffic)")
-	useExitNode = flag.Bool("global-exit", false, "Route all internet traffic through the VPN Hub")
-	secret      = flag.String("secret", "change-this-password", "Shared secret for encryption")
-)
+const handshakeRetry = 5 * time.Second
+
+// tunnel holds the sessions with one Noise peer (the Hub or another Agent)
+// and the handshake that is waiting for a response.
+type tunnel struct {
+	sync.Mutex
+	conn         *net.UDPConn
+	addr         *net.UDPAddr       // Where the peer is reachable
+	remote       security.PublicKey // Static key of the peer
+	keys         *security.Keyring
+	pending      *security.Handshake
+	pendingIndex uint32
+	pendingSent  time.Time
+	lastRecv     time.Time // Last authenticated packet
+
+	rx, tx traffic // Data packets through this tunnel
+
+	advertised []*net.IPNet    // LANs announced to the Hub in every handshake
+	exitVia    net.IP          // Exit Node asked for in every handshake (nil: the Hub's choice)
+	exitOffer  bool            // Tell the Hub we forward Internet traffic (-exit-node)
+	ifaceName  string          // TUN device, known once the address is assigned
+	routes     map[string]bool // Mesh subnets installed as kernel routes
+}
+
+func (t *tunnel) current() *security.Session {
+	return t.keys.Current()
+}
+
+// send encrypts payload with the current session and transmits it as msgType
+func (t *tunnel) send(msgType protocol.MessageType, payload []byte) error {
+	session := t.current()
+	if session == nil {
+		return security.ErrNoSession
+	}
+	header := protocol.NewHeader(msgType, session.RemoteIndex).AppendTo(nil)
+	packet, err := session.PackAndEncrypt(header, payload)
+	if err != nil {
+		return err
+	}
+	return t.write(packet)
+}
+
+// write transmits a raw datagram to the peer's current endpoint
+func (t *tunnel) write(packet []byte) error {
+	t.Lock()
+	addr := t.addr
+	t.Unlock()
+	_, err := t.conn.WriteToUDP(packet, addr)
+	return err
+}
+
+// initiate sends a new handshake initiation to the peer
+func (t *tunnel) initiate(local security.PrivateKey) error {
+	index := security.RandomIndex()
+	prologue := protocol.AppendHandshake(nil, protocol.NewHeader(protocol.TypeHandshakeInit, 0), index)
+	var attrs []protocol.Attr
+	for _, prefix := range t.advertised {
+		attrs = append(attrs, protocol.PrefixAttr(protocol.AttrRoute, prefix))
+	}
+	if t.exitVia != nil {
+		bits := len(t.exitVia) * 8
+		attrs = append(attrs, protocol.PrefixAttr(protocol.AttrExitNode, &net.IPNet{IP: t.exitVia, Mask: net.CIDRMask(bits, bits)}))
+	}
+	if t.exitOffer {
+		attrs = append(attrs, protocol.Attr{Type: protocol.AttrExitOffer})
+	}
+	hs := security.NewInitiator(local, t.remote)
+	msg, err := hs.CreateInitiation(prologue, protocol.MarshalAttrs(attrs))
+	if err != nil {
+		return err
+	}
+	t.Lock()
+	t.pending = hs
+	t.pendingIndex = index
+	t.pendingSent = time.Now()
+	t.Unlock()
+
+	return t.write(msg)
+}
+
+// complete consumes a handshake response and installs the new session.
+// It returns the attributes sent by the peer (e.g. the leased address).
+func (t *tunnel) complete(packet []byte, header protocol.Header, body []byte) (*security.Session, []protocol.Attr, error) {
+	sender, msg, err := protocol.SplitHandshake(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	prologue := packet[:protocol.HeaderSize+protocol.IndexSize]
+
+	t.Lock()
+	defer t.Unlock()
+	if t.pending == nil || header.Receiver != t.pendingIndex {
+		return nil, nil, security.ErrHandshakeFailed
+	}
+	payload, session, err := t.pending.ConsumeResponse(prologue, msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	attrs, err := protocol.ParseAttrs(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	session.LocalIndex = t.pendingIndex
+	session.RemoteIndex = sender
+	t.keys.Install(session, true)
+	t.pending = nil
+	return session, attrs, nil
+}
+
+// syncRoutes makes the kernel routes through the TUN match the mesh subnets
+// announced by the Hub (the LANs behind other Agents)
+func (t *tunnel) syncRoutes(attrs []protocol.Attr) {
+	t.Lock()
+	defer t.Unlock()
+	if t.ifaceName == "" {
+		return
+	}
+
+	current := make(map[string]bool)
+	for _, prefix := range protocol.Prefixes(attrs, protocol.AttrRoute) {
+		// Normalize host bits away (192.168.50.1/24 -> 192.168.50.0/24)
+		route := (&net.IPNet{IP: prefix.IP.Mask(prefix.Mask), Mask: prefix.Mask}).String()
+		current[route] = true
+		if !t.routes[route] {
+			if err := tun.AddRoute(t.ifaceName, route); err != nil {
+				log.Printf("[ROUTE] %v", err)
+				delete(current, route)
+			}
+		}
+	}
+	for route := range t.routes {
+		if !current[route] {
+			tun.DelRoute(t.ifaceName, route)
+		}
+	}
+	t.routes = current
+}
+
+// dropRoutes removes the mesh subnet routes on shutdown
+func (t *tunnel) dropRoutes() {
+	t.Lock()
+	defer t.Unlock()
+	for route := range t.routes {
+		tun.DelRoute(t.ifaceName, route)
+	}
+	t.routes = nil
+}
+
+// connect performs the first handshake synchronously, so the leased
+// address is known before the TUN interface is configured.
+func (t *tunnel) connect(local security.PrivateKey) []protocol.Attr {
+	buf := make([]byte, 2000)
+	defer t.conn.SetReadDeadline(time.Time{})
+	for {
+		if err := t.initiate(local); err != nil {
+			log.Printf("[ERR] Failed to send Handshake packet: %v", err)
+		}
+		t.conn.SetReadDeadline(time.Now().Add(handshakeRetry))
+		for {
+			n, err := t.conn.Read(buf)
+			if err != nil {
+				break // Timeout: retry the handshake
+			}
+			header, body, err := protocol.Parse(buf[:n])
+			if err != nil || header.Type != protocol.TypeHandshakeResponse {
+				continue
+			}
+			session, attrs, err := t.complete(buf[:n], header, body)
+			if err != nil {
+				continue
+			}
+			// Confirm the new keys to the Hub right away so it switches too
+			t.send(protocol.TypeKeepalive, nil)
+			log.Printf("[NET] Handshake complete (key epoch %d).", session.Epoch)
+			return attrs
+		}
+		log.Println("[NET] No answer from Hub, retrying handshake...")
+	}
+}
 
 func main() {
-	flag.Parse()
-	if *hubIP == "" || *tunIP == "" {
-		log.Fatal("Usage: sudo ./client -hub-ip <IP> -tun-ip <IP>")
+	cfg, err := config.LoadAgent()
+	if err != nil {
+		log.Fatalf("[CRIT] Invalid configuration:\n%v\nUsage: sudo ./agent -hub-ip <IP> -hub-key <KEY> [-tun-ip <IP>] or -config agent.yaml", err)
+	}
+	if cfg.CheckConfig {
+		log.Println("[CONF] Configuration OK")
+		return
+	}
+	if cfg.Cleanup {
+		cleanup(cfg.NetBackend, cfg.StateFile)
+		return
 	}
 
 	// 1. Crypto
-	key := sha256.Sum256([]byte(*secret))
-	aead, err := chacha20poly1305.New(key[:])
+	privateKey, err := security.LoadOrCreatePrivateKey(cfg.KeyFile)
+	if err != nil {
+		log.Fatalf("[CRIT] Failed to load private key: %v", err)
+	}
+	hubPublicKey, _ := security.ParsePublicKey(cfg.HubKey) // Checked by Validate
+	log.Printf("[SEC] Agent public key: %s (add it to the Hub's authorized peers)", privateKey.PublicKey())
+	limits := security.NewLimits(cfg.RekeyAfter, cfg.RekeyAfterPackets)
+	link := &tunnel{remote: hubPublicKey, keys: security.NewKeyring(limits)}
+	link.advertised, _ = cfg.AdvertisedPrefixes() // Checked by Validate
+	if ip := net.ParseIP(cfg.ExitVia); ip != nil {
+		if ip.To4() != nil {
+			ip = ip.To4()
+		}
+		link.exitVia = ip
+	}
+	link.exitOffer = cfg.ExitNode
+
+	// Host networking: backend, firewall, and the leftovers of a crashed run
+	if err := tun.SetBackend(cfg.NetBackend); err != nil {
+		log.Fatalf("[CRIT] %v", err)
+	}
+	if err := tun.SetFirewall(cfg.Firewall); err != nil {
+		log.Fatalf("[CRIT] Firewall %s unavailable: %v", cfg.Firewall, err)
+	}
+	// Revert what a crashed run left behind, then journal our own changes
+	// (the kill switch is kept and replaced in place, never lifted)
+	if err := tun.OpenJournal(cfg.StateFile, cfg.KillSwitch); err != nil {
+		log.Fatalf("[CRIT] %v", err)
+	}
+
+	// 2. UDP Connection to Hub
+	// JoinHostPort brackets IPv6 literals (e.g. [2001:db8::1]:5000)
+	serverAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(cfg.HubIP, strconv.Itoa(cfg.HubPort)))
 	if err != nil {
 		log.Fatal(err)
 	}
+	// One unconnected socket for the Hub and the direct peers: punching only
+	// works if other Agents reach the same NAT mapping the Hub sees
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	link.conn = conn
+	link.addr = serverAddr
+	stats := newAgentMetrics()
+	peers := newPeerSet(privateKey, conn, limits, stats)
+	log.Printf("Client started. Connecting to Hub at %s\n", serverAddr)
 
-	// 2. TUN
-	ifce, err := tun.Setup(*tunIP)
+	// KILL SWITCH: only the Hub is reachable until the tunnel is up, and
+	// nothing leaks while it is down (the TUN is allowed once it exists)
+	if cfg.KillSwitch {
+		if err := tun.EnableKillSwitch(tun.KillSwitch{Hub: serverAddr}); err != nil {
+			log.Fatalf("[CRIT] Failed to enable the kill switch: %v", err)
+		}
+		log.Printf("[SEC] Kill switch on: only the Hub at %s is reachable outside the tunnel, direct tunnels are disabled", serverAddr)
+	}
+
+	// 3. Initial handshake: the Hub may lease our Virtual IP
+	attrs := link.connect(privateKey)
+	// Leased addresses win over the flags, family by family
+	var leased4, leased6 bool
+	var addresses []string
+	for _, prefix := range protocol.Prefixes(attrs, protocol.AttrAddress) {
+		if prefix.IP.To4() != nil {
+			leased4 = true
+		} else {
+			leased6 = true
+		}
+		addresses = append(addresses, prefix.String())
+		log.Printf("[IPAM] Hub assigned Virtual IP %s", prefix)
+	}
+	if !leased4 && cfg.TunIP != "" {
+		addresses = append(addresses, cfg.TunIP)
+	}
+	if !leased6 && cfg.TunIP6 != "" {
+		addresses = append(addresses, cfg.TunIP6)
+	}
+	if len(addresses) == 0 {
+		log.Fatal("[CRIT] Hub did not lease an address and no -tun-ip was given")
+	}
+
+	// 4. TUN
+	ifce, err := tun.Setup(cfg.MTU, addresses...)
 	if err != nil {
 		log.Fatalf("[CRIT] TUN init failed: %v", err)
 	}
+	link.Lock()
+	link.ifaceName = ifce.Name()
+	link.Unlock()
+	link.syncRoutes(attrs)
 
-	var cleanupNAT func()
+	// IPv6 forwarding is only needed with an IPv6 overlay or LAN
+	ipv6 := leased6 || cfg.TunIP6 != ""
+	for _, prefix := range link.advertised {
+		if prefix.IP.To4() == nil {
+			ipv6 = true
+		}
+	}
+
+	// --- SUBNET ROUTER ---
+	// Hosts on the advertised LANs reach the mesh through us
+	if len(link.advertised) > 0 {
+		if err := tun.EnableForwarding(ipv6); err != nil {
+			log.Fatalf("[CRIT] Failed to enable forwarding for advertised subnets: %v", err)
+		}
+		log.Printf("[ROUTE] Advertising %s to the mesh", cfg.Advertise.String())
+	}
+
+	var cleanupNAT, cleanupRoutes func()
 	// --- EXIT NODE CONFIGURATION ---
-    if *isExitNode {
-		
-        cleanupNAT, err = tun.EnableExitNode(ifce.Name())
-        if err != nil {
-            log.Fatalf("[CRIT] Failed to enable Exit Node: %v", err)
-        }
-        // IMPORTANT: Ensure rules are deleted when we kill the app
-        defer cleanupNAT() 
-    }
+	if cfg.ExitNode {
+
+		cleanupNAT, err = tun.EnableExitNode(ifce.Name(), ipv6)
+		if err != nil {
+			log.Fatalf("[CRIT] Failed to enable Exit Node: %v", err)
+		}
+		// IMPORTANT: Ensure rules are deleted when we kill the app
+		defer cleanupNAT()
+		log.Printf("[NAT] Forwarding Internet traffic for the mesh. List %s in the Hub's exit-node to use this Agent.", addresses[0])
+	}
 
 	// if useExitNode we have to redirect all the trafic
-	if *useExitNode {
-        // Resolvemos la IP del Hub (si nos pasaron un dominio, necesitamos la IP numérica para 'ip route')
-        hubUDPAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", *hubIP, *hubPort))
-        if err != nil {
-            log.Fatalf("[CRIT] Failed to resolve Hub IP: %v", err)
-        }
-        hubRealIP := hubUDPAddr.IP.String()
-        // Magic happens here:
-        cleanupRoutes, err := tun.RedirectGateway(ifce.Name(), hubRealIP)
-        if err != nil {
-            log.Fatalf("[CRIT] Failed to redirect gateway: %v", err)
-        }
-        defer cleanupRoutes() // Restore internet when we exit 
-        log.Println("[INFO] Global Exit Node active. You are now surfing via the Hub.")
-    }
-
-	// 3. UDP Connection to Hub
-	serverAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", *hubIP, *hubPort))
-	if err != nil {
-		log.Fatal(err)
+	if cfg.GlobalExit {
+		// Resolvemos la IP del Hub (si nos pasaron un dominio, necesitamos la IP numérica para 'ip route')
+		hubRealIP := serverAddr.IP.String()
+		// Magic happens here:
+		// IPv6 goes through the tunnel as soon as we have an IPv6 Virtual IP
+		cleanupRoutes, err = tun.RedirectGateway(ifce.Name(), hubRealIP, leased6 || cfg.TunIP6 != "")
+		if err != nil {
+			log.Fatalf("[CRIT] Failed to redirect gateway: %v", err)
+		}
+		defer cleanupRoutes() // Restore internet when we exit
+		log.Println("[INFO] Global Exit Node active. You are now surfing via the Hub.")
 	}
-	// DialUDP fixes the remote address, so we don't need to specify it every time
-	conn, err := net.DialUDP("udp", nil, serverAddr) 
-	if err != nil {
-		log.Fatal(err)
+	if cfg.KillSwitch {
+		if err := tun.EnableKillSwitch(tun.KillSwitch{Tun: ifce.Name(), Hub: serverAddr}); err != nil {
+			log.Fatalf("[CRIT] Failed to open the kill switch to %s: %v", ifce.Name(), err)
+		}
 	}
-	defer conn.Close()
-	log.Printf("Client %s started. Connected to Hub at %s\n", *tunIP, serverAddr)
-    
+
 	// For clean the iptable to restore internet
 	go func() {
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 		// blocking here waiting the signal
 		sig := <-sigChan
-	
+
 		fmt.Println()
 		log.Printf("[OS] Received signal: %v. Cleaning up...", sig)
-		// 1. Restore IPTables / NAT 
+		// 0. Tell the Hub we are leaving so it drops our session
+		link.send(protocol.TypeDisconnect, nil)
+		peers.close()
+		// 1. Restore IPTables / NAT
 		if cleanupNAT != nil {
 			cleanupNAT()
 		}
-		// 2. close conections
+		tun.RestoreForwarding()
+		// 2. Restore the default routes and drop the mesh subnet routes
+		if cleanupRoutes != nil {
+			cleanupRoutes()
+		}
+		link.dropRoutes()
+		// A deliberate disconnect: the only way the kill switch goes away
+		if cfg.KillSwitch {
+			if err := tun.DisableKillSwitch(); err != nil {
+				log.Printf("[ERR] Failed to remove the kill switch: %v", err)
+			}
+		}
+		// 3. close conections
 		conn.Close()
 		ifce.Close()
 		log.Println("[OS] Cleanup complete. Exiting.")
 		os.Exit(0) // Matamos el programa limpiamente
 	}()
 
-	// HANDSHAKE Initial 
-    go func() {
-		// 1. Construct a minimal, valid IPv4 Header (20 bytes)
-		// We don't need a payload, just the headers for the Server's Deep Packet Inspection.
-		handshakePacket := make([]byte, 20)
-
-		// Byte 0: Version (4) + Header Length (5 words = 20 bytes) = 0x45
-		// CRITICAL: The Server ignores packets if version != 4.
-		handshakePacket[0] = 0x45
-
-		// Bytes 12-16: Source IP (My Virtual Identity)
-		// The server uses this to learn "Who I am"
-		sourceIP := net.ParseIP(*tunIP).To4()
-		copy(handshakePacket[12:16], sourceIP)
-
-		// Bytes 16-20: Destination IP (Hub Virtual Identity)
-		// This is formal; the server will consume it anyway. 
-		// We assume the Hub is usually the .1 address.
-		destIP := net.ParseIP("10.0.0.1").To4() 
-		copy(handshakePacket[16:20], destIP)
-
-		// 2. Encrypt the Packet
-		nonce := make([]byte, aead.NonceSize())
-		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-			log.Printf("[ERR] Handshake failed: Could not generate nonce: %v", err)
-			return
-		}
-
-		// Seal (Encrypt + Authenticate)
-		encryptedPayload := aead.Seal(nil, nonce, handshakePacket, nil)
+	// REKEY: Noise IK towards the Hub's static key.
+	// Runs whenever there is no session or the current one reached its rekey
+	// limits; the old keys stay valid until the new ones are in place.
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		for ; ; <-ticker.C {
+			link.Lock()
+			waiting := link.pending != nil && time.Since(link.pendingSent) < handshakeRetry
+			link.Unlock()
+			if waiting || !link.keys.NeedsRekey() {
+				continue
+			}
 
-		// 3. Transmit: [Nonce + Encrypted Data]
-		finalPacket := append(nonce, encryptedPayload...)
-		if _, err := conn.Write(finalPacket); err != nil {
-			log.Printf("[ERR] Failed to send Handshake packet: %v", err)
-		} else {
-			log.Printf("[NET] Handshake sent. Registered Virtual IP %s with Hub.", *tunIP)
+			if err := link.initiate(privateKey); err != nil {
+				log.Printf("[ERR] Failed to send Handshake packet: %v", err)
+			}
 		}
 	}()
 
@@ -153,11 +412,7 @@ func main() {
 	go func() {
 		ticker := time.NewTicker(20 * time.Second)
 		for range ticker.C {
-			nonce := make([]byte, aead.NonceSize())
-			io.ReadFull(rand.Reader, nonce)
-			// Encrypting an empty slice []byte{}
-			heartbeat := aead.Seal(nil, nonce, []byte{}, nil)
-			conn.Write(append(nonce, heartbeat...))
+			link.send(protocol.TypeKeepalive, nil)
 		}
 	}()
 
@@ -165,46 +420,160 @@ func main() {
 	go func() {
 		buf := make([]byte, 2000)
 		for {
-			n, _, err := conn.ReadFromUDP(buf)
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil || n == 0 {
+				continue
+			}
+			received := time.Now()
+			if !from.IP.Equal(serverAddr.IP) || from.Port != serverAddr.Port {
+				// Another Agent talking to us directly
+				peers.handle(buf[:n], from, ifce)
+				continue
+			}
+
+			header, body, err := protocol.Parse(buf[:n])
 			if err != nil {
 				continue
 			}
-			
-			// Decrypt
-			nonceSize := aead.NonceSize()
-			if n < nonceSize { continue }
-			nonce := buf[:nonceSize]
-			ciphertext := buf[nonceSize:n]
-			plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+
+			if header.Type == protocol.TypeHandshakeResponse {
+				session, attrs, err := link.complete(buf[:n], header, body)
+				if err == nil {
+					link.syncRoutes(attrs)
+					// Confirm the new keys to the Hub right away so it switches too
+					link.send(protocol.TypeKeepalive, nil)
+					log.Printf("[NET] Rekey complete (key epoch %d).", session.Epoch)
+				}
+				continue
+			}
+			if !header.Type.IsTransport() {
+				continue
+			}
+
+			// Decrypt with the session the Hub addressed
+			// (replayed and too-old packets are dropped and counted by the session)
+			plaintext, _, err := link.keys.Decrypt(header.Receiver, buf[:protocol.HeaderSize], body)
 			if err != nil {
+				stats.decryptFailures.Inc()
 				continue
 			}
+			link.Lock()
+			link.lastRecv = received
+			link.Unlock()
 
-			// Write to TUN (only if it's a valid packet)
-			if len(plaintext) > 0 {
-				ifce.Write(plaintext)
+			switch header.Type {
+			case protocol.TypeData:
+				// Write to TUN (only if it's a valid packet)
+				if len(plaintext) > 0 {
+					link.rx.count(len(plaintext))
+					stats.writeTUN(ifce, plaintext)
+					stats.latency.Since(received)
+				}
+			case protocol.TypeControl:
+				code, attrs, err := protocol.ParseControl(plaintext)
+				if err != nil {
+					continue
+				}
+				switch code {
+				case protocol.ControlRoutes:
+					link.syncRoutes(attrs)
+				case protocol.ControlPeer:
+					// The kill switch blocks hole punching: all goes through the Hub
+					if !cfg.KillSwitch {
+						peers.introduce(attrs)
+					}
+				case protocol.ControlDropPeer:
+					peers.drop(attrs)
+				case protocol.ControlPing:
+					// The Hub measures the round trip time of the tunnel
+					link.send(protocol.TypeControl, protocol.MarshalControl(protocol.ControlPong, attrs))
+				}
+			case protocol.TypeDisconnect:
+				log.Println("[NET] Hub closed the session. Reconnecting...")
+				link.keys.Clear()
 			}
 		}
 	}()
 
-	// --- OUTBOUND LOOP (TUN -> Hub) ---
+	// --- DIRECT PEERS ---
+	go peers.maintain()
+
+	// --- METRICS (optional, local scrape target) ---
+	if cfg.MetricsListen != "" {
+		go serveMetrics(cfg.MetricsListen, link, peers, stats)
+	}
+
+	// Inner sources direct peers accept from us: our addresses and LANs.
+	// Replies from the Internet (Exit Node) must go back through the Hub.
+	own := append(hostPrefixes(addresses), link.advertised...)
+
+	// --- OUTBOUND LOOP (TUN -> Peer or Hub) ---
 	packet := make([]byte, 2000)
 	for {
 		n, err := ifce.Read(packet)
 		if err != nil {
+			stats.tunErrors.With("read").Inc()
 			log.Fatal(err)
 		}
-		// Encrypt and send everything to Hub
-		nonce := make([]byte, aead.NonceSize())
-		io.ReadFull(rand.Reader, nonce)
-		encrypted := aead.Seal(nil, nonce, packet[:n], nil)
-		conn.Write(append(nonce, encrypted...))
+		read := time.Now()
+		// Straight to the other Agent when a direct tunnel is up
+		if src, dst, ok := tun.Addresses(packet[:n]); ok && containsIP(own, src) {
+			if peer := peers.route(dst); peer != nil {
+				if peer.send(protocol.TypeData, packet[:n]) == nil {
+					peer.tx.count(n)
+					stats.latency.Since(read)
+					continue
+				}
+			}
+		}
+		// Encrypt and send everything to Hub (dropped while there is no tunnel yet)
+		if err := link.send(protocol.TypeData, packet[:n]); err != nil {
+			stats.dropSend(err)
+			continue
+		}
+		link.tx.count(n)
+		stats.latency.Since(read)
+	}
+}
+
+// hostPrefixes turns the TUN addresses (bare or with a prefix length) into
+// single-address prefixes
+func hostPrefixes(addresses []string) []*net.IPNet {
+	var prefixes []*net.IPNet
+	for _, address := range addresses {
+		ip, _, err := net.ParseCIDR(address)
+		if err != nil {
+			ip = net.ParseIP(address)
+		}
+		if ip == nil {
+			continue
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		prefixes = append(prefixes, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
 	}
+	return prefixes
 }
 
-func setupInterface(ifaceName, ip string) {
-	cidr := ip + "/24"
-	exec.Command("ip", "addr", "add", cidr, "dev", ifaceName).Run()
-	exec.Command("ip", "link", "set", "dev", ifaceName, "mtu", "1300").Run()
-	exec.Command("ip", "link", "set", "dev", ifaceName, "up").Run()
+func containsIP(prefixes []*net.IPNet, ip net.IP) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanup reverts the routes and NAT rules left by an Agent that crashed or
+// was killed (the cleanup subcommand)
+func cleanup(backend, stateFile string) {
+	if err := tun.SetBackend(backend); err != nil {
+		log.Fatalf("[CRIT] %v", err)
+	}
+	if err := tun.Cleanup(stateFile); err != nil {
+		log.Fatalf("[CRIT] Cleanup failed: %v", err)
+	}
+	log.Println("[OS] Cleanup complete.")
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/songgao/water"
+
+	"go-mesh-hub/internal/metrics"
+	"go-mesh-hub/internal/security"
+)
+
+// Drop reasons of the packets the Agent doesn't deliver
+const (
+	dropNoSession = "no_session" // No keys with the Hub yet (or any more)
+	dropSendError = "send_error" // The UDP socket refused the packet
+	dropSpoofed   = "spoofed"    // A direct peer used a source it doesn't own
+)
+
+// traffic counts the data packets of one direction of a tunnel
+type traffic struct {
+	bytes   metrics.Counter
+	packets metrics.Counter
+}
+
+func (t *traffic) count(n int) {
+	t.bytes.Add(uint64(n))
+	t.packets.Inc()
+}
+
+// agentMetrics are the counters that don't belong to a single tunnel
+type agentMetrics struct {
+	decryptFailures metrics.Counter
+	drops           *metrics.CounterVec // By reason
+	tunErrors       *metrics.CounterVec // By operation: read, write
+	latency         *metrics.Histogram  // UDP receive to TUN write, TUN read to UDP send
+}
+
+func newAgentMetrics() *agentMetrics {
+	return &agentMetrics{
+		drops:     metrics.NewCounterVec(dropNoSession, dropSendError, dropSpoofed),
+		tunErrors: metrics.NewCounterVec("read", "write"),
+		latency:   metrics.NewHistogram(metrics.LatencyBuckets),
+	}
+}
+
+// dropSend counts a packet the Hub tunnel could not send
+func (m *agentMetrics) dropSend(err error) {
+	if errors.Is(err, security.ErrNoSession) {
+		m.drops.With(dropNoSession).Inc()
+	} else {
+		m.drops.With(dropSendError).Inc()
+	}
+}
+
+// writeTUN hands a packet to the kernel
+func (m *agentMetrics) writeTUN(ifce *water.Interface, packet []byte) {
+	if _, err := ifce.Write(packet); err != nil {
+		m.tunErrors.With("write").Inc()
+	}
+}
+
+// serveMetrics exposes the Agent metrics on addr (blocking, call it with 'go')
+func serveMetrics(addr string, link *tunnel, peers *peerSet, stats *agentMetrics) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Handler(func(w *metrics.Writer) {
+		stats.collect(w, link, peers)
+	}))
+	log.Printf("[INFO] Metrics available at http://%s/metrics", addr)
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	log.Printf("[ERR] Metrics listener stopped: %v", server.ListenAndServe())
+}
+
+// tunnelSample is the state of one tunnel at scrape time
+type tunnelSample struct {
+	labels    metrics.Labels
+	t         *tunnel
+	up        bool
+	handshake time.Time
+	received  time.Time
+}
+
+func sample(t *tunnel, labels metrics.Labels) tunnelSample {
+	s := tunnelSample{labels: labels, t: t}
+	if session := t.current(); session != nil {
+		s.up = true
+		s.handshake = session.Created
+	}
+	t.Lock()
+	s.received = t.lastRecv
+	t.Unlock()
+	return s
+}
+
+func (m *agentMetrics) collect(w *metrics.Writer, link *tunnel, peers *peerSet) {
+	tunnels := []tunnelSample{sample(link, metrics.Labels{"peer", "hub"})}
+	peers.Lock()
+	for key, p := range peers.peers {
+		tunnels = append(tunnels, sample(p.tunnel, metrics.Labels{"peer", key.String()}))
+	}
+	peers.Unlock()
+
+	perTunnel := []struct {
+		name, kind, help string
+		value            func(tunnelSample) float64
+	}{
+		{"gomesh_agent_tunnel_up", "gauge", "1 while the tunnel has a session key.", func(s tunnelSample) float64 {
+			if s.up {
+				return 1
+			}
+			return 0
+		}},
+		{"gomesh_agent_last_handshake_seconds", "gauge", "Unix time of the handshake that created the current session (0: none).", func(s tunnelSample) float64 { return unix(s.handshake) }},
+		{"gomesh_agent_last_received_seconds", "gauge", "Unix time of the last authenticated packet (0: none).", func(s tunnelSample) float64 { return unix(s.received) }},
+		{"gomesh_agent_rx_bytes_total", "counter", "Bytes of data packets received.", func(s tunnelSample) float64 { return float64(s.t.rx.bytes.Value()) }},
+		{"gomesh_agent_tx_bytes_total", "counter", "Bytes of data packets sent.", func(s tunnelSample) float64 { return float64(s.t.tx.bytes.Value()) }},
+		{"gomesh_agent_rx_packets_total", "counter", "Data packets received.", func(s tunnelSample) float64 { return float64(s.t.rx.packets.Value()) }},
+		{"gomesh_agent_tx_packets_total", "counter", "Data packets sent.", func(s tunnelSample) float64 { return float64(s.t.tx.packets.Value()) }},
+	}
+	for _, metric := range perTunnel {
+		w.Header(metric.name, metric.kind, metric.help)
+		for _, s := range tunnels {
+			w.Sample(metric.name, s.labels, metric.value(s))
+		}
+	}
+
+	w.Counter("gomesh_agent_decrypt_failures_total", "Transport packets that failed to decrypt (no session, bad tag, replayed).", &m.decryptFailures)
+	w.CounterVec("gomesh_agent_dropped_packets_total", "Packets not delivered, by reason.", "reason", m.drops)
+	w.CounterVec("gomesh_agent_tun_errors_total", "Errors reading from or writing to the TUN device.", "op", m.tunErrors)
+	w.Histogram("gomesh_agent_forward_latency_seconds", "Time from receiving a packet to forwarding it.", m.latency)
+}
+
+func unix(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.Unix())
+}
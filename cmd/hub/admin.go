@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"go-mesh-hub/internal/config"
+	"go-mesh-hub/internal/history"
+	"go-mesh-hub/internal/protocol"
+	"go-mesh-hub/internal/security"
+)
+
+// The methods below are the control surface used by the admin API
+// (dashboard.Hub).
+
+// disconnect forgets the sessions of a peer and withdraws its subnets. The
+// peer keeps its addresses and may connect again.
+func (h *hub) disconnect(peer security.PublicKey) {
+	addr := h.registry.AddrOf(peer)
+	h.registry.Remove(peer)
+	if h.table.SetSubnets(peer.String(), addr, nil) {
+		h.syncRoutes()
+	}
+}
+
+// PeerName returns the configured name of a peer and whether it is authorized
+func (h *hub) PeerName(peer security.PublicKey) (string, bool) {
+	return h.registry.Authorized(peer)
+}
+
+// KeyInfo exposes the session key state of the registry
+func (h *hub) KeyInfo(identity string) (uint64, time.Time, bool) {
+	return h.registry.KeyInfo(identity)
+}
+
+// Kick closes the session of a peer. Agents reconnect on their own, so this
+// forces a new handshake. It returns false if the peer wasn't connected.
+func (h *hub) Kick(peer security.PublicKey) bool {
+	session := h.registry.ByPeer(peer)
+	if session == nil {
+		return false
+	}
+	h.dropDirect(peer)
+	h.send(session, protocol.TypeDisconnect, nil, nil)
+	h.disconnect(peer)
+	name, _ := h.registry.Authorized(peer)
+	log.Printf("[SEC] Peer %s (%s) kicked by the admin API", name, peer)
+	return true
+}
+
+// Ban closes the session of a peer and refuses its handshakes until it is
+// unbanned or the Hub restarts
+func (h *hub) Ban(peer security.PublicKey) {
+	h.registry.Ban(peer)
+	log.Printf("[SEC] Peer %s banned by the admin API", peer)
+	// Kick drops its direct tunnels, which go even if it isn't connected
+	if !h.Kick(peer) {
+		h.dropDirect(peer)
+	}
+}
+
+// Unban lets a banned peer connect again
+func (h *hub) Unban(peer security.PublicKey) bool {
+	if !h.registry.Unban(peer) {
+		return false
+	}
+	log.Printf("[SEC] Peer %s unbanned by the admin API", peer)
+	return true
+}
+
+// Bans lists the banned identities
+func (h *hub) Bans() []security.PublicKey {
+	return h.registry.Bans()
+}
+
+// ExitNodes returns the Virtual IPs of the current Exit Nodes, in order of
+// preference
+func (h *hub) ExitNodes() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.exitNodes...)
+}
+
+// SetExitNodes changes the Exit Nodes until the next reload, which goes
+// back to the configured ones
+func (h *hub) SetExitNodes(ips []string) error {
+	if err := h.setExitNodes(ips); err != nil {
+		return err
+	}
+	log.Printf("[NAT] Exit Nodes changed to %v by the admin API", ips)
+	return nil
+}
+
+// AssignExit pins the Exit Node of a peer until the next reload ("" lets
+// the Agent's request or the default apply again)
+func (h *hub) AssignExit(peer security.PublicKey, ip string) error {
+	if ip != "" && !slices.Contains(h.ExitNodes(), ip) {
+		return fmt.Errorf("%s is not an Exit Node", ip)
+	}
+	h.table.AssignExit(peer.String(), ip)
+	name, _ := h.registry.Authorized(peer)
+	log.Printf("[ROUTER] Exit Node of %s set to %q by the admin API", name, ip)
+	return nil
+}
+
+// Config returns the configuration last loaded, at startup or by a reload
+func (h *hub) Config() *config.Config {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.current
+}
+
+// History returns the per-peer traffic history
+func (h *hub) History() *history.Store {
+	return h.history
+}
+
+// Started returns when the Hub came up
+func (h *hub) Started() time.Time {
+	return h.started
+}
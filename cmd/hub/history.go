@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"sort"
+	"time"
+
+	"go-mesh-hub/internal/history"
+	"go-mesh-hub/internal/protocol"
+	"go-mesh-hub/internal/router"
+	"go-mesh-hub/internal/security"
+)
+
+// historySaveInterval is how often the history is written to disk (it is
+// also written on shutdown)
+const historySaveInterval = 5 * time.Minute
+
+// record samples the routing table into the history and pings every
+// connected Agent, whose answer gives the RTT of the next sample
+func (h *hub) record() {
+	ticker := time.NewTicker(history.Interval)
+	lastSave := time.Now()
+	for now := range ticker.C {
+		h.history.Record(now, h.samples())
+		h.ping(now)
+
+		if now.Sub(lastSave) >= historySaveInterval {
+			if err := h.history.Save(); err != nil {
+				log.Printf("[HIST] Failed to save the history: %v", err)
+			}
+			lastSave = now
+		}
+	}
+}
+
+// samples aggregates the routing table per identity
+func (h *hub) samples() map[string]history.Sample {
+	h.rttMu.Lock()
+	rtt := h.rtt
+	h.rtt = make(map[security.PublicKey]time.Duration)
+	h.rttMu.Unlock()
+
+	samples := make(map[string]history.Sample)
+	for _, p := range h.table.Snapshot() {
+		s := samples[p.Identity]
+		s.Addresses = append(s.Addresses, p.VirtualIP)
+		s.RxBytes += p.RxBytes
+		s.TxBytes += p.TxBytes
+		s.Online = s.Online || p.State != router.StateExpired
+		samples[p.Identity] = s
+	}
+	for identity, s := range samples {
+		sort.Strings(s.Addresses)
+		if key, err := security.ParsePublicKey(identity); err == nil {
+			s.Name, _ = h.registry.Authorized(key)
+			s.RTT = rtt[key]
+		}
+		samples[identity] = s
+	}
+	return samples
+}
+
+// ping sends a ControlPing carrying the send time to every connected Agent
+func (h *hub) ping(now time.Time) {
+	cookie := binary.LittleEndian.AppendUint64(nil, uint64(now.UnixNano()))
+	msg := protocol.MarshalControl(protocol.ControlPing, []protocol.Attr{{Type: protocol.AttrCookie, Value: cookie}})
+	for _, session := range h.registry.Active() {
+		h.send(session, protocol.TypeControl, msg, nil)
+	}
+}
+
+// handleControl processes a control message from an Agent
+func (h *hub) handleControl(session *security.Session, plaintext []byte) {
+	code, attrs, err := protocol.ParseControl(plaintext)
+	if err != nil || code != protocol.ControlPong {
+		return
+	}
+	cookie, ok := protocol.Find(attrs, protocol.AttrCookie)
+	if !ok || len(cookie.Value) != 8 {
+		return
+	}
+	rtt := time.Since(time.Unix(0, int64(binary.LittleEndian.Uint64(cookie.Value))))
+	if rtt <= 0 || rtt > history.Interval {
+		return // Not one of our recent pings
+	}
+	h.rttMu.Lock()
+	h.rtt[session.Remote] = rtt
+	h.rttMu.Unlock()
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/songgao/water"
+
+	"go-mesh-hub/internal/config"
+	"go-mesh-hub/internal/history"
+	"go-mesh-hub/internal/ipam"
+	"go-mesh-hub/internal/policy"
+	"go-mesh-hub/internal/protocol"
+	"go-mesh-hub/internal/router"
+	"go-mesh-hub/internal/security"
+	"go-mesh-hub/internal/tun"
+)
+
+// hub bundles the state shared by the forwarding loops and the handlers
+type hub struct {
+	cfg      *config.Config
+	key      security.PrivateKey
+	conn     *net.UDPConn
+	ifce     *water.Interface
+	registry *security.Registry
+	table    *router.Table
+	pools    []*ipam.Pool // IPv4 and/or IPv6 address pools
+	stats    *hubMetrics
+	history  *history.Store
+	policy   *policy.Engine
+
+	rttMu sync.Mutex
+	rtt   map[security.PublicKey]time.Duration // Last ping answer per peer
+
+	started time.Time
+
+	mu         sync.Mutex
+	current    *config.Config // Last configuration loaded (cfg holds the startup one)
+	exitNodes  []string       // Current Exit Nodes (may change on reload or through the API)
+	cleanupNAT func()         // Set while the Hub itself is the Exit Node
+
+	routesMu     sync.Mutex
+	kernelRoutes map[string]bool // Subnet routes installed on the Hub's TUN
+
+	introMu    sync.Mutex
+	introduced map[peerPair]time.Time // Peer pairs last told to punch
+}
+
+// peerPair is an unordered pair of Agents, the lower key first
+type peerPair struct {
+	a, b security.PublicKey
+}
+
+func newPeerPair(x, y security.PublicKey) peerPair {
+	if x.String() > y.String() {
+		x, y = y, x
+	}
+	return peerPair{x, y}
+}
+
+// introduceInterval limits how often the Hub asks the same pair of Agents
+// to try a direct tunnel while it keeps relaying traffic between them
+const introduceInterval = time.Minute
+
+// reapInterval is how often peer states are refreshed
+const reapInterval = 5 * time.Second
+
+// handleHandshake answers a Noise IK initiation from an authorized peer
+func (h *hub) handleHandshake(packet []byte, header protocol.Header, body []byte, remoteAddr *net.UDPAddr) {
+	sender, msg, err := protocol.SplitHandshake(body)
+	if err != nil {
+		return
+	}
+	prologue := packet[:protocol.HeaderSize+protocol.IndexSize]
+
+	hs, ts, payload, err := security.ConsumeInitiation(h.key, prologue, msg)
+	if err != nil {
+		return // Garbage or not encrypted to our key
+	}
+
+	name, ok := h.registry.Authorized(hs.Remote())
+	if !ok {
+		log.Printf("[SEC] Rejected handshake from unknown key %s at %s", hs.Remote(), remoteAddr)
+		return
+	}
+	if h.registry.Banned(hs.Remote()) {
+		log.Printf("[SEC] Rejected handshake from banned peer %s (%s)", name, remoteAddr)
+		return
+	}
+	if !h.registry.AcceptTimestamp(hs.Remote(), ts) {
+		log.Printf("[SEC] Rejected replayed handshake from %s (%s)", name, remoteAddr)
+		return
+	}
+
+	// Deliver the peer's Virtual IPs (one per pool) inside the encrypted response
+	var attrs []protocol.Attr
+	for _, pool := range h.pools {
+		ip, err := pool.Lease(hs.Remote().String())
+		if err != nil {
+			log.Printf("[IPAM] No address for %s in %s: %v", name, pool.Network(), err)
+			return
+		}
+		bits := len(ip) * 8
+		h.registry.Allow(hs.Remote(), &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		attrs = append(attrs, protocol.PrefixAttr(protocol.AttrAddress, &net.IPNet{IP: ip, Mask: pool.Network().Mask}))
+	}
+
+	// Subnets advertised by the peer, limited to what its allowed IPs cover
+	requested, err := protocol.ParseAttrs(payload)
+	if err != nil {
+		return
+	}
+	var subnets []*net.IPNet
+	for _, prefix := range protocol.Prefixes(requested, protocol.AttrRoute) {
+		if !h.registry.Covers(hs.Remote(), prefix) {
+			log.Printf("[ROUTE] Ignoring subnet %s from %s: outside its allowed IPs", prefix, name)
+			continue
+		}
+		subnets = append(subnets, prefix)
+	}
+	attrs = append(attrs, h.meshRoutes(hs.Remote().String())...)
+
+	// The Exit Node the Agent would like to use, among ours: any other
+	// request clears its preference
+	exitVia := ""
+	for _, prefix := range protocol.Prefixes(requested, protocol.AttrExitNode) {
+		exitVia = prefix.IP.String()
+		if !slices.Contains(h.ExitNodes(), exitVia) {
+			log.Printf("[ROUTER] %s asked for Exit Node %s, which is not one of %v", name, exitVia, h.ExitNodes())
+			exitVia = ""
+		}
+	}
+	h.table.RequestExit(hs.Remote().String(), exitVia)
+	// Whether the Agent itself can carry the Internet traffic of the mesh
+	_, offered := protocol.Find(requested, protocol.AttrExitOffer)
+	if h.table.OfferExit(hs.Remote().String(), offered) {
+		if offered {
+			log.Printf("[ROUTER] %s can serve as an Exit Node (list its Virtual IP in exit-node to use it)", name)
+		} else {
+			log.Printf("[ROUTER] %s no longer serves as an Exit Node", name)
+		}
+	}
+
+	// Answer with the initiator's protocol version
+	index := h.registry.AllocateIndex()
+	respHeader := protocol.Header{Version: header.Version, Type: protocol.TypeHandshakeResponse, Receiver: sender}
+	response, session, err := hs.CreateResponse(protocol.AppendHandshake(nil, respHeader, index), protocol.MarshalAttrs(attrs))
+	if err != nil {
+		log.Printf("[SEC] Handshake with %s failed: %v", name, err)
+		h.registry.ReleaseIndex(index)
+		return
+	}
+	session.LocalIndex = index
+	session.RemoteIndex = sender
+
+	h.registry.Establish(remoteAddr.String(), session)
+	if _, err := h.conn.WriteToUDP(response, remoteAddr); err != nil {
+		return
+	}
+	log.Printf("[SEC] Handshake completed with %s (%s)", name, remoteAddr)
+
+	if h.table.SetSubnets(hs.Remote().String(), remoteAddr, subnets) {
+		h.syncRoutes()
+	}
+}
+
+// meshRoutes lists the subnets advertised by every peer except identity
+func (h *hub) meshRoutes(identity string) []protocol.Attr {
+	var attrs []protocol.Attr
+	for _, subnet := range h.table.Subnets() {
+		if subnet.Identity != identity {
+			attrs = append(attrs, protocol.PrefixAttr(protocol.AttrRoute, subnet.Prefix))
+		}
+	}
+	return attrs
+}
+
+// syncRoutes installs kernel routes for every advertised subnet on the Hub
+// and pushes the updated list to all connected peers
+func (h *hub) syncRoutes() {
+	h.routesMu.Lock()
+	defer h.routesMu.Unlock()
+
+	current := make(map[string]bool)
+	for _, subnet := range h.table.Subnets() {
+		prefix := subnet.Prefix.String()
+		current[prefix] = true
+		if !h.kernelRoutes[prefix] {
+			if err := tun.AddRoute(h.ifce.Name(), prefix); err != nil {
+				log.Printf("[ROUTE] %v", err)
+				continue
+			}
+		}
+	}
+	for prefix := range h.kernelRoutes {
+		if !current[prefix] {
+			tun.DelRoute(h.ifce.Name(), prefix)
+		}
+	}
+	h.kernelRoutes = current
+
+	for _, session := range h.registry.Active() {
+		msg := protocol.MarshalControl(protocol.ControlRoutes, h.meshRoutes(session.Remote.String()))
+		h.send(session, protocol.TypeControl, msg, nil)
+	}
+}
+
+// forwardPacket handles encryption and transmission based on routing rules.
+// src is the identity of the sender ("" for the Hub), whose Exit Node
+// carries its Internet traffic.
+func (h *hub) forwardPacket(data []byte, src, dstIP string) {
+
+	targetAddr, found := h.table.GetRoute(src, dstIP)
+
+	if !found {
+		// Drop: No route to host (neither Peer nor Exit Node)
+		h.stats.drops.With(dropNoRoute).Inc()
+		return
+	}
+
+	// Each peer has its own transport keys
+	session := h.registry.ByAddr(targetAddr.String())
+	if session == nil {
+		h.stats.drops.With(dropNoSession).Inc()
+		return
+	}
+
+	// re-encryping
+	if h.send(session, protocol.TypeData, data, targetAddr) != nil {
+		return
+	}
+
+	// Update Dashboard Stats (Tx)
+	h.table.RecordTx(dstIP, len(data))
+}
+
+// returnPath tells whether an Agent may send a packet from src, an address
+// that is not its own: only replies from the Internet for a peer, or for
+// the Hub, whose traffic recently went out through it as an Exit Node. It
+// returns the Virtual IP of that Exit Node. A source owned by the mesh is
+// never a reply from the Internet.
+func (h *hub) returnPath(exit security.PublicKey, src, dst net.IP) (string, bool) {
+	if h.inMesh(src) {
+		return "", false
+	}
+	owner := "" // The Hub itself
+	if !h.isLocal(dst) {
+		var known bool
+		if owner, known = h.table.Owner(dst.String()); !known {
+			return "", false
+		}
+	}
+	return h.table.ReturnPath(exit.String(), owner)
+}
+
+// inMesh reports whether ip belongs to the mesh: the Hub, an address pool
+// (leased or not), a route or subnet of a peer, or the allowed IPs of one
+func (h *hub) inMesh(ip net.IP) bool {
+	if h.isLocal(ip) {
+		return true
+	}
+	for _, pool := range h.pools {
+		if pool.Network().Contains(ip) {
+			return true
+		}
+	}
+	if _, ok := h.table.Owner(ip.String()); ok {
+		return true
+	}
+	_, ok := h.registry.Owner(ip)
+	return ok
+}
+
+// reap periodically refreshes the liveness of the peers. Expired peers stop
+// receiving traffic at once (the table checks it on every lookup); once
+// they are forgotten, the subnets they advertised are withdrawn.
+// Idle flows of the policy are closed too.
+func (h *hub) reap() {
+	ticker := time.NewTicker(reapInterval)
+	for now := range ticker.C {
+		if h.table.Reap() {
+			h.syncRoutes()
+		}
+		h.policy.Expire(now)
+	}
+}
+
+// writeTUN hands a packet to the kernel of the Hub
+func (h *hub) writeTUN(packet []byte) {
+	if _, err := h.ifce.Write(packet); err != nil {
+		h.stats.tunErrors.With("write").Inc()
+	}
+}
+
+// isLocal reports whether ip is one of the Hub's own Virtual IPs
+func (h *hub) isLocal(ip net.IP) bool {
+	for _, own := range []string{h.cfg.TunIP, h.cfg.TunIP6} {
+		if addr := net.ParseIP(own); addr != nil && addr.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// introduce acts as rendezvous for two Agents exchanging traffic through
+// the Hub: each one learns the other's key, allowed IPs and the endpoint
+// the Hub sees, so both can punch through their NATs at the same time.
+// Relaying goes on untouched until (and unless) the direct path works.
+func (h *hub) introduce(src *security.Session, dstIP string) {
+	if h.policy.Enabled() {
+		return // A direct tunnel would bypass the acl rules
+	}
+	targetAddr, found := h.table.GetRoute(src.Remote.String(), dstIP)
+	if !found {
+		return
+	}
+	dst := h.registry.ByAddr(targetAddr.String())
+	if dst == nil || dst.Remote == src.Remote {
+		return
+	}
+
+	pair := newPeerPair(src.Remote, dst.Remote)
+	h.introMu.Lock()
+	recent := time.Since(h.introduced[pair]) < introduceInterval
+	if !recent {
+		h.introduced[pair] = time.Now()
+	}
+	h.introMu.Unlock()
+	if recent {
+		return
+	}
+
+	srcAddr := h.registry.AddrOf(src.Remote)
+	if srcAddr == nil {
+		return
+	}
+	h.send(src, protocol.TypeControl, h.peerIntro(dst.Remote, targetAddr), srcAddr)
+	h.send(dst, protocol.TypeControl, h.peerIntro(src.Remote, srcAddr), targetAddr)
+
+	srcName, _ := h.registry.Authorized(src.Remote)
+	dstName, _ := h.registry.Authorized(dst.Remote)
+	log.Printf("[P2P] Introduced %s (%s) and %s (%s)", srcName, srcAddr, dstName, targetAddr)
+}
+
+// peerIntro builds the ControlPeer message describing one Agent
+func (h *hub) peerIntro(peer security.PublicKey, endpoint *net.UDPAddr) []byte {
+	attrs := []protocol.Attr{
+		{Type: protocol.AttrPublicKey, Value: peer[:]},
+		protocol.EndpointAttr(protocol.AttrEndpoint, endpoint),
+	}
+	for _, prefix := range h.registry.AllowedIPs(peer) {
+		attrs = append(attrs, protocol.PrefixAttr(protocol.AttrAllowedIP, prefix))
+	}
+	return protocol.MarshalControl(protocol.ControlPeer, attrs)
+}
+
+// dropDirect tells every Agent introduced to peer, and peer itself, to
+// close their direct tunnels, so traffic between them goes back through
+// the Hub and its checks
+func (h *hub) dropDirect(peer security.PublicKey) {
+	h.dropPairs(func(pair peerPair) bool { return pair.a == peer || pair.b == peer })
+}
+
+// dropAllDirect closes every direct tunnel the Hub set up
+func (h *hub) dropAllDirect() {
+	h.dropPairs(func(peerPair) bool { return true })
+}
+
+func (h *hub) dropPairs(match func(peerPair) bool) {
+	h.introMu.Lock()
+	var pairs []peerPair
+	for pair := range h.introduced {
+		if match(pair) {
+			pairs = append(pairs, pair)
+			delete(h.introduced, pair)
+		}
+	}
+	h.introMu.Unlock()
+
+	for _, pair := range pairs {
+		for _, side := range [][2]security.PublicKey{{pair.a, pair.b}, {pair.b, pair.a}} {
+			if session := h.registry.ByPeer(side[0]); session != nil {
+				msg := protocol.MarshalControl(protocol.ControlDropPeer, []protocol.Attr{{Type: protocol.AttrPublicKey, Value: side[1][:]}})
+				h.send(session, protocol.TypeControl, msg, nil)
+			}
+		}
+		log.Printf("[P2P] Direct tunnel between %s and %s closed", pair.a, pair.b)
+	}
+}
+
+// send encrypts payload for a session and transmits it as msgType.
+// A nil addr means the peer's current endpoint.
+func (h *hub) send(session *security.Session, msgType protocol.MessageType, payload []byte, addr *net.UDPAddr) error {
+	if addr == nil {
+		if addr = h.registry.AddrOf(session.Remote); addr == nil {
+			return security.ErrNoSession
+		}
+	}
+	header := protocol.NewHeader(msgType, session.RemoteIndex).AppendTo(nil)
+	packet, err := session.PackAndEncrypt(header, payload)
+	if err != nil {
+		return err
+	}
+	_, err = h.conn.WriteToUDP(packet, addr)
+	return err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"go-mesh-hub/internal/config"
+	"go-mesh-hub/internal/ipam"
+	"go-mesh-hub/internal/router"
+	"go-mesh-hub/internal/security"
+)
+
+func mustKey(t *testing.T) security.PublicKey {
+	t.Helper()
+	key, err := security.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.PublicKey()
+}
+
+// A reply from the Internet is only accepted from the exit Agent of the
+// destination, and never with a source address owned by the mesh
+func TestReturnPath(t *testing.T) {
+	client, exit, other := mustKey(t), mustKey(t), mustKey(t)
+	_, lan, _ := net.ParseCIDR("192.168.50.0/24")
+	_, static, _ := net.ParseCIDR("172.16.0.0/16")
+
+	registry := security.NewRegistry(map[security.PublicKey]security.PeerInfo{
+		client: {Name: "client"},
+		exit:   {Name: "exit"},
+		other:  {Name: "other", AllowedIPs: []*net.IPNet{lan, static}},
+	}, security.DefaultLimits())
+	pool, err := ipam.New("10.0.0.0/24", []string{"10.0.0.1"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &hub{
+		cfg:      &config.Config{TunIP: "10.0.0.1"},
+		registry: registry,
+		table:    router.NewTable(),
+		pools:    []*ipam.Pool{pool},
+	}
+
+	h.table.SetExitNodes([]router.Exit{{IP: "10.0.0.3", Identity: exit.String()}})
+	h.table.OfferExit(exit.String(), true)
+	for _, p := range []struct {
+		ip   string
+		key  security.PublicKey
+		addr string
+	}{
+		{"10.0.0.2", client, "192.0.2.2:5000"},
+		{"10.0.0.3", exit, "192.0.2.3:5000"},
+		{"10.0.0.4", other, "192.0.2.4:5000"},
+	} {
+		addr, _ := net.ResolveUDPAddr("udp", p.addr)
+		h.table.Learn(p.ip, p.key.String(), addr)
+	}
+	h.table.SetSubnets(other.String(), nil, []*net.IPNet{lan})
+
+	// The client browses the Internet through the exit Agent
+	if _, ok := h.table.GetRoute(client.String(), "198.51.100.1"); !ok {
+		t.Fatal("no route to the Internet through the exit Agent")
+	}
+
+	tests := []struct {
+		name string
+		from security.PublicKey
+		src  string
+		dst  string
+		want bool
+	}{
+		{"reply from the Internet", exit, "198.51.100.1", "10.0.0.2", true},
+		{"from another exit", other, "198.51.100.1", "10.0.0.2", false},
+		{"to a peer that did not use the exit", exit, "198.51.100.1", "10.0.0.4", false},
+		{"to an unknown address", exit, "198.51.100.1", "10.9.9.9", false},
+		{"source is a Virtual IP", exit, "10.0.0.4", "10.0.0.2", false},
+		{"source is an unleased pool address", exit, "10.0.0.200", "10.0.0.2", false},
+		{"source is the Hub", exit, "10.0.0.1", "10.0.0.2", false},
+		{"source is an advertised subnet", exit, "192.168.50.7", "10.0.0.2", false},
+		{"source is in the allowed IPs of a peer", exit, "172.16.1.1", "10.0.0.2", false},
+	}
+	for _, tt := range tests {
+		ip, ok := h.returnPath(tt.from, net.ParseIP(tt.src), net.ParseIP(tt.dst))
+		if ok != tt.want {
+			t.Errorf("%s: returnPath = %q, %v; want %v", tt.name, ip, ok, tt.want)
+		}
+		if ok && ip != "10.0.0.3" {
+			t.Errorf("%s: exit = %q, want 10.0.0.3", tt.name, ip)
+		}
+	}
+}
@@ -1,15 +1,25 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
-	
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
 	"go-mesh-hub/internal/config"
 	"go-mesh-hub/internal/dashboard"
+	"go-mesh-hub/internal/history"
+	"go-mesh-hub/internal/ipam"
+	"go-mesh-hub/internal/policy"
+	"go-mesh-hub/internal/protocol"
 	"go-mesh-hub/internal/router"
 	"go-mesh-hub/internal/security"
 	"go-mesh-hub/internal/tun"
@@ -17,41 +27,83 @@ import (
 
 func main() {
 	// 1. Load Configuration
-	cfg := config.Load()
-	
-	// 2. Initialize Security
-	sec, err := security.New(cfg.Secret)
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("[CRIT] Invalid configuration:\n%v", err)
+	}
+	if cfg.Cleanup {
+		cleanup(cfg.NetBackend, cfg.StateFile)
+		return
+	}
+	if cfg.HashPassword {
+		printPasswordHash()
+		return
+	}
+	peers, err := cfg.LoadPeers()
+	if err != nil {
+		log.Fatalf("[CRIT] Failed to load authorized peers: %v", err)
+	}
+	if cfg.CheckConfig {
+		log.Printf("[CONF] Configuration OK (%d authorized peers)", len(peers))
+		return
+	}
+
+	// 2. Initialize Security (static identity + authorized peers)
+	privateKey, err := security.LoadOrCreatePrivateKey(cfg.KeyFile)
 	if err != nil {
-		log.Fatalf("[CRIT] Crypto init failed: %v", err)
+		log.Fatalf("[CRIT] Failed to load private key: %v", err)
+	}
+	log.Printf("[SEC] Hub public key: %s", privateKey.PublicKey())
+
+	authorized := authorizedSet(cfg, peers)
+	limits := security.NewLimits(cfg.RekeyAfter, cfg.RekeyAfterPackets)
+	registry := security.NewRegistry(authorized, limits)
+	log.Printf("[SEC] %d authorized peers loaded", len(authorized))
+
+	// IP Address Management (optional, one pool per address family)
+	var pools []*ipam.Pool
+	if cfg.Pool != "" {
+		pools = append(pools, newPool(cfg.Pool, cfg.TunIP, cfg.LeasesFile, peers))
+	}
+	if cfg.Pool6 != "" {
+		pools = append(pools, newPool(cfg.Pool6, cfg.TunIP6, cfg.LeasesFile6, peers))
 	}
 
 	// 3. Initialize TUN
-	ifce, err := tun.Setup(cfg.TunIP)
+	addrs := []string{tunAddress(cfg.TunIP, pools)}
+	if cfg.TunIP6 != "" {
+		addrs = append(addrs, tunAddress(cfg.TunIP6, pools))
+	}
+	if err := tun.SetBackend(cfg.NetBackend); err != nil {
+		log.Fatalf("[CRIT] %v", err)
+	}
+	if err := tun.SetFirewall(cfg.Firewall); err != nil {
+		log.Fatalf("[CRIT] Firewall %s unavailable: %v", cfg.Firewall, err)
+	}
+	// Revert what a crashed run left behind, then journal our own changes
+	if err := tun.OpenJournal(cfg.StateFile, false); err != nil {
+		log.Fatalf("[CRIT] %v", err)
+	}
+	ifce, err := tun.Setup(cfg.MTU, addrs...)
 	if err != nil {
 		log.Fatalf("[CRIT] TUN setup failed: %v", err)
 	}
 
+	// Traffic and availability history, kept across restarts
+	peerHistory, err := history.Open(cfg.HistoryFile)
+	if err != nil {
+		log.Fatalf("[CRIT] Failed to load the peer history: %v", err)
+	}
+
 	// 4. Initialize Routing Table
 	routeTable := router.NewTable()
-	if cfg.ExitNodeIP != "" {
-        routeTable.SetExitNode(cfg.ExitNodeIP)
-    }
-
-	var cleanupNAT func()
-	// --- EXIT NODE CONFIGURATION ---
-    if cfg.ExitNodeIP == cfg.TunIP {
-        // we call our new function
-        cleanupNAT, err = tun.EnableExitNode(ifce.Name())
-        if err != nil {
-            log.Fatalf("[CRIT] Failed to enable Exit Node: %v", err)
-        }
-		log.Printf("[NAT] Exit Node Enabled on %s. Traffic will be masqueraded via host interface.", cfg.ExitNodeIP)
-        // ensure rules are deleted when we kill the app
-        defer cleanupNAT() 
-    }
+	routeTable.SetThresholds(cfg.IdleAfter, cfg.DeadAfter)
+	routeTable.SetLocal(cfg.TunIP, cfg.TunIP6)
 
 	// 5. Start UDP Listener
-	localAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", cfg.LocalPort))
+	// An empty -listen-ip binds the wildcard address, which on Linux is
+	// dual-stack: Agents can reach the Hub over IPv4 or IPv6
+	localAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(cfg.ListenIP, strconv.Itoa(cfg.LocalPort)))
 	if err != nil {
 		log.Fatalf("[CRIT] UDP resolve failed: %v", err)
 	}
@@ -62,81 +114,206 @@ func main() {
 	defer conn.Close()
 	log.Printf("[INFO] VPN Server listening on %s", localAddr)
 
-	// For clean the iptable to restore internet
+	h := &hub{
+		cfg:      cfg,
+		key:      privateKey,
+		conn:     conn,
+		ifce:     ifce,
+		registry: registry,
+		table:    routeTable,
+		pools:    pools,
+		stats:    newHubMetrics(),
+		history:  peerHistory,
+		policy:   policy.New(),
+		rtt:      make(map[security.PublicKey]time.Duration),
+		started:  time.Now(),
+		current:  cfg,
+
+		introduced: make(map[peerPair]time.Time),
+	}
+
+	// Forwarding policy (acl rules), default deny once configured
+	h.applyPolicy(cfg, peers)
+
+	// --- EXIT NODE CONFIGURATION ---
+	// NAT rules are installed when the Hub itself is one of the Exit Nodes
+	if err := h.setExitNodes(cfg.ExitNodes); err != nil {
+		log.Fatalf("[CRIT] Failed to enable Exit Node: %v", err)
+	}
+	h.assignExits(peers)
+	// ensure rules are deleted when we kill the app
+	defer h.shutdown()
+
+	// SIGHUP reloads the configuration, anything else shuts down
+	// (and cleans the iptables rules to restore internet)
 	go func() {
 		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 		// blocking here waiting the signal
-		sig := <-sigChan
-	
-		fmt.Println()
-		log.Printf("[OS] Received signal: %v. Cleaning up...", sig)
-		// 1. Restore IPTables / NAT 
-		if cleanupNAT != nil {
-			cleanupNAT()
+		for sig := range sigChan {
+			if sig == syscall.SIGHUP {
+				log.Println("[OS] Received SIGHUP. Reloading configuration...")
+				h.reload()
+				continue
+			}
+
+			fmt.Println()
+			log.Printf("[OS] Received signal: %v. Cleaning up...", sig)
+			// 1. Restore IPTables / NAT
+			h.shutdown()
+			// 2. close conections
+			conn.Close()
+			ifce.Close()
+			log.Println("[OS] Cleanup complete. Exiting.")
+			os.Exit(0) // Matamos el programa limpiamente
 		}
-		// 2. close conections
-		conn.Close()
-		ifce.Close()
-		log.Println("[OS] Cleanup complete. Exiting.")
-		os.Exit(0) // Matamos el programa limpiamente
 	}()
 
+	// Expire and forget peers that went silent
+	go h.reap()
+	// Per-peer history for the dashboard charts
+	go h.record()
+
 	// 6. START DASHBOARD (Non-blocking)
-	go dashboard.Start(cfg.WebPort, routeTable)
+	web := dashboard.Options{
+		Addr:     net.JoinHostPort(cfg.WebIP, strconv.Itoa(cfg.WebPort)),
+		TLS:      cfg.WebTLS,
+		CertFile: cfg.WebCert,
+		KeyFile:  cfg.WebKey,
+		Hosts:    []string{"localhost", "127.0.0.1", "::1", cfg.WebIP, cfg.TunIP, cfg.TunIP6},
+		Logins:   cfg.WebLogins(),
+		Tokens:   cfg.WebTokenHashes(),
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		web.Hosts = append(web.Hosts, hostname)
+	}
+	go dashboard.Start(web, routeTable, h)
 
 	// --- LOOP 1: INBOUND (Internet -> Decrypt -> TUN) ---
 	go func() {
 		buf := make([]byte, 2048)
 		for {
 			n, remoteAddr, err := conn.ReadFromUDP(buf)
+			if err != nil || n == 0 {
+				continue
+			}
+			received := time.Now()
+
+			header, body, err := protocol.Parse(buf[:n])
 			if err != nil {
+				continue // Not ours, or a protocol version we don't speak
+			}
+
+			if header.Type == protocol.TypeHandshakeInit {
+				h.handleHandshake(buf[:n], header, body, remoteAddr)
 				continue
 			}
+			if !header.Type.IsTransport() {
+				continue // The Hub never initiates, so it never gets responses
+			}
 
-			plaintext, err := sec.DecryptUnpack(buf[:n])
+			// The receiver index selects the session (current, next or previous keys)
+			plaintext, session, err := registry.Decrypt(remoteAddr.String(), header.Receiver, buf[:protocol.HeaderSize], body)
 			if err != nil {
-				continue // Auth fail
+				h.stats.decryptFailures.Inc()
+				continue // No session, auth fail, replayed or too old (counted by the session)
 			}
+			// Any authenticated packet, keepalives included, keeps the peer alive
+			routeTable.Touch(session.Remote.String(), remoteAddr)
 
-			if len(plaintext) == 0 {
-				continue // Heartbeat
+			switch header.Type {
+			case protocol.TypeKeepalive:
+				continue
+			case protocol.TypeDisconnect:
+				name, _ := registry.Authorized(session.Remote)
+				log.Printf("[NET] Peer %s (%s) disconnected", name, remoteAddr)
+				h.disconnect(session.Remote)
+				continue
+			case protocol.TypeControl:
+				h.handleControl(session, plaintext)
+				continue
 			}
 
-			// IPv4 Inspection
-			if len(plaintext) >= 20 {
-				srcIP := net.IP(plaintext[12:16]).String()
-				dstIP := net.IP(plaintext[16:20]).String()
+			// IP Inspection (IPv4 and IPv6)
+			if src, dst, ok := tun.Addresses(plaintext); ok {
+				srcIP := src.String()
+				dstIP := dst.String()
 
-				if srcIP == "0.0.0.0" {
+				if src.IsUnspecified() {
 					continue
 				}
 
-				// A. Learn Route & Record Stats
-				routeTable.Learn(srcIP, remoteAddr)
-				routeTable.RecordRx(srcIP, len(plaintext)) // Update Dashboard Stats
+				// A. Anti-Spoofing: the inner source must belong to the sender's identity,
+				// unless the sender is an Exit Node returning a reply from the Internet
+				if !registry.Allows(session.Remote, src) {
+					exit, ok := h.returnPath(session.Remote, src, dst)
+					if !ok {
+						name, _ := registry.Authorized(session.Remote)
+						log.Printf("[SEC] Spoofing attempt: %s (%s) sent packet from %s", name, remoteAddr, srcIP)
+						h.stats.drops.With(dropSpoofed).Inc()
+						continue
+					}
+					routeTable.RecordRx(exit, len(plaintext))
+					if !h.allowed(session.Remote.String(), plaintext, dstIP, received) {
+						h.stats.drops.With(dropPolicy).Inc()
+						continue
+					}
+					if h.isLocal(dst) {
+						h.writeTUN(plaintext)
+					} else {
+						h.forwardPacket(plaintext, session.Remote.String(), dstIP)
+					}
+					h.stats.latency.Since(received)
+					continue
+				}
 
-				// B. Routing Decision
-                isPeer := routeTable.Lookup(dstIP) != nil
+				// B. Learn Route & Record Stats. Hosts on a LAN the peer
+				// advertises are not peers: their traffic counts for the peer
+				if routeTable.Advertises(session.Remote.String(), src) {
+					routeTable.RecordSubnetRx(session.Remote.String(), remoteAddr, len(plaintext))
+				} else if !routeTable.Learn(srcIP, session.Remote.String(), remoteAddr) {
+					h.stats.drops.With(dropSpoofed).Inc()
+					continue
+				} else {
+					routeTable.RecordRx(srcIP, len(plaintext)) // Update Dashboard Stats
+				}
 
-                if isPeer {
+				// C. Policy: the acl rules apply to every destination
+				if !h.allowed(session.Remote.String(), plaintext, dstIP, received) {
+					h.stats.drops.With(dropPolicy).Inc()
+					continue
+				}
+
+				// D. Routing Decision
+				isPeer := routeTable.Lookup(dstIP) != nil
+
+				if isPeer {
 					//It's internal VPN traffic
-                    forwardPacket(plaintext, dstIP, conn, sec, routeTable)
-                
-                } else if dstIP == cfg.TunIP {
-                    // It's for me: Eg. ping to Hub
-                    ifce.Write(plaintext)
-                
-                } else if cfg.ExitNodeIP == cfg.TunIP {
-			        //It's Internet traffic! (e.g., Destination 8.8.8.8)
-				    //Since I'm the Exit Node and I've already enabled NAT, I inject the packet
-				    //into my TUN interface. The Linux kernel will see that it's for 8.8.8.8
-				    //and will route it through eth0 using Masquerade.
-                    ifce.Write(plaintext)
-                
-                } else {
-                    log.Printf("Drop: Unknown destination %s", dstIP)
-                }
+					h.forwardPacket(plaintext, session.Remote.String(), dstIP)
+					// Offer both Agents a direct tunnel so the next packets skip us
+					h.introduce(session, dstIP)
+
+				} else if h.isLocal(dst) {
+					// It's for me: Eg. ping to Hub
+					h.writeTUN(plaintext)
+
+				} else if exit, ok := routeTable.ExitFor(session.Remote.String()); ok && h.isLocal(net.ParseIP(exit)) {
+					//It's Internet traffic! (e.g., Destination 8.8.8.8)
+					//Since I'm the Exit Node of this peer and I've already enabled NAT, I inject the packet
+					//into my TUN interface. The Linux kernel will see that it's for 8.8.8.8
+					//and will route it through eth0 using Masquerade.
+					h.writeTUN(plaintext)
+
+				} else if ok {
+					// Internet traffic for the Agent serving as this peer's Exit Node
+					h.forwardPacket(plaintext, session.Remote.String(), dstIP)
+
+				} else {
+					log.Printf("Drop: Unknown destination %s", dstIP)
+					h.stats.drops.With(dropUnknownDest).Inc()
+					continue
+				}
+				h.stats.latency.Since(received)
 			}
 		}
 	}()
@@ -146,35 +323,70 @@ func main() {
 	for {
 		n, err := ifce.Read(packet)
 		if err != nil {
+			h.stats.tunErrors.With("read").Inc()
 			//log.Fatalf("[CRIT] TUN Read Error: %v", err)
 			return
 		}
-		
-		if n < 20 { continue }
 
-		dstIP := net.IP(packet[16:20]).String()
-		forwardPacket(packet[:n], dstIP, conn, sec, routeTable)
+		_, dst, ok := tun.Addresses(packet[:n])
+		if !ok {
+			continue
+		}
+		h.track(packet[:n], time.Now())
+		h.forwardPacket(packet[:n], "", dst.String())
 	}
 }
 
-// forwardPacket handles encryption and transmission based on routing rules
-func forwardPacket(data []byte, dstIP string, conn *net.UDPConn, sec *security.Manager, table *router.Table) {
-	
-	targetAddr, found := table.GetRoute(dstIP)
-    
-    if !found {
-        // Drop: No route to host (neither Peer nor Exit Node)
-        return 
-    }
-
-	// re-encryping
-	encryptedData, err := sec.PackAndEncrypt(data)
+// newPool opens an IPAM pool and pins the single addresses of the peers
+// file that fall inside it as static leases
+func newPool(cidr, hubIP, leasesFile string, peers []config.Peer) *ipam.Pool {
+	pool, err := ipam.New(cidr, []string{hubIP}, leasesFile)
 	if err != nil {
-		return
+		log.Fatalf("[CRIT] IPAM init failed: %v", err)
+	}
+	if err := reserveStatic(pool, peers); err != nil {
+		log.Fatalf("[CRIT] IPAM reservation failed: %v", err)
 	}
+	log.Printf("[IPAM] Leasing addresses from %s", pool.Network())
+	return pool
+}
 
-	conn.WriteToUDP(encryptedData, targetAddr)
-	
-	// Update Dashboard Stats (Tx)
-	table.RecordTx(dstIP, len(data)) 
+// tunAddress gives an address of the Hub the prefix length of the pool it
+// is in, so the whole pool is routed through the TUN. Outside a pool
+// tun.ParseAddress picks /24 or /64.
+func tunAddress(ip string, pools []*ipam.Pool) string {
+	addr := net.ParseIP(ip)
+	for _, pool := range pools {
+		if network := pool.Network(); network.Contains(addr) {
+			ones, _ := network.Mask.Size()
+			return fmt.Sprintf("%s/%d", ip, ones)
+		}
+	}
+	return ip
+}
+
+// printPasswordHash reads a dashboard password from stdin and prints the
+// bcrypt hash to put in web-users
+func printPasswordHash() {
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		log.Fatalf("[CRIT] No password on stdin: %v", err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(strings.TrimRight(password, "\r\n")), bcrypt.DefaultCost)
+	if err != nil {
+		log.Fatalf("[CRIT] %v", err)
+	}
+	fmt.Println(string(hash))
+}
+
+// cleanup reverts the routes and NAT rules left by a Hub that crashed or was
+// killed (the cleanup subcommand)
+func cleanup(backend, stateFile string) {
+	if err := tun.SetBackend(backend); err != nil {
+		log.Fatalf("[CRIT] %v", err)
+	}
+	if err := tun.Cleanup(stateFile); err != nil {
+		log.Fatalf("[CRIT] Cleanup failed: %v", err)
+	}
+	log.Println("[OS] Cleanup complete.")
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"go-mesh-hub/internal/metrics"
+	"go-mesh-hub/internal/router"
+	"go-mesh-hub/internal/security"
+)
+
+// Drop reasons of the packets the Hub doesn't forward
+const (
+	dropNoRoute     = "no_route"            // Neither a live peer nor an Exit Node
+	dropNoSession   = "no_session"          // Route found, but the peer has no keys
+	dropSpoofed     = "spoofed"             // Inner source not owned by the sender
+	dropUnknownDest = "unknown_destination" // Not for a peer, the Hub or the Internet
+	dropPolicy      = "policy"              // Denied by the acl rules
+)
+
+// hubMetrics are the counters of the forwarding loops. Per-peer traffic is
+// kept by the routing table and read at scrape time.
+type hubMetrics struct {
+	decryptFailures metrics.Counter
+	drops           *metrics.CounterVec // By reason
+	tunErrors       *metrics.CounterVec // By operation: read, write
+	latency         *metrics.Histogram  // UDP receive to send (or TUN write)
+}
+
+func newHubMetrics() *hubMetrics {
+	return &hubMetrics{
+		drops:     metrics.NewCounterVec(dropNoRoute, dropNoSession, dropSpoofed, dropUnknownDest, dropPolicy),
+		tunErrors: metrics.NewCounterVec("read", "write"),
+		latency:   metrics.NewHistogram(metrics.LatencyBuckets),
+	}
+}
+
+// Metrics writes every Hub metric in the Prometheus text format
+func (h *hub) Metrics(w *metrics.Writer) {
+	peers := h.table.Snapshot()
+	labels := func(p router.PeerStats) metrics.Labels {
+		name := ""
+		if key, err := security.ParsePublicKey(p.Identity); err == nil {
+			name, _ = h.registry.Authorized(key)
+		}
+		return metrics.Labels{"peer", name, "virtual_ip", p.VirtualIP}
+	}
+	perPeer := []struct {
+		name, help string
+		value      func(router.PeerStats) uint64
+	}{
+		{"gomesh_hub_peer_rx_bytes_total", "Bytes received from the peer (inner packets).", func(p router.PeerStats) uint64 { return p.RxBytes }},
+		{"gomesh_hub_peer_tx_bytes_total", "Bytes sent to the peer (inner packets).", func(p router.PeerStats) uint64 { return p.TxBytes }},
+		{"gomesh_hub_peer_rx_packets_total", "Packets received from the peer.", func(p router.PeerStats) uint64 { return p.RxPackets }},
+		{"gomesh_hub_peer_tx_packets_total", "Packets sent to the peer.", func(p router.PeerStats) uint64 { return p.TxPackets }},
+	}
+	for _, m := range perPeer {
+		w.Header(m.name, "counter", m.help)
+		for _, p := range peers {
+			w.Sample(m.name, labels(p), float64(m.value(p)))
+		}
+	}
+
+	w.Header("gomesh_hub_peer_last_seen_seconds", "gauge", "Unix time of the last authenticated packet from the peer.")
+	for _, p := range peers {
+		w.Sample("gomesh_hub_peer_last_seen_seconds", labels(p), float64(p.LastSeen.Unix()))
+	}
+	w.Header("gomesh_hub_peer_state", "gauge", "1 for the current liveness state of the peer.")
+	for _, p := range peers {
+		for state := router.StateActive; state <= router.StateExpired; state++ {
+			value := 0.0
+			if p.State == state {
+				value = 1
+			}
+			w.Sample("gomesh_hub_peer_state", append(labels(p), "state", state.String()), value)
+		}
+	}
+
+	// Sessions belong to identities, not to Virtual IPs
+	w.Header("gomesh_hub_peer_last_handshake_seconds", "gauge", "Unix time of the handshake that created the current session.")
+	for _, session := range h.registry.Active() {
+		name, _ := h.registry.Authorized(session.Remote)
+		w.Sample("gomesh_hub_peer_last_handshake_seconds", metrics.Labels{"peer", name}, float64(session.Created.Unix()))
+	}
+	w.Gauge("gomesh_hub_sessions", "Peers with an established session.", float64(len(h.registry.Active())))
+
+	w.Counter("gomesh_hub_decrypt_failures_total", "Transport packets that failed to decrypt (no session, bad tag, replayed).", &h.stats.decryptFailures)
+	w.CounterVec("gomesh_hub_dropped_packets_total", "Packets not forwarded, by reason.", "reason", h.stats.drops)
+	w.CounterVec("gomesh_hub_tun_errors_total", "Errors reading from or writing to the TUN device.", "op", h.stats.tunErrors)
+	w.Histogram("gomesh_hub_forward_latency_seconds", "Time from receiving a packet to forwarding it.", h.stats.latency)
+}
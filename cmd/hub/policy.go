@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"go-mesh-hub/internal/config"
+	"go-mesh-hub/internal/policy"
+)
+
+// applyPolicy loads the acl rules and the tags of the peers into the policy
+// engine (at startup and on every reload). The config was validated, so
+// the rules parse.
+func (h *hub) applyPolicy(cfg *config.Config, peers []config.Peer) {
+	rules, err := cfg.Policy()
+	if err != nil {
+		log.Printf("[ACL] %v", err)
+		return
+	}
+	tagged := make([]policy.Peer, 0, len(peers))
+	for _, p := range peers {
+		tagged = append(tagged, policy.Peer{Identity: p.PublicKey.String(), Name: p.Name, Tags: p.Tags})
+	}
+	h.policy.Update(rules, tagged)
+	if h.policy.Enabled() {
+		// Direct tunnels would bypass the rules
+		h.dropAllDirect()
+	}
+
+	if len(rules) > 0 {
+		log.Printf("[ACL] %d rules loaded, anything they don't allow is denied (direct tunnels disabled)", len(rules))
+	} else {
+		log.Println("[ACL] No acl rules: all traffic between peers is allowed")
+	}
+}
+
+// allowed applies the policy to a packet the peer identity sent through
+// the Hub, whatever its destination (a peer, the Hub or the Internet)
+func (h *hub) allowed(identity string, packet []byte, dstIP string, now time.Time) bool {
+	if !h.policy.Enabled() {
+		return true
+	}
+	flow, ok := policy.ParseFlow(packet)
+	if !ok {
+		return false
+	}
+	to, _ := h.table.Owner(dstIP)
+	return h.policy.Allow(flow, identity, to, now)
+}
+
+// track lets the replies to packets sent by the Hub itself through the policy
+func (h *hub) track(packet []byte, now time.Time) {
+	if !h.policy.Enabled() {
+		return
+	}
+	if flow, ok := policy.ParseFlow(packet); ok && h.isLocal(flow.Src) {
+		h.policy.Track(flow, now)
+	}
+}
+
+// Policy returns the forwarding policy engine
+func (h *hub) Policy() *policy.Engine {
+	return h.policy
+}
+
+// IdentityOf returns the peer owning an address: a live route or subnet
+// first, then the allowed IPs of the authorized peers and the leases
+func (h *hub) IdentityOf(ip net.IP) string {
+	if identity, ok := h.table.Owner(ip.String()); ok {
+		return identity
+	}
+	if key, ok := h.registry.Owner(ip); ok {
+		return key.String()
+	}
+	for _, pool := range h.pools {
+		for identity, leased := range pool.Leases() {
+			if leased == ip.String() {
+				return identity
+			}
+		}
+	}
+	return ""
+}
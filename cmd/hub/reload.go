@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"slices"
+
+	"go-mesh-hub/internal/config"
+	"go-mesh-hub/internal/ipam"
+	"go-mesh-hub/internal/protocol"
+	"go-mesh-hub/internal/router"
+	"go-mesh-hub/internal/security"
+	"go-mesh-hub/internal/tun"
+)
+
+// authorizedSet builds the registry view of the peers list
+func authorizedSet(cfg *config.Config, peers []config.Peer) map[security.PublicKey]security.PeerInfo {
+	authorized := make(map[security.PublicKey]security.PeerInfo, len(peers))
+	for _, p := range peers {
+		if len(p.AllowedIPs) == 0 && cfg.Pool == "" && cfg.Pool6 == "" {
+			log.Printf("[SEC] Warning: peer %s has no allowed IPs; all its traffic will be dropped", p.Name)
+		}
+		authorized[p.PublicKey] = security.PeerInfo{Name: p.Name, AllowedIPs: p.AllowedIPs}
+	}
+	return authorized
+}
+
+// reserveStatic pins the single addresses of the peers list that fall
+// inside the pool as static leases
+func reserveStatic(pool *ipam.Pool, peers []config.Peer) error {
+	for _, p := range peers {
+		for _, prefix := range p.AllowedIPs {
+			if ones, bits := prefix.Mask.Size(); ones == bits && pool.Network().Contains(prefix.IP) {
+				if err := pool.Reserve(p.PublicKey.String(), prefix.IP); err != nil {
+					return fmt.Errorf("reservation for %s: %w", p.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// allowLeases adds the addresses leased from pool to the allowed IPs of the
+// peers of authorized
+func allowLeases(authorized map[security.PublicKey]security.PeerInfo, pool *ipam.Pool) {
+	for identity, ip := range pool.Leases() {
+		key, err := security.ParsePublicKey(identity)
+		if err != nil {
+			continue
+		}
+		info, ok := authorized[key]
+		addr := net.ParseIP(ip)
+		if !ok || addr == nil {
+			continue
+		}
+		if v4 := addr.To4(); v4 != nil {
+			addr = v4
+		}
+		bits := len(addr) * 8
+		lease := &net.IPNet{IP: addr, Mask: net.CIDRMask(bits, bits)}
+		if slices.ContainsFunc(info.AllowedIPs, func(p *net.IPNet) bool { return p.String() == lease.String() }) {
+			continue // A static reservation
+		}
+		// Clipped: the slice belongs to the peers list
+		info.AllowedIPs = append(slices.Clip(info.AllowedIPs), lease)
+		authorized[key] = info
+	}
+}
+
+// setExitNodes points Internet traffic at the Exit Nodes ips, in order of
+// preference, and turns the NAT of the Hub on or off depending on whether
+// the Hub itself is one of them
+func (h *hub) setExitNodes(ips []string) error {
+	exits := make([]router.Exit, 0, len(ips))
+	normalized := make([]string, 0, len(ips))
+	wantNAT := false
+	for _, ip := range ips {
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			return fmt.Errorf("invalid Exit Node %q", ip)
+		}
+		if h.isLocal(addr) {
+			wantNAT = true
+		}
+		exits = append(exits, router.Exit{IP: addr.String(), Identity: h.IdentityOf(addr)})
+		normalized = append(normalized, addr.String())
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case wantNAT && h.cleanupNAT == nil:
+		cleanup, err := tun.EnableExitNode(h.ifce.Name(), h.cfg.TunIP6 != "" || h.cfg.Pool6 != "")
+		if err != nil {
+			return err
+		}
+		h.cleanupNAT = cleanup
+		log.Printf("[NAT] Exit Node Enabled on %s. Traffic will be masqueraded via host interface.", h.cfg.TunIP)
+	case !wantNAT && h.cleanupNAT != nil:
+		h.cleanupNAT()
+		h.cleanupNAT = nil
+		log.Println("[NAT] The Hub is no longer an Exit Node, NAT rules removed.")
+	}
+
+	// Owners are looked up again every time, peers may have leased the address since
+	h.table.SetExitNodes(exits)
+	h.exitNodes = normalized
+	return nil
+}
+
+// assignExits applies the Exit Nodes the config file assigns to peers
+func (h *hub) assignExits(peers []config.Peer) {
+	assigned := make(map[string]string)
+	for _, p := range peers {
+		if p.ExitNode != "" {
+			assigned[p.PublicKey.String()] = p.ExitNode
+		}
+	}
+	h.table.SetAssignments(assigned)
+}
+
+// shutdown removes the subnet routes and NAT rules installed by the Hub and
+// saves the history
+func (h *hub) shutdown() {
+	h.routesMu.Lock()
+	for prefix := range h.kernelRoutes {
+		tun.DelRoute(h.ifce.Name(), prefix)
+	}
+	h.kernelRoutes = nil
+	h.routesMu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.cleanupNAT != nil {
+		h.cleanupNAT()
+		h.cleanupNAT = nil
+	}
+	tun.RestoreForwarding()
+	if err := h.history.Save(); err != nil {
+		log.Printf("[HIST] Failed to save the history: %v", err)
+	}
+}
+
+// reload re-reads the configuration (SIGHUP) and applies what can change
+// live: authorized peers and their allowed IPs, the peer liveness
+// thresholds, the acl rules, and the Exit Nodes with the NAT rules. Sessions of peers that remain authorized are untouched.
+func (h *hub) reload() {
+	cfg, err := config.Reload()
+	if err != nil {
+		log.Printf("[CONF] Reload failed, keeping the running configuration:\n%v", err)
+		return
+	}
+	peers, err := cfg.LoadPeers()
+	if err != nil {
+		log.Printf("[CONF] Reload failed, keeping the running configuration: %v", err)
+		return
+	}
+	h.warnRestart(cfg)
+	applied := true
+
+	// 1. Authorized peers: revoked keys lose their sessions right away.
+	// Leases stay valid for the peers that are still authorized; they are
+	// part of the new set so no packet is checked against a set without them.
+	authorized := authorizedSet(cfg, peers)
+	for _, pool := range h.pools {
+		if err := reserveStatic(pool, peers); err != nil {
+			log.Printf("[IPAM] Reload: %v", err)
+			applied = false
+		}
+		allowLeases(authorized, pool)
+	}
+	removed := h.registry.Update(authorized)
+	routesChanged := false
+	for _, peer := range removed {
+		h.dropDirect(peer)
+		if session := h.registry.ByPeer(peer); session != nil {
+			h.send(session, protocol.TypeDisconnect, nil, nil)
+		}
+		h.registry.Remove(peer)
+		if h.table.Forget(peer.String()) {
+			routesChanged = true
+		}
+		h.history.Forget(peer.String())
+		log.Printf("[SEC] Peer %s is no longer authorized, session closed", peer)
+	}
+
+	// Routes and advertised subnets must still be covered by the new allowed IPs
+	if h.table.Prune(h.covered) {
+		routesChanged = true
+	}
+	if routesChanged {
+		h.syncRoutes()
+	}
+
+	// 2. Liveness thresholds and the forwarding policy
+	h.table.SetThresholds(cfg.IdleAfter, cfg.DeadAfter)
+	h.applyPolicy(cfg, peers)
+
+	// 3. Exit Nodes, their NAT and the peers assigned to them
+	if err := h.setExitNodes(cfg.ExitNodes); err != nil {
+		log.Printf("[NAT] Reload: failed to apply Exit Nodes %v: %v", cfg.ExitNodes, err)
+		applied = false
+	}
+	h.assignExits(peers)
+
+	if !applied {
+		// The Hub runs part of the new file: keep reporting the old one
+		log.Printf("[CONF] Reload incomplete: %d authorized peers (%d removed), the API still reports the previous configuration", len(peers), len(removed))
+		return
+	}
+	h.mu.Lock()
+	h.current = cfg
+	h.mu.Unlock()
+	log.Printf("[CONF] Configuration reloaded: %d authorized peers (%d removed)", len(peers), len(removed))
+}
+
+// covered tells whether prefix lies inside the allowed IPs of identity
+func (h *hub) covered(identity string, prefix *net.IPNet) bool {
+	key, err := security.ParsePublicKey(identity)
+	return err == nil && h.registry.Covers(key, prefix)
+}
+
+// warnRestart logs the settings that only take effect after a restart
+func (h *hub) warnRestart(cfg *config.Config) {
+	fixed := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"local-port", h.cfg.LocalPort, cfg.LocalPort},
+		{"listen-ip", h.cfg.ListenIP, cfg.ListenIP},
+		{"web-port", h.cfg.WebPort, cfg.WebPort},
+		{"web-ip", h.cfg.WebIP, cfg.WebIP},
+		{"web-tls", h.cfg.WebTLS, cfg.WebTLS},
+		{"web-cert", h.cfg.WebCert, cfg.WebCert},
+		{"web-key", h.cfg.WebKey, cfg.WebKey},
+		{"web-users (count)", len(h.cfg.WebUsers), len(cfg.WebUsers)},
+		{"web-tokens (count)", len(h.cfg.WebTokens), len(cfg.WebTokens)},
+		{"tun-ip", h.cfg.TunIP, cfg.TunIP},
+		{"tun-ip6", h.cfg.TunIP6, cfg.TunIP6},
+		{"mtu", h.cfg.MTU, cfg.MTU},
+		{"key", h.cfg.KeyFile, cfg.KeyFile},
+		{"pool", h.cfg.Pool, cfg.Pool},
+		{"pool6", h.cfg.Pool6, cfg.Pool6},
+		{"history", h.cfg.HistoryFile, cfg.HistoryFile},
+		{"net-backend", h.cfg.NetBackend, cfg.NetBackend},
+		{"firewall", h.cfg.Firewall, cfg.Firewall},
+		{"state", h.cfg.StateFile, cfg.StateFile},
+		{"rekey-after", h.cfg.RekeyAfter, cfg.RekeyAfter},
+		{"rekey-after-packets", h.cfg.RekeyAfterPackets, cfg.RekeyAfterPackets},
+	}
+	for _, f := range fixed {
+		if f.old != f.new {
+			log.Printf("[CONF] %s changed (%v -> %v): takes effect after a restart", f.name, f.old, f.new)
+		}
+	}
+}
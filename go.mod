@@ -5,6 +5,6 @@ go 1.25.5
 require (
 	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
 	golang.org/x/crypto v0.45.0
+	golang.org/x/sys v0.38.0
+	gopkg.in/yaml.v3 v3.0.1
 )
-
-require golang.org/x/sys v0.38.0 // indirect
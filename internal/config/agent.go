@@ -0,0 +1,117 @@
+package config
+
+import (
+	"flag"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"go-mesh-hub/internal/security"
+)
+
+// AgentConfig is the configuration of an Agent. The YAML keys of the
+// config file are the flag names, as for the Hub.
+type AgentConfig struct {
+	ConfigFile  string `yaml:"-"`
+	CheckConfig bool   `yaml:"-"` // Validate and exit
+	Cleanup     bool   `yaml:"-"` // cleanup subcommand: revert what a crashed run left and exit
+
+	HubIP             string        `yaml:"hub-ip"`
+	HubPort           int           `yaml:"hub-port"`
+	HubKey            string        `yaml:"hub-key"`
+	TunIP             string        `yaml:"tun-ip"`
+	TunIP6            string        `yaml:"tun-ip6"`
+	MTU               int           `yaml:"mtu"`
+	KeyFile           string        `yaml:"key"`
+	ExitNode          bool          `yaml:"exit-node"`
+	GlobalExit        bool          `yaml:"global-exit"`
+	KillSwitch        bool          `yaml:"kill-switch"` // Block traffic outside the tunnel, even while it is down
+	ExitVia           string        `yaml:"exit-via"`    // Preferred Exit Node among the Hub's, empty for the Hub's choice
+	Advertise         List          `yaml:"advertise"`
+	RekeyAfter        time.Duration `yaml:"rekey-after"`
+	RekeyAfterPackets uint64        `yaml:"rekey-after-packets"`
+	MetricsListen     string        `yaml:"metrics-listen"` // host:port of the Prometheus listener, empty disables it
+	NetBackend        string        `yaml:"net-backend"`    // How links and routes are managed: auto, netlink or exec
+	Firewall          string        `yaml:"firewall"`       // NAT and kill switch rules with auto, iptables or nftables
+	StateFile         string        `yaml:"state"`          // Journal of the routes and NAT rules to revert after a crash
+}
+
+// LoadAgent reads the Agent configuration from the command line and, with
+// -config, from a YAML file (flags win). The result is validated.
+func LoadAgent() (*AgentConfig, error) {
+	cfg := &AgentConfig{}
+	flag.StringVar(&cfg.ConfigFile, "config", "", "YAML config file (flags override its values)")
+	flag.BoolVar(&cfg.CheckConfig, "check-config", false, "Validate the configuration and exit")
+	flag.StringVar(&cfg.HubIP, "hub-ip", "", "Public IP of the Hub Server")
+	flag.IntVar(&cfg.HubPort, "hub-port", 5000, "UDP port of the Hub")
+	flag.StringVar(&cfg.HubKey, "hub-key", "", "Public key of the Hub (base64)")
+	flag.StringVar(&cfg.TunIP, "tun-ip", "", "My Virtual IP (e.g. 10.0.0.2); optional when the Hub leases addresses")
+	flag.StringVar(&cfg.TunIP6, "tun-ip6", "", "My IPv6 Virtual IP (e.g. fd00::2); optional when the Hub leases addresses")
+	flag.IntVar(&cfg.MTU, "mtu", 1300, "MTU of the TUN interface")
+	flag.StringVar(&cfg.KeyFile, "key", "agent.key", "Path to the Agent private key (created if missing)")
+	flag.BoolVar(&cfg.ExitNode, "exit-node", false, "Act as an Exit Node (Route internet traffic)")
+	flag.BoolVar(&cfg.GlobalExit, "global-exit", false, "Route all internet traffic through the VPN Hub")
+	flag.BoolVar(&cfg.KillSwitch, "kill-switch", false, "With -global-exit, block all traffic outside the tunnel until a clean shutdown, even while reconnecting (disables direct tunnels)")
+	flag.StringVar(&cfg.ExitVia, "exit-via", "", "Virtual IP of the Exit Node to use, among the Hub's (default: the Hub's choice)")
+	flag.Var(&cfg.Advertise, "advertise", "Comma separated LAN prefixes reachable through this Agent (e.g. 192.168.50.0/24)")
+	flag.DurationVar(&cfg.RekeyAfter, "rekey-after", 2*time.Minute, "Start a new handshake after this session age")
+	flag.Uint64Var(&cfg.RekeyAfterPackets, "rekey-after-packets", 1<<60, "Start a new handshake after this many packets on one key")
+	flag.StringVar(&cfg.MetricsListen, "metrics-listen", "", "Serve Prometheus metrics on this address (e.g. 127.0.0.1:9101)")
+	flag.StringVar(&cfg.NetBackend, "net-backend", "auto", "Manage addresses and routes with netlink, exec (the ip command) or auto")
+	flag.StringVar(&cfg.Firewall, "firewall", "auto", "Install the Exit Node NAT and kill switch rules with iptables, nftables or auto")
+	flag.StringVar(&cfg.StateFile, "state", "agent.state", "File recording the routes and NAT rules to revert after a crash (empty: no recovery)")
+	var args []string
+	cfg.Cleanup, args = cleanupCommand(os.Args[1:])
+	if err := parseFlags(flag.CommandLine, args, &cfg.ConfigFile, cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Cleanup {
+		var v validator
+		return cfg, v.cleanup(cfg.StateFile)
+	}
+	return cfg, cfg.Validate()
+}
+
+// Validate checks every field and reports all problems with their paths.
+func (cfg *AgentConfig) Validate() error {
+	var v validator
+	if cfg.HubIP == "" {
+		v.fail("hub-ip", "is required")
+	}
+	v.port("hub-port", cfg.HubPort)
+	if cfg.HubKey == "" {
+		v.fail("hub-key", "is required")
+	} else if _, err := security.ParsePublicKey(cfg.HubKey); err != nil {
+		v.fail("hub-key", "%v", err)
+	}
+	v.address("tun-ip", cfg.TunIP, 4)
+	v.address("tun-ip6", cfg.TunIP6, 6)
+	v.mtu("mtu", cfg.MTU, cfg.TunIP6 != "")
+	v.oneOf("net-backend", cfg.NetBackend, "auto", "netlink", "exec")
+	v.oneOf("firewall", cfg.Firewall, "auto", "iptables", "nftables")
+	if cfg.KeyFile == "" {
+		v.fail("key", "is required")
+	}
+	v.prefixes("advertise", cfg.Advertise)
+	v.address("exit-via", cfg.ExitVia, 0)
+	if cfg.ExitNode && cfg.GlobalExit {
+		// Our own default route would send the forwarded traffic back into the tunnel
+		v.fail("exit-node", "cannot be combined with global-exit")
+	}
+	if cfg.KillSwitch && !cfg.GlobalExit {
+		v.fail("kill-switch", "needs global-exit")
+	}
+	v.rekey(cfg.RekeyAfter, cfg.RekeyAfterPackets)
+	if cfg.MetricsListen != "" {
+		if _, port, err := net.SplitHostPort(cfg.MetricsListen); err != nil || port == "" {
+			v.fail("metrics-listen", "expected host:port, got %q", cfg.MetricsListen)
+		}
+	}
+	return v.err()
+}
+
+// AdvertisedPrefixes parses the advertised LAN prefixes.
+func (cfg *AgentConfig) AdvertisedPrefixes() ([]*net.IPNet, error) {
+	return ParsePrefixes(strings.Join(cfg.Advertise, ","))
+}
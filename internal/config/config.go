@@ -1,23 +1,306 @@
 package config
 
-import "flag"
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"go-mesh-hub/internal/policy"
+	"go-mesh-hub/internal/router"
+	"go-mesh-hub/internal/security"
+)
 
 type Config struct {
-	LocalPort  int
-	WebPort    int 
-	TunIP      string
-	Secret     string
-	ExitNodeIP string 
+	ConfigFile   string `yaml:"-"`
+	CheckConfig  bool   `yaml:"-"` // Validate and exit
+	HashPassword bool   `yaml:"-"` // Print the bcrypt hash of a password read from stdin and exit
+	Cleanup      bool   `yaml:"-"` // cleanup subcommand: revert what a crashed run left and exit
+
+	LocalPort           int           `yaml:"local-port"`
+	WebPort             int           `yaml:"web-port"`
+	WebIP               string        `yaml:"web-ip"` // Dashboard bind address, e.g. 127.0.0.1 or the overlay IP
+	WebTLS              bool          `yaml:"web-tls"`
+	WebCert             string        `yaml:"web-cert"` // Self-signed pair generated if missing
+	WebKey              string        `yaml:"web-key"`
+	WebUsers            List          `yaml:"web-users" secret:"true"`  // name:bcrypt-hash
+	WebTokens           List          `yaml:"web-tokens" secret:"true"` // SHA-256 (hex) of the accepted bearer tokens
+	ListenIP            string        `yaml:"listen-ip"`
+	TunIP               string        `yaml:"tun-ip"`
+	TunIP6              string        `yaml:"tun-ip6"` // Optional IPv6 Virtual IP for a dual-stack overlay
+	MTU                 int           `yaml:"mtu"`
+	KeyFile             string        `yaml:"key"`
+	AuthorizedPeersFile string        `yaml:"authorized-peers"`
+	Peers               []PeerEntry   `yaml:"peers"`     // Inline peers, in addition to the file
+	ACL                 []RuleEntry   `yaml:"acl"`       // Forwarding policy, first match wins; empty allows everything
+	ExitNodes           List          `yaml:"exit-node"` // Virtual IPs of the Exit Nodes, in order of preference
+	RekeyAfter          time.Duration `yaml:"rekey-after"`
+	RekeyAfterPackets   uint64        `yaml:"rekey-after-packets"`
+	IdleAfter           time.Duration `yaml:"idle-after"` // Silence before a peer is shown as idle
+	DeadAfter           time.Duration `yaml:"dead-after"` // Silence before a peer stops being routed
+	Pool                string        `yaml:"pool"`       // IPAM subnet, empty disables address leasing
+	LeasesFile          string        `yaml:"leases"`
+	Pool6               string        `yaml:"pool6"` // IPv6 IPAM subnet, empty disables IPv6 leasing
+	LeasesFile6         string        `yaml:"leases6"`
+	HistoryFile         string        `yaml:"history"`     // Empty keeps the peer history in memory only
+	NetBackend          string        `yaml:"net-backend"` // How links and routes are managed: auto, netlink or exec
+	Firewall            string        `yaml:"firewall"`    // NAT rules with auto, iptables or nftables
+	StateFile           string        `yaml:"state"`       // Journal of the routes and NAT rules to revert after a crash
+}
+
+// Peer is an entry of the authorized peers file
+type Peer struct {
+	Name       string
+	PublicKey  security.PublicKey
+	AllowedIPs []*net.IPNet // Inner source addresses this peer may use
+	Tags       []string     // Groups for the acl rules
+	ExitNode   string       // Exit Node assigned to this peer, "" for the default
+}
 
+// Load reads the Hub configuration from the command line and, with
+// -config, from a YAML file (flags win). The result is validated.
+func Load() (*Config, error) {
+	return load(flag.CommandLine)
 }
 
-func Load() *Config {
+// Reload reads the configuration again with the same command line, e.g.
+// after the config file changed on disk.
+func Reload() (*Config, error) {
+	return load(flag.NewFlagSet(os.Args[0], flag.ContinueOnError))
+}
+
+func load(fs *flag.FlagSet) (*Config, error) {
 	cfg := &Config{}
-	flag.IntVar(&cfg.LocalPort, "local-port", 5000, "Local UDP port to listen on")
-	flag.IntVar(&cfg.WebPort, "web-port", 8080, "TCP port for Web Dashboard") 
-	flag.StringVar(&cfg.TunIP, "tun-ip", "10.0.0.1", "Virtual IP of this Hub")
-	flag.StringVar(&cfg.Secret, "secret", "change-this-password", "Shared secret for encryption")
-	flag.StringVar(&cfg.ExitNodeIP, "exit-node", "", "Virtual IP of the peer acting as Exit Node")
-	flag.Parse()
-	return cfg
-}
\ No newline at end of file
+	fs.StringVar(&cfg.ConfigFile, "config", "", "YAML config file (flags override its values)")
+	fs.BoolVar(&cfg.CheckConfig, "check-config", false, "Validate the configuration and exit")
+	fs.IntVar(&cfg.LocalPort, "local-port", 5000, "Local UDP port to listen on")
+	fs.BoolVar(&cfg.HashPassword, "hash-password", false, "Read a dashboard password from stdin, print its bcrypt hash for web-users and exit")
+	fs.IntVar(&cfg.WebPort, "web-port", 8080, "TCP port for Web Dashboard")
+	fs.StringVar(&cfg.WebIP, "web-ip", "0.0.0.0", "Address to bind the Web Dashboard to (e.g. 127.0.0.1 or the Hub's Virtual IP)")
+	fs.BoolVar(&cfg.WebTLS, "web-tls", false, "Serve the Web Dashboard over HTTPS")
+	fs.StringVar(&cfg.WebCert, "web-cert", "dashboard.crt", "TLS certificate of the Web Dashboard (self-signed one created if missing)")
+	fs.StringVar(&cfg.WebKey, "web-key", "dashboard.key", "TLS private key of the Web Dashboard (created with the self-signed certificate)")
+	fs.Var(&cfg.WebUsers, "web-users", "Comma separated name:bcrypt-hash logins for the Web Dashboard (see -hash-password)")
+	fs.Var(&cfg.WebTokens, "web-tokens", "Comma separated SHA-256 hashes (hex) of accepted bearer tokens")
+	fs.StringVar(&cfg.ListenIP, "listen-ip", "", "Address to bind the UDP listener to (default: all IPv4 and IPv6 addresses)")
+	fs.StringVar(&cfg.TunIP, "tun-ip", "10.0.0.1", "Virtual IP of this Hub")
+	fs.StringVar(&cfg.TunIP6, "tun-ip6", "", "IPv6 Virtual IP of this Hub (e.g. fd00::1), enables the IPv6 overlay")
+	fs.IntVar(&cfg.MTU, "mtu", 1300, "MTU of the TUN interface")
+	fs.StringVar(&cfg.KeyFile, "key", "hub.key", "Path to the Hub private key (created if missing)")
+	fs.StringVar(&cfg.AuthorizedPeersFile, "authorized-peers", "authorized_peers", "File listing the public keys allowed to connect")
+	fs.Var(&cfg.ExitNodes, "exit-node", "Comma separated Virtual IPs of the Exit Nodes (the Hub's tun-ip or peers), in order of preference")
+	fs.DurationVar(&cfg.RekeyAfter, "rekey-after", 2*time.Minute, "Session age after which peers must rekey")
+	fs.Uint64Var(&cfg.RekeyAfterPackets, "rekey-after-packets", 1<<60, "Packets per key after which peers must rekey")
+	fs.DurationVar(&cfg.IdleAfter, "idle-after", router.DefaultIdleAfter, "Silence after which a peer is marked idle")
+	fs.DurationVar(&cfg.DeadAfter, "dead-after", router.DefaultDeadAfter, "Silence after which a peer is expired and no longer routed (forgotten after twice this)")
+	fs.StringVar(&cfg.Pool, "pool", "", "Subnet to lease Virtual IPs from (e.g. 10.0.0.0/24)")
+	fs.StringVar(&cfg.LeasesFile, "leases", "leases.json", "File where IP leases are persisted")
+	fs.StringVar(&cfg.Pool6, "pool6", "", "IPv6 subnet to lease Virtual IPs from (e.g. fd00::/64)")
+	fs.StringVar(&cfg.LeasesFile6, "leases6", "leases6.json", "File where IPv6 leases are persisted")
+	fs.StringVar(&cfg.HistoryFile, "history", "history.json", "File where the per-peer traffic history is persisted (empty: memory only)")
+	fs.StringVar(&cfg.NetBackend, "net-backend", "auto", "Manage addresses and routes with netlink, exec (the ip command) or auto")
+	fs.StringVar(&cfg.Firewall, "firewall", "auto", "Install the Exit Node NAT rules with iptables, nftables or auto")
+	fs.StringVar(&cfg.StateFile, "state", "hub.state", "File recording the routes and NAT rules to revert after a crash (empty: no recovery)")
+	var args []string
+	cfg.Cleanup, args = cleanupCommand(os.Args[1:])
+	if err := parseFlags(fs, args, &cfg.ConfigFile, cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Cleanup {
+		var v validator
+		return cfg, v.cleanup(cfg.StateFile)
+	}
+	if cfg.HashPassword {
+		return cfg, nil // Reads stdin only: nothing else has to be valid
+	}
+	return cfg, cfg.Validate()
+}
+
+// Validate checks every field and reports all problems with their paths.
+func (cfg *Config) Validate() error {
+	var v validator
+	v.port("local-port", cfg.LocalPort)
+	v.port("web-port", cfg.WebPort)
+	v.web(cfg)
+	v.address("listen-ip", cfg.ListenIP, 0)
+	if cfg.TunIP == "" {
+		v.fail("tun-ip", "is required")
+	}
+	// The pools set the subnets: the Hub's addresses are used bare
+	v.host("tun-ip", cfg.TunIP, 4)
+	v.host("tun-ip6", cfg.TunIP6, 6)
+	v.mtu("mtu", cfg.MTU, cfg.TunIP6 != "")
+	v.oneOf("net-backend", cfg.NetBackend, "auto", "netlink", "exec")
+	v.oneOf("firewall", cfg.Firewall, "auto", "iptables", "nftables")
+	if cfg.KeyFile == "" {
+		v.fail("key", "is required")
+	}
+	exits := make(map[string]bool)
+	for i, ip := range cfg.ExitNodes {
+		v.host(fmt.Sprintf("exit-node[%d]", i), ip, 0)
+		exits[ip] = true
+	}
+	v.rekey(cfg.RekeyAfter, cfg.RekeyAfterPackets)
+	if cfg.IdleAfter <= 0 {
+		v.fail("idle-after", "must be positive")
+	}
+	if cfg.DeadAfter <= cfg.IdleAfter {
+		v.fail("dead-after", "must be longer than idle-after (%s)", cfg.IdleAfter)
+	}
+	v.prefix("pool", cfg.Pool, 4)
+	v.prefix("pool6", cfg.Pool6, 6)
+	if cfg.Pool6 != "" && cfg.TunIP6 == "" {
+		v.fail("pool6", "needs tun-ip6 so the Hub is part of the IPv6 overlay")
+	}
+	for i, peer := range cfg.Peers {
+		path := fmt.Sprintf("peers[%d]", i)
+		if _, err := security.ParsePublicKey(peer.PublicKey); err != nil {
+			v.fail(path+".public-key", "%v", err)
+		}
+		v.prefixes(path+".allowed-ips", peer.AllowedIPs)
+		if peer.ExitNode != "" && !exits[peer.ExitNode] {
+			v.fail(path+".exit-node", "%s is not one of the exit-node list", peer.ExitNode)
+		}
+	}
+	for i, entry := range cfg.ACL {
+		if _, err := policy.NewRule(entry.Name, entry.Action, entry.From, entry.To, entry.Proto, entry.Ports); err != nil {
+			v.fail(fmt.Sprintf("acl[%d]", i), "%v", err)
+		}
+	}
+	return v.err()
+}
+
+// LoadPeers returns the peers of the authorized peers file (if any) plus
+// the ones declared inline in the config file.
+func (cfg *Config) LoadPeers() ([]Peer, error) {
+	peers, err := cfg.InlinePeers()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.AuthorizedPeersFile != "" {
+		fromFile, err := LoadAuthorizedPeers(cfg.AuthorizedPeersFile)
+		// The file is optional when the config file lists the peers
+		if err != nil && !(errors.Is(err, os.ErrNotExist) && len(peers) > 0) {
+			return nil, err
+		}
+		peers = append(fromFile, peers...)
+	}
+	seen := make(map[security.PublicKey]string)
+	for _, p := range peers {
+		if other, ok := seen[p.PublicKey]; ok {
+			return nil, fmt.Errorf("peers %s and %s share the same public key", other, p.Name)
+		}
+		seen[p.PublicKey] = p.Name
+	}
+	if err := checkOverlap(peers); err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// LoadAuthorizedPeers parses a file with one peer per line:
+//
+//	<base64-public-key> [name] [allowed-ips] [tags]
+//
+// allowed-ips is a comma separated list of addresses or CIDR prefixes
+// (e.g. 10.0.0.2/32,192.168.50.0/24). A bare address means a single host.
+// tags is a comma separated list of groups used by the acl rules.
+// Empty lines and lines starting with '#' are ignored.
+func LoadAuthorizedPeers(path string) ([]Peer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var peers []Peer
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		key, err := security.ParsePublicKey(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+		peer := Peer{PublicKey: key, Name: key.String()[:8]}
+		if len(fields) > 1 {
+			peer.Name = fields[1]
+		}
+		if len(fields) > 2 {
+			peer.AllowedIPs, err = ParsePrefixes(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+			}
+		}
+		if len(fields) > 3 {
+			var tags List
+			tags.Set(fields[3])
+			peer.Tags = tags
+		}
+		peers = append(peers, peer)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := checkOverlap(peers); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return peers, nil
+}
+
+// ParsePrefixes parses a comma separated list of IPs or CIDR prefixes.
+func ParsePrefixes(list string) ([]*net.IPNet, error) {
+	var prefixes []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			prefixes = append(prefixes, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, prefix, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix %q", item)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// checkOverlap ensures no address is claimed by two different peers,
+// otherwise the Hub could not tell which identity owns a packet.
+func checkOverlap(peers []Peer) error {
+	for i := range peers {
+		for j := i + 1; j < len(peers); j++ {
+			for _, a := range peers[i].AllowedIPs {
+				for _, b := range peers[j].AllowedIPs {
+					if a.Contains(b.IP) || b.Contains(a.IP) {
+						return fmt.Errorf("allowed IPs %s (%s) and %s (%s) overlap",
+							a, peers[i].Name, b, peers[j].Name)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
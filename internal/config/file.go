@@ -0,0 +1,410 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"go-mesh-hub/internal/policy"
+	"go-mesh-hub/internal/security"
+)
+
+// Config files are YAML documents whose keys are the flag names, e.g.
+//
+//	local-port: 5000
+//	tun-ip: 10.0.0.1
+//	pool: 10.0.0.0/24
+//	peers:
+//	  - name: laptop
+//	    public-key: 3pQ...=
+//	    allowed-ips: [10.0.0.2/32]
+//
+// Decoding is strict: unknown keys and values of the wrong type are errors,
+// reported with the path of the offending field (peers[0].allowed-ips[1]).
+// Flags given on the command line win over the file.
+
+// List is a string list that is a comma separated flag on the command line
+// and a sequence in the config file (a single value is also accepted).
+type List []string
+
+func (l *List) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set implements flag.Value.
+func (l *List) Set(s string) error {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// PeerEntry is an authorized peer declared inline in the Hub config file.
+type PeerEntry struct {
+	Name       string `yaml:"name"`
+	PublicKey  string `yaml:"public-key"`
+	AllowedIPs List   `yaml:"allowed-ips"`
+	Tags       List   `yaml:"tags"`      // Groups the peer belongs to, for the acl rules
+	ExitNode   string `yaml:"exit-node"` // One of the Hub's Exit Nodes, for this peer's Internet traffic
+}
+
+// RuleEntry is an acl rule of the Hub config file (see internal/policy)
+type RuleEntry struct {
+	Name   string `yaml:"name"`
+	Action string `yaml:"action"` // allow or deny
+	From   List   `yaml:"from"`   // *, tag:<tag>, peer:<name>, addresses or prefixes
+	To     List   `yaml:"to"`
+	Proto  string `yaml:"proto"` // tcp, udp, icmp or any
+	Ports  List   `yaml:"ports"` // Destination ports or ranges, e.g. 22 or 8000-8100
+}
+
+// parseFlags parses the command line and, if a config file was given,
+// loads it into out. Flags set explicitly are applied again afterwards,
+// so they override whatever the file says.
+func parseFlags(fs *flag.FlagSet, args []string, path *string, out interface{}) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *path == "" {
+		return nil
+	}
+
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+	if err := loadFile(*path, out); err != nil {
+		return err
+	}
+	for name, value := range explicit {
+		if err := fs.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanupCommand splits the cleanup subcommand off the arguments, e.g.
+// "hub cleanup -config hub.yaml". The flags after it are parsed as usual.
+func cleanupCommand(args []string) (bool, []string) {
+	if len(args) > 0 && args[0] == "cleanup" {
+		return true, args[1:]
+	}
+	return false, args
+}
+
+// loadFile strictly decodes a YAML file into out (a pointer to a struct).
+func loadFile(path string, out interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil // Empty file: defaults and flags only
+	}
+	if err := decodeNode(doc.Content[0], reflect.ValueOf(out).Elem(), ""); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	listType     = reflect.TypeOf(List(nil))
+)
+
+// decodeNode walks the YAML tree alongside the Go value so every error
+// carries the full field path.
+func decodeNode(node *yaml.Node, out reflect.Value, path string) error {
+	switch {
+	case out.Kind() == reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return fieldError(path, node, "expected a mapping")
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			field, ok := fieldByTag(out, key)
+			if !ok {
+				return fieldError(joinPath(path, key), node.Content[i], "unknown field")
+			}
+			if err := decodeNode(node.Content[i+1], field, joinPath(path, key)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case out.Type() == listType && node.Kind == yaml.ScalarNode:
+		out.Set(reflect.ValueOf(List{node.Value}))
+		return nil
+
+	case out.Kind() == reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return fieldError(path, node, "expected a list")
+		}
+		list := reflect.MakeSlice(out.Type(), len(node.Content), len(node.Content))
+		for i, item := range node.Content {
+			if err := decodeNode(item, list.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		out.Set(list)
+		return nil
+	}
+
+	if node.Kind != yaml.ScalarNode {
+		return fieldError(path, node, "expected a single value")
+	}
+	if out.Type() == durationType {
+		d, err := time.ParseDuration(node.Value)
+		if err != nil {
+			return fieldError(path, node, fmt.Sprintf("invalid duration %q", node.Value))
+		}
+		out.SetInt(int64(d))
+		return nil
+	}
+	if err := node.Decode(out.Addr().Interface()); err != nil {
+		return fieldError(path, node, fmt.Sprintf("expected %s, got %q", out.Type(), node.Value))
+	}
+	return nil
+}
+
+// fieldByTag finds the struct field whose yaml tag is key.
+func fieldByTag(v reflect.Value, key string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag != "" && tag != "-" && tag == key {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// redacted replaces every entry of the fields tagged secret in Settings
+const redacted = "(redacted)"
+
+// Settings returns the configuration under the keys of the config file,
+// with durations written as in the file (e.g. "2m0s"). Used by the admin API,
+// so the entries of secret fields (login and token hashes) are redacted.
+func (cfg *Config) Settings() map[string]interface{} {
+	return settings(reflect.ValueOf(cfg).Elem()).(map[string]interface{})
+}
+
+func settings(v reflect.Value) interface{} {
+	switch {
+	case v.Type() == durationType:
+		return time.Duration(v.Int()).String()
+	case v.Kind() == reflect.Struct:
+		out := make(map[string]interface{})
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			tag := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			switch {
+			case tag == "" || tag == "-":
+			case field.Tag.Get("secret") == "true":
+				out[tag] = redact(v.Field(i))
+			default:
+				out[tag] = settings(v.Field(i))
+			}
+		}
+		return out
+	case v.Kind() == reflect.Slice:
+		out := make([]interface{}, v.Len())
+		for i := range out {
+			out[i] = settings(v.Index(i))
+		}
+		return out
+	}
+	return v.Interface()
+}
+
+// redact keeps the number of entries of a secret list, not their content
+func redact(v reflect.Value) interface{} {
+	if v.Kind() != reflect.Slice {
+		return redacted
+	}
+	out := make([]interface{}, v.Len())
+	for i := range out {
+		out[i] = redacted
+	}
+	return out
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func fieldError(path string, node *yaml.Node, msg string) error {
+	if path == "" {
+		path = "(root)"
+	}
+	return fmt.Errorf("%s (line %d): %s", path, node.Line, msg)
+}
+
+// validator collects every problem of a config instead of stopping at the
+// first one, so a single -check-config run shows all of them.
+type validator struct {
+	errs []error
+}
+
+func (v *validator) fail(path, format string, args ...interface{}) {
+	v.errs = append(v.errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+}
+
+func (v *validator) err() error {
+	return errors.Join(v.errs...)
+}
+
+// port checks a TCP/UDP port number.
+func (v *validator) port(path string, port int) {
+	if port < 1 || port > 65535 {
+		v.fail(path, "port %d out of range 1-65535", port)
+	}
+}
+
+// address checks an optional IP (bare or with a prefix length) of the
+// given family: 4, 6 or 0 for any.
+func (v *validator) address(path, value string, family int) {
+	if value == "" {
+		return
+	}
+	ip := net.ParseIP(value)
+	if strings.Contains(value, "/") {
+		var err error
+		if ip, _, err = net.ParseCIDR(value); err != nil {
+			v.fail(path, "invalid address %q", value)
+			return
+		}
+	}
+	if ip == nil {
+		v.fail(path, "invalid address %q", value)
+		return
+	}
+	if is4 := ip.To4() != nil; (family == 4 && !is4) || (family == 6 && is4) {
+		v.fail(path, "%q is not an IPv%d address", value, family)
+	}
+}
+
+// host checks an optional bare IP of the given family, for addresses used
+// as such (the Hub's own ones, Exit Nodes)
+func (v *validator) host(path, value string, family int) {
+	if strings.Contains(value, "/") {
+		v.fail(path, "%q: give the address without a prefix length", value)
+		return
+	}
+	v.address(path, value, family)
+}
+
+// prefix checks an optional CIDR subnet of the given family.
+func (v *validator) prefix(path, value string, family int) {
+	if value == "" {
+		return
+	}
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		v.fail(path, "invalid prefix %q", value)
+		return
+	}
+	if is4 := network.IP.To4() != nil; (family == 4 && !is4) || (family == 6 && is4) {
+		v.fail(path, "%q is not an IPv%d prefix", value, family)
+	}
+}
+
+// prefixes checks a list of addresses or prefixes (see ParsePrefixes).
+func (v *validator) prefixes(path string, list List) {
+	for i, item := range list {
+		if _, err := ParsePrefixes(item); err != nil {
+			v.fail(fmt.Sprintf("%s[%d]", path, i), "%v", err)
+		}
+	}
+}
+
+// mtu checks the TUN MTU; IPv6 needs at least 1280.
+func (v *validator) mtu(path string, mtu int, ipv6 bool) {
+	switch {
+	case mtu < 576 || mtu > 9000:
+		v.fail(path, "%d out of range 576-9000", mtu)
+	case ipv6 && mtu < 1280:
+		v.fail(path, "%d is below the IPv6 minimum of 1280", mtu)
+	}
+}
+
+// oneOf checks a value against the accepted ones.
+func (v *validator) oneOf(path, value string, accepted ...string) {
+	for _, a := range accepted {
+		if value == a {
+			return
+		}
+	}
+	v.fail(path, "%q is not one of %s", value, strings.Join(accepted, ", "))
+}
+
+// cleanup checks what the cleanup subcommand needs: only the state file.
+func (v *validator) cleanup(stateFile string) error {
+	if stateFile == "" {
+		v.fail("state", "is required for cleanup")
+	}
+	return v.err()
+}
+
+// rekey checks the session renegotiation limits.
+func (v *validator) rekey(after time.Duration, packets uint64) {
+	if after <= 0 {
+		v.fail("rekey-after", "must be positive")
+	}
+	if packets == 0 {
+		v.fail("rekey-after-packets", "must be positive")
+	}
+}
+
+// Policy converts the acl rules of the config file, in order
+func (cfg *Config) Policy() ([]policy.Rule, error) {
+	var rules []policy.Rule
+	for i, entry := range cfg.ACL {
+		rule, err := policy.NewRule(entry.Name, entry.Action, entry.From, entry.To, entry.Proto, entry.Ports)
+		if err != nil {
+			return nil, fmt.Errorf("acl[%d]: %v", i, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// InlinePeers converts the peer entries of the config file.
+func (cfg *Config) InlinePeers() ([]Peer, error) {
+	var peers []Peer
+	for i, entry := range cfg.Peers {
+		path := fmt.Sprintf("peers[%d]", i)
+		key, err := security.ParsePublicKey(entry.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s.public-key: %v", path, err)
+		}
+		peer := Peer{PublicKey: key, Name: entry.Name, Tags: entry.Tags, ExitNode: entry.ExitNode}
+		if peer.Name == "" {
+			peer.Name = key.String()[:8]
+		}
+		peer.AllowedIPs, err = ParsePrefixes(strings.Join(entry.AllowedIPs, ","))
+		if err != nil {
+			return nil, fmt.Errorf("%s.allowed-ips: %v", path, err)
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSettingsRedactsSecrets(t *testing.T) {
+	cfg := &Config{
+		WebPort:   8080,
+		WebUsers:  List{"admin:$2a$10$abcdefghijklmnopqrstuv", "ops:$2a$10$zyxwvutsrqponmlkjihgfe"},
+		WebTokens: List{"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"},
+		DeadAfter: 2 * time.Minute,
+	}
+	settings := cfg.Settings()
+
+	want := []interface{}{redacted, redacted}
+	if got := settings["web-users"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("web-users = %v, want %v", got, want)
+	}
+	if got := settings["web-tokens"]; !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("web-tokens = %v, want %v", got, want[:1])
+	}
+	if got := settings["web-port"]; got != 8080 {
+		t.Errorf("web-port = %v, want 8080", got)
+	}
+	if got := settings["dead-after"]; got != "2m0s" {
+		t.Errorf("dead-after = %v, want 2m0s", got)
+	}
+}
+
+func TestHostRejectsPrefix(t *testing.T) {
+	tests := []struct {
+		value  string
+		family int
+		ok     bool
+	}{
+		{"", 4, true},
+		{"10.0.0.1", 4, true},
+		{"fd00::1", 6, true},
+		{"10.0.0.1/24", 4, false},
+		{"fd00::1/64", 6, false},
+		{"fd00::1", 4, false},
+		{"not-an-ip", 0, false},
+	}
+	for _, tt := range tests {
+		var v validator
+		v.host("tun-ip", tt.value, tt.family)
+		if err := v.err(); (err == nil) != tt.ok {
+			t.Errorf("host(%q) error = %v, want ok %v", tt.value, err, tt.ok)
+		}
+	}
+}
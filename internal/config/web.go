@@ -0,0 +1,70 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Dashboard access. Logins are "name:hash" with a bcrypt hash (hub
+// -hash-password prints one); bearer tokens are only stored as their
+// SHA-256, so the config file never holds a usable secret.
+
+// web checks the dashboard listener, TLS and login settings.
+func (v *validator) web(cfg *Config) {
+	if cfg.WebIP == "" || net.ParseIP(cfg.WebIP) == nil {
+		v.fail("web-ip", "invalid address %q", cfg.WebIP)
+	}
+	if cfg.WebTLS && (cfg.WebCert == "" || cfg.WebKey == "") {
+		v.fail("web-cert", "web-tls needs web-cert and web-key")
+	}
+	seen := make(map[string]bool)
+	for i, entry := range cfg.WebUsers {
+		path := fmt.Sprintf("web-users[%d]", i)
+		name, hash, ok := strings.Cut(entry, ":")
+		if !ok || name == "" {
+			v.fail(path, "expected name:bcrypt-hash")
+			continue
+		}
+		if seen[name] {
+			v.fail(path, "duplicate user %q", name)
+		}
+		seen[name] = true
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			v.fail(path, "user %q: not a bcrypt hash", name)
+		}
+	}
+	for i, token := range cfg.WebTokens {
+		if b, err := hex.DecodeString(token); err != nil || len(b) != sha256.Size {
+			v.fail(fmt.Sprintf("web-tokens[%d]", i), "expected the SHA-256 of a token (64 hex digits)")
+		}
+	}
+}
+
+// WebLogins returns the bcrypt hash of every dashboard user.
+func (cfg *Config) WebLogins() map[string][]byte {
+	logins := make(map[string][]byte, len(cfg.WebUsers))
+	for _, entry := range cfg.WebUsers {
+		if name, hash, ok := strings.Cut(entry, ":"); ok {
+			logins[name] = []byte(hash)
+		}
+	}
+	return logins
+}
+
+// WebTokenHashes returns the SHA-256 of every accepted bearer token.
+func (cfg *Config) WebTokenHashes() [][sha256.Size]byte {
+	var hashes [][sha256.Size]byte
+	for _, token := range cfg.WebTokens {
+		var h [sha256.Size]byte
+		if b, err := hex.DecodeString(token); err == nil && len(b) == sha256.Size {
+			copy(h[:], b)
+			hashes = append(hashes, h)
+		}
+	}
+	return hashes
+}
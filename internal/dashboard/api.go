@@ -0,0 +1,522 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go-mesh-hub/internal/config"
+	"go-mesh-hub/internal/history"
+	"go-mesh-hub/internal/metrics"
+	"go-mesh-hub/internal/policy"
+	"go-mesh-hub/internal/router"
+	"go-mesh-hub/internal/security"
+)
+
+// apiPrefix is the root of the versioned JSON admin API:
+//
+//	GET    /api/v1/health                  liveness, uptime, peer counts
+//	GET    /api/v1/config                  running configuration
+//	GET    /api/v1/peers                   every peer with its stats
+//	GET    /api/v1/peers/{peer}            one peer
+//	POST   /api/v1/peers/{peer}/disconnect close its session (it reconnects)
+//	GET    /api/v1/peers/{peer}/history    ?range=hour|day|week traffic, RTT, availability
+//	GET    /api/v1/bans                    banned identities
+//	PUT    /api/v1/bans/{key}              ban an identity (and disconnect it)
+//	DELETE /api/v1/bans/{key}              lift a ban
+//	GET    /api/v1/exit-node               current Exit Nodes, in order of preference
+//	PUT    /api/v1/exit-node               change them: {"ips": ["10.0.0.3", "10.0.0.1"]} (or {"ip": ...})
+//	PUT    /api/v1/peers/{peer}/exit-node  assign one to a peer: {"ip": "10.0.0.3"} ("" to unset)
+//	GET    /api/v1/policy                  acl rules in evaluation order
+//	POST   /api/v1/policy/test             which rule a flow matches:
+//	                                       {"src": "10.0.0.2", "dst": "10.0.0.3", "proto": "tcp", "port": 22}
+//
+// {peer} is a public key or one of the peer's Virtual IPs. Keys are base64:
+// escape "/" as %2F, or use the URL-safe alphabet. Errors are returned as
+// {"error": "..."} with a matching status code. Changes (disconnect, bans,
+// exit-node) need Content-Type: application/json, and are refused when the
+// dashboard has no login.
+const apiPrefix = "/api/v1"
+
+// Hub is the control surface of the Hub used by the dashboard and the API
+type Hub interface {
+	KeySource
+	PeerName(peer security.PublicKey) (name string, authorized bool)
+	Kick(peer security.PublicKey) bool
+	Ban(peer security.PublicKey)
+	Unban(peer security.PublicKey) bool
+	Bans() []security.PublicKey
+	ExitNodes() []string
+	SetExitNodes(ips []string) error
+	AssignExit(peer security.PublicKey, ip string) error
+	Config() *config.Config
+	Started() time.Time
+	Metrics(w *metrics.Writer) // Prometheus exposition, served at /metrics
+	History() *history.Store
+	Policy() *policy.Engine
+	IdentityOf(ip net.IP) string // Peer owning an address, "" if none
+}
+
+// peerView is a peer identity with the stats of all its Virtual IPs
+type peerView struct {
+	Identity   string     `json:"identity"`
+	Name       string     `json:"name,omitempty"`
+	Authorized bool       `json:"authorized"`
+	Banned     bool       `json:"banned"`
+	Connected  bool       `json:"connected"`
+	State      string     `json:"state"`
+	Endpoint   string     `json:"endpoint"`
+	Addresses  []string   `json:"addresses"`
+	LastSeen   time.Time  `json:"last_seen"`
+	RxBytes    uint64     `json:"rx_bytes"`
+	TxBytes    uint64     `json:"tx_bytes"`
+	KeyEpoch   uint64     `json:"key_epoch,omitempty"`
+	KeyCreated *time.Time `json:"key_created,omitempty"`
+	ExitNode   string     `json:"exit_node,omitempty"`       // Exit Node in use
+	ExitChoice string     `json:"exit_preference,omitempty"` // Assigned or asked for by the Agent
+
+	state router.PeerState
+}
+
+type healthView struct {
+	Status    string         `json:"status"`
+	Started   time.Time      `json:"started"`
+	Uptime    string         `json:"uptime"`
+	Peers     map[string]int `json:"peers"` // Count per state
+	Sessions  int            `json:"sessions"`
+	ExitNode  string         `json:"exit_node"` // First Exit Node
+	ExitNodes []string       `json:"exit_nodes"`
+}
+
+type api struct {
+	table *router.Table
+	hub   Hub
+}
+
+// registerAPI adds the API routes to mux. Without writable (no login
+// configured) the routes that change the Hub only answer 403.
+func registerAPI(mux *http.ServeMux, table *router.Table, hub Hub, writable bool) {
+	a := &api{table: table, hub: hub}
+	change := func(pattern string, handler http.HandlerFunc) {
+		if !writable {
+			mux.HandleFunc(pattern, readOnly)
+			return
+		}
+		mux.HandleFunc(pattern, jsonOnly(handler))
+	}
+	mux.HandleFunc("GET "+apiPrefix+"/health", a.health)
+	mux.HandleFunc("GET "+apiPrefix+"/config", a.config)
+	mux.HandleFunc("GET "+apiPrefix+"/peers", a.listPeers)
+	mux.HandleFunc("GET "+apiPrefix+"/peers/{peer}", a.getPeer)
+	change("POST "+apiPrefix+"/peers/{peer}/disconnect", a.disconnect)
+	mux.HandleFunc("GET "+apiPrefix+"/peers/{peer}/history", a.history)
+	change("PUT "+apiPrefix+"/peers/{peer}/exit-node", a.assignExit)
+	mux.HandleFunc("GET "+apiPrefix+"/bans", a.listBans)
+	change("PUT "+apiPrefix+"/bans/{key}", a.ban)
+	change("DELETE "+apiPrefix+"/bans/{key}", a.unban)
+	mux.HandleFunc("GET "+apiPrefix+"/exit-node", a.exitNode)
+	change("PUT "+apiPrefix+"/exit-node", a.setExitNode)
+	mux.HandleFunc("GET "+apiPrefix+"/policy", a.policy)
+	mux.HandleFunc("POST "+apiPrefix+"/policy/test", a.testFlow)
+	mux.HandleFunc(apiPrefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "no such endpoint")
+	})
+}
+
+// peers groups the routing table by identity
+func (a *api) peers() []*peerView {
+	byIdentity := make(map[string]*peerView)
+	views := []*peerView{}
+	for _, p := range a.table.Snapshot() {
+		view, ok := byIdentity[p.Identity]
+		if !ok {
+			view = a.newView(p.Identity)
+			view.state = router.StateExpired
+			byIdentity[p.Identity] = view
+			views = append(views, view)
+		}
+		view.Addresses = append(view.Addresses, p.VirtualIP)
+		view.ExitNode = p.Exit
+		view.RxBytes += p.RxBytes
+		view.TxBytes += p.TxBytes
+		if p.LastSeen.After(view.LastSeen) {
+			view.LastSeen = p.LastSeen
+			view.Endpoint = p.RealAddr
+		}
+		// The most alive route entry wins
+		if p.State < view.state {
+			view.state = p.State
+		}
+	}
+	for _, view := range views {
+		view.State = view.state.String()
+		sort.Strings(view.Addresses)
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].Addresses[0] < views[j].Addresses[0] })
+	return views
+}
+
+func (a *api) newView(identity string) *peerView {
+	view := &peerView{Identity: identity, Addresses: []string{}, ExitChoice: a.table.ExitPreference(identity)}
+	if key, err := security.ParsePublicKey(identity); err == nil {
+		view.Name, view.Authorized = a.hub.PeerName(key)
+		for _, banned := range a.hub.Bans() {
+			view.Banned = view.Banned || banned == key
+		}
+	}
+	if epoch, created, ok := a.hub.KeyInfo(identity); ok {
+		view.Connected = true
+		view.KeyEpoch = epoch
+		view.KeyCreated = &created
+	}
+	return view
+}
+
+// findPeer resolves {peer}: a public key or a Virtual IP
+func (a *api) findPeer(w http.ResponseWriter, id string) *peerView {
+	var match func(*peerView) bool
+	if ip := net.ParseIP(id); ip != nil {
+		match = func(p *peerView) bool {
+			for _, addr := range p.Addresses {
+				if net.ParseIP(addr).Equal(ip) {
+					return true
+				}
+			}
+			return false
+		}
+	} else {
+		key, ok := parseKey(w, id)
+		if !ok {
+			return nil
+		}
+		match = func(p *peerView) bool { return p.Identity == key.String() }
+	}
+	for _, p := range a.peers() {
+		if match(p) {
+			return p
+		}
+	}
+	writeError(w, http.StatusNotFound, "unknown peer "+id)
+	return nil
+}
+
+// parseKey accepts standard and URL-safe base64 public keys
+func parseKey(w http.ResponseWriter, s string) (security.PublicKey, bool) {
+	s = strings.NewReplacer("-", "+", "_", "/").Replace(s)
+	key, err := security.ParsePublicKey(s)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid public key: "+err.Error())
+		return key, false
+	}
+	return key, true
+}
+
+func (a *api) health(w http.ResponseWriter, r *http.Request) {
+	started := a.hub.Started()
+	view := healthView{
+		Status:    "ok",
+		Started:   started,
+		Uptime:    time.Since(started).Round(time.Second).String(),
+		Peers:     make(map[string]int),
+		ExitNodes: a.hub.ExitNodes(),
+	}
+	if len(view.ExitNodes) > 0 {
+		view.ExitNode = view.ExitNodes[0]
+	}
+	for state := router.StateActive; state <= router.StateExpired; state++ {
+		view.Peers[state.String()] = 0
+	}
+	for _, p := range a.peers() {
+		view.Peers[p.State]++
+		if p.Connected {
+			view.Sessions++
+		}
+	}
+	writeJSON(w, http.StatusOK, view)
+}
+
+func (a *api) config(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.hub.Config().Settings())
+}
+
+func (a *api) listPeers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.peers())
+}
+
+func (a *api) getPeer(w http.ResponseWriter, r *http.Request) {
+	if p := a.findPeer(w, r.PathValue("peer")); p != nil {
+		writeJSON(w, http.StatusOK, p)
+	}
+}
+
+func (a *api) disconnect(w http.ResponseWriter, r *http.Request) {
+	p := a.findPeer(w, r.PathValue("peer"))
+	if p == nil {
+		return
+	}
+	key, _ := security.ParsePublicKey(p.Identity)
+	if !a.hub.Kick(key) {
+		writeError(w, http.StatusConflict, "peer is not connected")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// history serves the charts of the detail page. Peers keep their history
+// after the routing table forgot them, so {peer} is resolved by the store.
+func (a *api) history(w http.ResponseWriter, r *http.Request) {
+	identity, ok := resolveHistory(a.hub.History(), r.PathValue("peer"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no history for "+r.PathValue("peer"))
+		return
+	}
+	span := r.URL.Query().Get("range")
+	if span == "" {
+		span = history.Ranges[0].Name
+	}
+	view, err := a.hub.History().Query(identity, span, time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, view)
+}
+
+// resolveHistory accepts a Virtual IP or a public key in either base64 alphabet
+func resolveHistory(store *history.Store, id string) (string, bool) {
+	if identity, ok := store.Resolve(id); ok {
+		return identity, true
+	}
+	if key, err := security.ParsePublicKey(strings.NewReplacer("-", "+", "_", "/").Replace(id)); err == nil {
+		return store.Resolve(key.String())
+	}
+	return "", false
+}
+
+func (a *api) listBans(w http.ResponseWriter, r *http.Request) {
+	bans := []string{}
+	for _, key := range a.hub.Bans() {
+		bans = append(bans, key.String())
+	}
+	sort.Strings(bans)
+	writeJSON(w, http.StatusOK, bans)
+}
+
+func (a *api) ban(w http.ResponseWriter, r *http.Request) {
+	// Unknown keys may be banned too, before they ever connect
+	if key, ok := parseKey(w, r.PathValue("key")); ok {
+		a.hub.Ban(key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (a *api) unban(w http.ResponseWriter, r *http.Request) {
+	key, ok := parseKey(w, r.PathValue("key"))
+	if !ok {
+		return
+	}
+	if !a.hub.Unban(key) {
+		writeError(w, http.StatusNotFound, "identity is not banned")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type exitNodeView struct {
+	IP  string   `json:"ip"`  // First Exit Node, empty for none
+	IPs []string `json:"ips"` // All of them, in order of preference
+}
+
+func newExitNodeView(ips []string) exitNodeView {
+	view := exitNodeView{IPs: ips}
+	if len(ips) > 0 {
+		view.IP = ips[0]
+	}
+	return view
+}
+
+func (a *api) exitNode(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, newExitNodeView(a.hub.ExitNodes()))
+}
+
+func (a *api) setExitNode(w http.ResponseWriter, r *http.Request) {
+	var req exitNodeView
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	ips := req.IPs
+	if ips == nil && req.IP != "" {
+		ips = []string{req.IP}
+	}
+	for i, s := range ips {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			writeError(w, http.StatusBadRequest, "invalid IP "+s)
+			return
+		}
+		ips[i] = ip.String()
+	}
+	if err := a.hub.SetExitNodes(ips); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, newExitNodeView(a.hub.ExitNodes()))
+}
+
+// assignExit pins the Exit Node of a peer, which may be offline: {peer}
+// is resolved through the addresses it owns
+func (a *api) assignExit(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("peer")
+	var key security.PublicKey
+	if ip := net.ParseIP(id); ip != nil {
+		identity := a.hub.IdentityOf(ip)
+		if identity == "" {
+			writeError(w, http.StatusNotFound, "unknown peer "+id)
+			return
+		}
+		key, _ = security.ParsePublicKey(identity)
+	} else {
+		var ok bool
+		if key, ok = parseKey(w, id); !ok {
+			return
+		}
+	}
+	if _, authorized := a.hub.PeerName(key); !authorized {
+		writeError(w, http.StatusNotFound, "unknown peer "+id)
+		return
+	}
+
+	var req exitNodeView
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if req.IP != "" {
+		ip := net.ParseIP(req.IP)
+		if ip == nil {
+			writeError(w, http.StatusBadRequest, "invalid IP "+req.IP)
+			return
+		}
+		req.IP = ip.String()
+	}
+	if err := a.hub.AssignExit(key, req.IP); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"exit_preference": a.table.ExitPreference(key.String())})
+}
+
+// readOnly answers the routes that change the Hub when no login protects them
+func readOnly(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusForbidden, "read-only API: set web-users or web-tokens to make changes")
+}
+
+// jsonOnly refuses requests that are not JSON. Browsers cannot send that
+// content type cross-site without a preflight, so it also stops form-based
+// CSRF.
+func jsonOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			writeError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// decodeBody strictly decodes a small JSON request body
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+type ruleView struct {
+	Index  int    `json:"index"`
+	Name   string `json:"name,omitempty"`
+	Action string `json:"action"`
+	Rule   string `json:"rule"`
+}
+
+type policyView struct {
+	Enabled bool       `json:"enabled"` // False: no rules, everything is allowed
+	Rules   []ruleView `json:"rules"`
+}
+
+func (a *api) policy(w http.ResponseWriter, r *http.Request) {
+	view := policyView{Rules: []ruleView{}}
+	for i, rule := range a.hub.Policy().Rules() {
+		view.Rules = append(view.Rules, ruleView{Index: i, Name: rule.Name, Action: rule.Action.String(), Rule: rule.String()})
+	}
+	view.Enabled = len(view.Rules) > 0
+	writeJSON(w, http.StatusOK, view)
+}
+
+// flowRequest is a flow to test against the policy
+type flowRequest struct {
+	Src   string `json:"src"`
+	Dst   string `json:"dst"`
+	Proto string `json:"proto"` // tcp, udp or icmp
+	Port  uint16 `json:"port"`  // Destination port (tcp and udp)
+}
+
+type flowView struct {
+	policy.Explanation
+	Flow flowRequest `json:"flow"`
+}
+
+func (a *api) testFlow(w http.ResponseWriter, r *http.Request) {
+	var req flowRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	src, dst := net.ParseIP(req.Src), net.ParseIP(req.Dst)
+	if src == nil || dst == nil {
+		writeError(w, http.StatusBadRequest, "src and dst must be IP addresses")
+		return
+	}
+	if (src.To4() == nil) != (dst.To4() == nil) {
+		writeError(w, http.StatusBadRequest, "src and dst must be of the same address family")
+		return
+	}
+
+	flow := policy.Flow{Src: src, Dst: dst, DstPort: req.Port, HasPorts: req.Port != 0}
+	switch req.Proto = strings.ToLower(req.Proto); req.Proto {
+	case "tcp":
+		flow.Proto = policy.ProtoTCP
+	case "udp":
+		flow.Proto = policy.ProtoUDP
+	case "icmp":
+		flow.Proto = policy.ProtoICMP
+		if src.To4() == nil {
+			flow.Proto = policy.ProtoICMPv6
+		}
+		flow.HasPorts = false
+	default:
+		writeError(w, http.StatusBadRequest, "proto must be tcp, udp or icmp")
+		return
+	}
+
+	explanation := a.hub.Policy().Explain(flow, a.hub.IdentityOf(src), a.hub.IdentityOf(dst))
+	writeJSON(w, http.StatusOK, flowView{Explanation: explanation, Flow: req})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,47 @@
+package dashboard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go-mesh-hub/internal/router"
+)
+
+// Changes are refused without a login, and need a JSON content type with
+// one. Neither case reaches the Hub, so none is needed here.
+func TestAPIChangesGuarded(t *testing.T) {
+	requests := []struct{ method, path string }{
+		{"POST", apiPrefix + "/peers/10.0.0.2/disconnect"},
+		{"PUT", apiPrefix + "/peers/10.0.0.2/exit-node"},
+		{"PUT", apiPrefix + "/bans/key"},
+		{"DELETE", apiPrefix + "/bans/key"},
+		{"PUT", apiPrefix + "/exit-node"},
+	}
+	tests := []struct {
+		name        string
+		writable    bool
+		contentType string
+		want        int
+	}{
+		{"no login", false, "application/json", http.StatusForbidden},
+		{"form post", true, "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"no content type", true, "", http.StatusUnsupportedMediaType},
+		{"text", true, "text/plain", http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		mux := http.NewServeMux()
+		registerAPI(mux, router.NewTable(), nil, tt.writable)
+		for _, req := range requests {
+			r := httptest.NewRequest(req.method, req.path, nil)
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("%s: %s %s = %d, want %d", tt.name, req.method, req.path, w.Code, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Live updates of the peer table: rendered once by the server, then
+// replaced on every "peers" event of /events.
+(function () {
+    var FLAG_MS = 10000; // How long joins and departures stay highlighted
+    var flags = {};      // Virtual IP -> {event, until, row}
+    var columns = ["virtual_ip", "real_ip", "status", "last_seen", "rx_rate", "tx_rate", "rx", "tx", "key_age", "exit"];
+    var body = document.getElementById("peers");
+
+    function render(row, flag) {
+        var tr = document.createElement("tr");
+        tr.className = row.row_class + (flag ? " " + (flag.event === "join" ? "joined" : "left") : "");
+        tr.dataset.ip = row.virtual_ip;
+        columns.forEach(function (key, i) {
+            var td = document.createElement("td");
+            if (key === "status") {
+                var badge = document.createElement("span");
+                badge.className = "badge bg-secondary";
+                badge.textContent = row.status;
+                td.appendChild(badge);
+                if (flag) {
+                    var note = document.createElement("span");
+                    note.className = "badge ms-1 " + (flag.event === "join" ? "bg-info" : "bg-dark");
+                    note.textContent = flag.event === "join" ? "joined" : "left";
+                    td.appendChild(note);
+                }
+            } else if (key === "virtual_ip") {
+                var link = document.createElement("a");
+                link.href = "peer/" + encodeURIComponent(row.virtual_ip);
+                link.textContent = row.virtual_ip;
+                td.appendChild(link);
+            } else {
+                td.textContent = row[key];
+            }
+            if (i === 0) td.className = "fw-bold";
+            tr.appendChild(td);
+        });
+        return tr;
+    }
+
+    function log(text) {
+        document.getElementById("events").textContent = new Date().toLocaleTimeString() + " " + text;
+    }
+
+    var source = new EventSource("events");
+    source.addEventListener("open", function () {
+        document.getElementById("live").textContent = "● Live";
+    });
+    source.addEventListener("error", function () {
+        document.getElementById("live").textContent = "Reconnecting…";
+    });
+    source.addEventListener("peers", function (e) {
+        var msg = JSON.parse(e.data);
+        var now = Date.now();
+        var rows = {};
+        msg.rows.forEach(function (row) { rows[row.virtual_ip] = row; });
+
+        (msg.events || []).forEach(function (ev) {
+            // Departed peers may vanish from the table: keep their last row
+            var last = rows[ev.virtual_ip] || (flags[ev.virtual_ip] && flags[ev.virtual_ip].row);
+            var old = body.querySelector('tr[data-ip="' + ev.virtual_ip + '"]');
+            if (!last && old) {
+                last = {};
+                columns.forEach(function (key, i) { last[key] = old.cells[i].innerText; });
+                last.status = old.cells[2].firstChild ? old.cells[2].firstChild.textContent : "";
+                last.row_class = "";
+            }
+            flags[ev.virtual_ip] = { event: ev.event, until: now + FLAG_MS, row: last };
+            log("Peer " + ev.virtual_ip + (ev.event === "join" ? " joined" : " left"));
+        });
+
+        var list = msg.rows.slice();
+        Object.keys(flags).forEach(function (ip) {
+            if (flags[ip].until < now) {
+                delete flags[ip];
+            } else if (!rows[ip] && flags[ip].row) {
+                list.push(flags[ip].row); // Show departed peers for a while
+            }
+        });
+
+        body.replaceChildren.apply(body, list.map(function (row) { return render(row, flags[row.virtual_ip]); }));
+        document.getElementById("empty").hidden = list.length > 0;
+    });
+})();
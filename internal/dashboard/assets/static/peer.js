@@ -0,0 +1,124 @@
+// History charts of one peer, drawn as plain SVG from
+// /api/v1/peers/{peer}/history. Refreshed every step of the hour range.
+(function () {
+    var SVG = "http://www.w3.org/2000/svg";
+    var REFRESH_MS = 10000;
+    var card = document.getElementById("peer");
+    // URL-safe base64, so the key fits in one path segment
+    var peer = card.dataset.identity.replace(/\+/g, "-").replace(/\//g, "_");
+    var range = "hour";
+
+    function formatBytes(b) {
+        var units = ["B", "KB", "MB", "GB", "TB"];
+        var i = 0;
+        while (b >= 1024 && i < units.length - 1) { b /= 1024; i++; }
+        return b.toFixed(i ? 1 : 0) + " " + units[i];
+    }
+
+    function clear(id) {
+        var svg = document.getElementById(id);
+        svg.replaceChildren();
+        return svg;
+    }
+
+    function element(name, attrs) {
+        var el = document.createElementNS(SVG, name);
+        Object.keys(attrs).forEach(function (k) { el.setAttribute(k, attrs[k]); });
+        return el;
+    }
+
+    // line draws values (null for gaps) spread over the chart, scaled to max
+    function line(svg, values, max, cls) {
+        var box = svg.viewBox.baseVal;
+        var d = "";
+        var pen = false;
+        values.forEach(function (v, i) {
+            if (v === null) { pen = false; return; }
+            var x = values.length > 1 ? i * box.width / (values.length - 1) : 0;
+            var y = box.height - (max > 0 ? v / max : 0) * (box.height - 4);
+            d += (pen ? "L" : "M") + x.toFixed(1) + "," + y.toFixed(1);
+            pen = true;
+        });
+        if (d) svg.appendChild(element("path", { d: d, "class": cls }));
+    }
+
+    // slots spreads the points over the whole range, leaving gaps where the
+    // Hub recorded nothing (it was down)
+    function slots(view) {
+        var count = { hour: 360, day: 288, week: 168 }[view.range];
+        var end = Math.floor(Date.now() / 1000 / view.step) * view.step;
+        var start = end - (count - 1) * view.step;
+        var list = new Array(count).fill(null);
+        view.points.forEach(function (p) {
+            var i = Math.round((p.t - start) / view.step);
+            if (i >= 0 && i < count) list[i] = p;
+        });
+        return list;
+    }
+
+    function draw(view) {
+        var points = slots(view);
+
+        var rx = points.map(function (p) { return p ? p.rx / view.step : null; });
+        var tx = points.map(function (p) { return p ? p.tx / view.step : null; });
+        var peak = Math.max.apply(null, rx.concat(tx).map(function (v) { return v || 0; }));
+        var svg = clear("throughput");
+        line(svg, rx, peak, "rx");
+        line(svg, tx, peak, "tx");
+        document.getElementById("throughput-peak").textContent = "(peak " + formatBytes(peak) + "/s)";
+
+        svg = clear("availability");
+        var width = svg.viewBox.baseVal.width / points.length;
+        var up = 0, samples = 0;
+        points.forEach(function (p, i) {
+            if (!p) return;
+            up += p.up;
+            samples += p.n;
+            svg.appendChild(element("rect", {
+                x: (i * width).toFixed(2), y: 0, width: Math.max(width, 1).toFixed(2), height: 40,
+                "class": p.up === p.n ? "up" : "down",
+                opacity: p.up === p.n ? 1 : (1 - p.up / p.n * 0.7).toFixed(2)
+            }));
+        });
+        document.getElementById("availability-total").textContent =
+            samples ? "(" + (100 * up / samples).toFixed(1) + "% online)" : "";
+
+        var rtt = points.map(function (p) { return p && p.rtts ? p.rtt / p.rtts : null; });
+        var worst = Math.max.apply(null, rtt.map(function (v) { return v || 0; }));
+        svg = clear("rtt");
+        line(svg, rtt, worst, "rtt");
+        document.getElementById("rtt-peak").textContent = worst ? "(max " + worst.toFixed(1) + " ms)" : "(no answers)";
+
+        var list = document.getElementById("transitions");
+        list.replaceChildren.apply(list, view.transitions.slice().reverse().map(function (t) {
+            var li = document.createElement("li");
+            li.textContent = new Date(t.t * 1000).toLocaleString() + " " + (t.online ? "came online" : "went offline");
+            return li;
+        }));
+        if (!view.transitions.length) list.textContent = "No changes in this range.";
+
+        document.getElementById("summary").textContent = points.filter(Boolean).length + " points, one every " + view.step + "s";
+        document.getElementById("updated").textContent = "Updated " + new Date().toLocaleTimeString();
+    }
+
+    function load() {
+        fetch("../api/v1/peers/" + peer + "/history?range=" + range)
+            .then(function (r) { return r.ok ? r.json() : Promise.reject(r.status); })
+            .then(draw)
+            .catch(function (err) {
+                document.getElementById("updated").textContent = "Update failed (" + err + ")";
+            });
+    }
+
+    document.querySelectorAll("#ranges button").forEach(function (button) {
+        button.addEventListener("click", function () {
+            document.querySelectorAll("#ranges button").forEach(function (b) { b.classList.remove("active"); });
+            button.classList.add("active");
+            range = button.dataset.range;
+            load();
+        });
+    });
+
+    load();
+    setInterval(load, REFRESH_MS);
+})();
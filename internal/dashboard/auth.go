@@ -0,0 +1,90 @@
+package dashboard
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// auth protects every handler with HTTP basic auth (bcrypt hashed
+// passwords) and/or bearer tokens (SHA-256 hashed). With neither
+// configured the dashboard is open.
+type auth struct {
+	logins map[string][]byte
+	tokens [][sha256.Size]byte
+
+	// bcrypt is slow on purpose: remember the credentials that already
+	// passed (by their SHA-256) so the page and the API stay responsive
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]bool
+}
+
+func newAuth(logins map[string][]byte, tokens [][sha256.Size]byte) *auth {
+	return &auth{logins: logins, tokens: tokens, verified: make(map[[sha256.Size]byte]bool)}
+}
+
+func (a *auth) enabled() bool {
+	return len(a.logins) > 0 || len(a.tokens) > 0
+}
+
+// wrap rejects requests without valid credentials
+func (a *auth) wrap(next http.Handler) http.Handler {
+	if !a.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.allowed(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(a.logins) > 0 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="go-mesh-hub", charset="UTF-8"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="go-mesh-hub"`)
+		}
+		if strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+			writeError(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+	})
+}
+
+func (a *auth) allowed(r *http.Request) bool {
+	header := r.Header.Get("Authorization")
+	if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+		sum := sha256.Sum256([]byte(token))
+		match := 0
+		for _, h := range a.tokens {
+			match |= subtle.ConstantTimeCompare(sum[:], h[:])
+		}
+		return match == 1
+	}
+
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, known := a.logins[user]
+	if !known {
+		return false
+	}
+	sum := sha256.Sum256([]byte(header))
+	a.mu.Lock()
+	cached := a.verified[sum]
+	a.mu.Unlock()
+	if cached {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	a.mu.Lock()
+	a.verified[sum] = true
+	a.mu.Unlock()
+	return true
+}
@@ -0,0 +1,136 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"go-mesh-hub/internal/router"
+)
+
+// streamInterval is how often the table is sampled for the live page
+const streamInterval = time.Second
+
+// peerEvent flags a peer joining (first seen, or back from expired) or
+// leaving (expired, or forgotten by the routing table)
+type peerEvent struct {
+	VirtualIP string `json:"virtual_ip"`
+	Event     string `json:"event"` // join, leave
+}
+
+// update is the payload of the "peers" event
+type update struct {
+	Rows   []Row       `json:"rows"`
+	Events []peerEvent `json:"events,omitempty"`
+}
+
+// stream samples the routing table once per interval and pushes the peer
+// table with throughput rates to every connected browser (Server-Sent
+// Events). Sampling is shared, so the cost doesn't grow with viewers.
+type stream struct {
+	table *router.Table
+	keys  KeySource
+
+	mu      sync.Mutex
+	clients map[chan []byte]bool
+}
+
+func newStream(table *router.Table, keys KeySource) *stream {
+	s := &stream{table: table, keys: keys, clients: make(map[chan []byte]bool)}
+	go s.run()
+	return s
+}
+
+func (s *stream) run() {
+	// Seeded with the peers already there: they didn't just join
+	previous := make(map[string]router.PeerStats)
+	for _, p := range s.table.Snapshot() {
+		previous[p.VirtualIP] = p
+	}
+	last := time.Now()
+	ticker := time.NewTicker(streamInterval)
+	for now := range ticker.C {
+		peers := s.table.Snapshot()
+		current := make(map[string]router.PeerStats, len(peers))
+		var events []peerEvent
+		for _, p := range peers {
+			current[p.VirtualIP] = p
+			before, known := previous[p.VirtualIP]
+			alive := p.State != router.StateExpired
+			switch {
+			case alive && (!known || before.State == router.StateExpired):
+				events = append(events, peerEvent{p.VirtualIP, "join"})
+			case !alive && known && before.State != router.StateExpired:
+				events = append(events, peerEvent{p.VirtualIP, "leave"})
+			}
+		}
+		for ip, p := range previous {
+			if _, ok := current[ip]; !ok && p.State != router.StateExpired {
+				events = append(events, peerEvent{ip, "leave"})
+			}
+		}
+
+		msg := update{Rows: buildRows(peers, previous, now.Sub(last), s.keys, now), Events: events}
+		previous, last = current, now
+		s.broadcast("peers", msg)
+	}
+}
+
+// broadcast sends an event to every client; slow clients miss it rather
+// than stall the others
+func (s *stream) broadcast(event string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[WEB] Event encoding failed: %v", err)
+		return
+	}
+	frame := []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", event, data))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.clients {
+		select {
+		case ch <- frame:
+		default:
+		}
+	}
+}
+
+// ServeHTTP keeps the connection open and writes the events as they come
+func (s *stream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan []byte, 8)
+	s.mu.Lock()
+	s.clients[ch] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, ch)
+		s.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Don't let reverse proxies buffer it
+	fmt.Fprintf(w, "retry: %d\n\n", (3 * time.Second).Milliseconds())
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case frame := <-ch:
+			if _, err := w.Write(frame); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -1,60 +1,196 @@
 package dashboard
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"embed"
 	"fmt"
 	"html/template"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"sort"
+	"strings"
 	"time"
 
+	"go-mesh-hub/internal/history"
+	"go-mesh-hub/internal/metrics"
 	"go-mesh-hub/internal/router"
 )
 
+// KeySource exposes the transport key state of a peer identity
+type KeySource interface {
+	KeyInfo(identity string) (epoch uint64, created time.Time, ok bool)
+}
+
+// Options configures the dashboard listener and who may use it
+type Options struct {
+	Addr     string // host:port to bind
+	TLS      bool
+	CertFile string // Self-signed pair created if both files are missing
+	KeyFile  string
+	Hosts    []string // Names and IPs put in a generated certificate
+
+	Logins map[string][]byte   // User -> bcrypt hash (basic auth)
+	Tokens [][sha256.Size]byte // SHA-256 of the accepted bearer tokens
+}
+
 // Start launches the HTTP server in a blocking manner (call it with 'go')
-func Start(port int, table *router.Table) {
-	// Register Handler
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		renderHome(w, table)
+func Start(opts Options, table *router.Table, hub Hub) {
+	mux := http.NewServeMux()
+	// Register Handlers
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		renderHome(w, table, hub)
+	})
+	mux.HandleFunc("GET /peer/{peer}", func(w http.ResponseWriter, r *http.Request) {
+		renderPeer(w, r, hub)
 	})
+	mux.Handle("GET /static/", staticFiles())
+	mux.Handle("GET /events", newStream(table, hub))
+	access := newAuth(opts.Logins, opts.Tokens)
+	registerAPI(mux, table, hub, access.enabled())
+	mux.Handle("GET /metrics", metrics.Handler(hub.Metrics))
+
+	if !access.enabled() {
+		if ip := net.ParseIP(opts.Host()); ip == nil || !ip.IsLoopback() {
+			log.Printf("[WEB] Warning: the dashboard has no login and is reachable on %s (set web-users or web-tokens)", opts.Addr)
+		}
+		log.Println("[WEB] The admin API is read-only without web-users or web-tokens")
+	}
+	server := &http.Server{
+		Addr:              opts.Addr,
+		Handler:           access.wrap(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	scheme := "http"
+	if opts.TLS {
+		cert, err := loadOrCreateCert(opts.CertFile, opts.KeyFile, opts.Hosts)
+		if err != nil {
+			log.Printf("[ERR] Dashboard disabled: %v", err)
+			return
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		scheme = "https"
+	}
+	log.Printf("[WEB] Dashboard running at %s://%s (JSON API under %s)", scheme, opts.Addr, apiPrefix)
 
-	addr := fmt.Sprintf("0.0.0.0:%d", port)
-	log.Printf("[WEB] Dashboard running at http://%s", addr)
-	
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Printf("[ERR] Dashboard stopped: %v", err)
+	var err error
+	if opts.TLS {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
 	}
+	log.Printf("[ERR] Dashboard stopped: %v", err)
+}
+
+// Host returns the bind address without the port
+func (o Options) Host() string {
+	host, _, _ := net.SplitHostPort(o.Addr)
+	return host
+}
+
+// Row is one line of the peer table, rendered by the template and pushed
+// as JSON by the event stream
+type Row struct {
+	VirtualIP string `json:"virtual_ip"`
+	RealIP    string `json:"real_ip"`
+	Status    string `json:"status"`    // Online/Idle/Expired
+	RowClass  string `json:"row_class"` // Bootstrap class (success, warning, danger)
+	LastSeen  string `json:"last_seen"`
+	Rx        string `json:"rx"`
+	Tx        string `json:"tx"`
+	RxRate    string `json:"rx_rate"` // Per second, over the last sample
+	TxRate    string `json:"tx_rate"`
+	KeyAge    string `json:"key_age"`
+	Exit      string `json:"exit"` // Exit Node in use
+}
+
+// assets holds the page template, the stylesheet and the script, so the
+// dashboard is a single binary that needs no CDN
+//
+//go:embed assets
+var assets embed.FS
+
+// pages are parsed once at startup
+var pages = template.Must(template.ParseFS(assets, "assets/*.html"))
+
+// staticFiles serves the CSS and JS under /static/ (no directory listings)
+func staticFiles() http.Handler {
+	files, _ := fs.Sub(assets, "assets/static")
+	server := http.StripPrefix("/static/", http.FileServer(http.FS(files)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		server.ServeHTTP(w, r)
+	})
 }
 
-func renderHome(w http.ResponseWriter, table *router.Table) {
+func renderHome(w http.ResponseWriter, table *router.Table, keys KeySource) {
 	// 1. Get Data Snapshot
 	peers := table.Snapshot()
 
-	// 2. Prepare View Data
-	type Row struct {
-		VirtualIP string
-		RealIP    string
-		Status    string // Online/Offline
-		RowClass  string // Bootstrap class (success, danger)
-		LastSeen  string
-		Rx        string
-		Tx        string
+	// 2. Prepare View Data (rates come with the first event)
+	rows := buildRows(peers, nil, 0, keys, time.Now())
+
+	// 3. Render Template
+	render(w, "index.html", rows)
+}
+
+// renderPeer serves the history charts of one peer (drawn by peer.js)
+func renderPeer(w http.ResponseWriter, r *http.Request, hub Hub) {
+	identity, ok := resolveHistory(hub.History(), r.PathValue("peer"))
+	if !ok {
+		http.Error(w, "No history for this peer yet", http.StatusNotFound)
+		return
+	}
+	view, _ := hub.History().Query(identity, history.Ranges[0].Name, time.Now())
+	render(w, "peer.html", view)
+}
+
+func render(w http.ResponseWriter, name string, data interface{}) {
+	var buf bytes.Buffer
+	if err := pages.ExecuteTemplate(&buf, name, data); err != nil {
+		http.Error(w, "Internal Template Error", 500)
+		return
 	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
 
-	var rows []Row
-	now := time.Now()
+// buildRows formats a snapshot of the table, sorted by Virtual IP. With a
+// previous sample taken elapsed ago, it also computes throughput rates.
+func buildRows(peers []router.PeerStats, previous map[string]router.PeerStats, elapsed time.Duration, keys KeySource, now time.Time) []Row {
+	sort.Slice(peers, func(i, j int) bool { return peers[i].VirtualIP < peers[j].VirtualIP })
 
+	rows := make([]Row, 0, len(peers))
 	for _, p := range peers {
 		timeDiff := now.Sub(p.LastSeen)
-		status := "Online"
-		rowClass := "table-success"
-
-		// Logic to determine health
-		if timeDiff > 60*time.Second {
-			status = "Offline"
-			rowClass = "table-danger"
-		} else if timeDiff > 25*time.Second {
-			status = "Idle/Lag"
-			rowClass = "table-warning"
+
+		// The routing table owns the liveness of its peers
+		status, rowClass := "Online", "table-success"
+		switch p.State {
+		case router.StateIdle:
+			status, rowClass = "Idle", "table-warning"
+		case router.StateExpired:
+			status, rowClass = "Expired", "table-danger"
+		}
+
+		rxRate, txRate := "–", "–"
+		// A forgotten and re-learned peer starts again from zero
+		if before, ok := previous[p.VirtualIP]; ok && elapsed > 0 && p.RxBytes >= before.RxBytes && p.TxBytes >= before.TxBytes {
+			rxRate = formatRate(p.RxBytes-before.RxBytes, elapsed)
+			txRate = formatRate(p.TxBytes-before.TxBytes, elapsed)
+		}
+
+		exit := p.Exit
+		if exit == "" {
+			exit = "–"
 		}
 
 		rows = append(rows, Row{
@@ -65,16 +201,22 @@ func renderHome(w http.ResponseWriter, table *router.Table) {
 			LastSeen:  fmt.Sprintf("%.0fs ago", timeDiff.Seconds()),
 			Rx:        formatBytes(p.RxBytes),
 			Tx:        formatBytes(p.TxBytes),
+			RxRate:    rxRate,
+			TxRate:    txRate,
+			KeyAge:    keyAge(keys, p.Identity, now),
+			Exit:      exit,
 		})
 	}
+	return rows
+}
 
-	// 3. Render Template
-	tmpl, err := template.New("index").Parse(htmlTemplate)
-	if err != nil {
-		http.Error(w, "Internal Template Error", 500)
-		return
+// keyAge describes how old the peer's current session key is
+func keyAge(keys KeySource, identity string, now time.Time) string {
+	epoch, created, ok := keys.KeyInfo(identity)
+	if !ok {
+		return "no session"
 	}
-	tmpl.Execute(w, rows)
+	return fmt.Sprintf("%.0fs (epoch %d)", now.Sub(created).Seconds(), epoch)
 }
 
 func formatBytes(b uint64) string {
@@ -90,59 +232,7 @@ func formatBytes(b uint64) string {
 	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "KMGTPE"[exp])
 }
 
-// Embedded HTML for single-binary distribution
-const htmlTemplate = `
-<!DOCTYPE html>
-<html lang="en">
-<head>
-    <meta charset="UTF-8">
-    <meta http-equiv="refresh" content="3"> <title>VPN Dashboard</title>
-    <link href="https://cdn.jsdelivr.net/npm/bootstrap@5.3.0/dist/css/bootstrap.min.css" rel="stylesheet">
-    <style>
-        body { background-color: #f0f2f5; padding-top: 30px; }
-        .card { border: none; box-shadow: 0 4px 6px rgba(0,0,0,0.1); }
-    </style>
-</head>
-<body>
-<div class="container">
-    <div class="card">
-        <div class="card-header bg-dark text-white p-3">
-            <h4 class="mb-0">🛰️ VPN Mesh Control Center</h4>
-        </div>
-        <div class="card-body">
-            <table class="table table-hover align-middle">
-                <thead class="table-light">
-                    <tr>
-                        <th>Virtual IP</th>
-                        <th>Real Address (WAN)</th>
-                        <th>Status</th>
-                        <th>Last Seen</th>
-                        <th>Data In (Rx)</th>
-                        <th>Data Out (Tx)</th>
-                    </tr>
-                </thead>
-                <tbody>
-                    {{range .}}
-                    <tr class="{{.RowClass}}">
-                        <td class="fw-bold">{{.VirtualIP}}</td>
-                        <td>{{.RealIP}}</td>
-                        <td><span class="badge bg-secondary">{{.Status}}</span></td>
-                        <td>{{.LastSeen}}</td>
-                        <td>{{.Rx}}</td>
-                        <td>{{.Tx}}</td>
-                    </tr>
-                    {{end}}
-                </tbody>
-            </table>
-            {{if not .}}
-                <div class="text-center text-muted py-4">No peers connected yet. Waiting for heartbeats...</div>
-            {{end}}
-        </div>
-        <div class="card-footer text-muted text-end">
-            <small>System Active • Auto-refreshing</small>
-        </div>
-    </div>
-</div>
-</body>
-</html>
-`
\ No newline at end of file
+// formatRate turns a byte delta into a bandwidth
+func formatRate(delta uint64, elapsed time.Duration) string {
+	return formatBytes(uint64(float64(delta)/elapsed.Seconds())) + "/s"
+}
@@ -0,0 +1,299 @@
+// Package history keeps a compact traffic and availability history per
+// peer identity: one ring buffer per resolution, so memory stays fixed
+// however long the Hub runs.
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Interval is how often the Hub should call Record
+const Interval = 10 * time.Second
+
+// Range is a time span with a fixed resolution
+type Range struct {
+	Name   string
+	Span   time.Duration
+	Step   time.Duration
+	points int
+}
+
+// Ranges are the resolutions kept for every peer: 10s over the last hour,
+// 5 minutes over the last day and 1 hour over the last week.
+var Ranges = []Range{
+	{Name: "hour", Span: time.Hour, Step: 10 * time.Second},
+	{Name: "day", Span: 24 * time.Hour, Step: 5 * time.Minute},
+	{Name: "week", Span: 7 * 24 * time.Hour, Step: time.Hour},
+}
+
+func init() {
+	for i := range Ranges {
+		Ranges[i].points = int(Ranges[i].Span / Ranges[i].Step)
+	}
+}
+
+// maxTransitions bounds the online/offline log of each peer
+const maxTransitions = 256
+
+// Sample is the state of a peer at one Record call
+type Sample struct {
+	Name      string
+	Addresses []string
+	RxBytes   uint64 // Cumulative counters (resets are handled)
+	TxBytes   uint64
+	Online    bool
+	RTT       time.Duration // 0 when not measured
+}
+
+// Point aggregates the samples of one step
+type Point struct {
+	Time    int64   `json:"t"` // Unix seconds at the start of the step
+	Rx      uint64  `json:"rx"`
+	Tx      uint64  `json:"tx"`
+	Up      uint32  `json:"up"` // Samples where the peer was online
+	Samples uint32  `json:"n"`
+	RTTSum  float64 `json:"rtt"` // Milliseconds
+	RTTs    uint32  `json:"rtts"`
+}
+
+// Transition is a peer going online or offline
+type Transition struct {
+	Time   int64 `json:"t"`
+	Online bool  `json:"online"`
+}
+
+// series is the whole history of one identity
+type series struct {
+	Name        string       `json:"name"`
+	Addresses   []string     `json:"addresses"`
+	Rings       [][]Point    `json:"rings"` // One per Range, indexed by step number
+	Transitions []Transition `json:"transitions"`
+	Online      bool         `json:"online"`
+
+	lastRx, lastTx uint64 // Counters at the previous sample (not saved: the table starts at zero)
+}
+
+// Store holds the series of every peer ever seen
+type Store struct {
+	mu     sync.Mutex
+	series map[string]*series
+	file   string // Empty: memory only
+}
+
+// Open loads the history saved in file, if any. An empty file name keeps
+// the history in memory only.
+func Open(file string) (*Store, error) {
+	s := &Store{series: make(map[string]*series), file: file}
+	if file == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.series); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	for identity, ser := range s.series {
+		if len(ser.Rings) != len(Ranges) {
+			delete(s.series, identity) // Saved with other resolutions
+			continue
+		}
+		for i, r := range Ranges {
+			if len(ser.Rings[i]) != r.points {
+				ser.Rings[i] = make([]Point, r.points)
+			}
+		}
+	}
+	log.Printf("[HIST] Loaded the history of %d peers from %s", len(s.series), file)
+	return s, nil
+}
+
+// Record adds one sample per identity. Identities known to the store but
+// missing from samples are recorded as offline.
+func (s *Store) Record(now time.Time, samples map[string]Sample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for identity := range s.series {
+		if _, ok := samples[identity]; !ok {
+			s.recordLocked(identity, now, Sample{})
+		}
+	}
+	for identity, sample := range samples {
+		s.recordLocked(identity, now, sample)
+	}
+}
+
+func (s *Store) recordLocked(identity string, now time.Time, sample Sample) {
+	ser, ok := s.series[identity]
+	if !ok {
+		ser = &series{Rings: make([][]Point, len(Ranges))}
+		for i, r := range Ranges {
+			ser.Rings[i] = make([]Point, r.points)
+		}
+		s.series[identity] = ser
+	}
+	if sample.Name != "" {
+		ser.Name = sample.Name
+	}
+	if len(sample.Addresses) > 0 {
+		ser.Addresses = sample.Addresses
+	}
+
+	// Traffic since the previous sample; a peer forgotten by the routing
+	// table comes back with its counters at zero
+	var rx, tx uint64
+	if sample.Online || sample.RxBytes > 0 || sample.TxBytes > 0 {
+		rx, tx = delta(sample.RxBytes, ser.lastRx), delta(sample.TxBytes, ser.lastTx)
+		ser.lastRx, ser.lastTx = sample.RxBytes, sample.TxBytes
+	}
+
+	if sample.Online != ser.Online || len(ser.Transitions) == 0 {
+		ser.Online = sample.Online
+		ser.Transitions = append(ser.Transitions, Transition{Time: now.Unix(), Online: sample.Online})
+		if len(ser.Transitions) > maxTransitions {
+			ser.Transitions = ser.Transitions[len(ser.Transitions)-maxTransitions:]
+		}
+	}
+
+	for i, r := range Ranges {
+		p := slot(ser.Rings[i], r, now)
+		p.Rx += rx
+		p.Tx += tx
+		p.Samples++
+		if sample.Online {
+			p.Up++
+		}
+		if sample.RTT > 0 {
+			p.RTTSum += float64(sample.RTT) / float64(time.Millisecond)
+			p.RTTs++
+		}
+	}
+}
+
+func delta(current, last uint64) uint64 {
+	if current < last {
+		return current
+	}
+	return current - last
+}
+
+// slot returns the point of the step containing now, recycling it if it
+// still holds an older step
+func slot(ring []Point, r Range, now time.Time) *Point {
+	step := now.Unix() / int64(r.Step/time.Second)
+	p := &ring[step%int64(len(ring))]
+	start := step * int64(r.Step/time.Second)
+	if p.Time != start {
+		*p = Point{Time: start}
+	}
+	return p
+}
+
+// Resolve finds an identity by public key or by one of its Virtual IPs
+func (s *Store) Resolve(id string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.series[id]; ok {
+		return id, true
+	}
+	for identity, ser := range s.series {
+		for _, addr := range ser.Addresses {
+			if addr == id {
+				return identity, true
+			}
+		}
+	}
+	return "", false
+}
+
+// View is the history of a peer over one Range, oldest point first
+type View struct {
+	Identity    string       `json:"identity"`
+	Name        string       `json:"name,omitempty"`
+	Addresses   []string     `json:"addresses"`
+	Range       string       `json:"range"`
+	Step        int64        `json:"step"` // Seconds
+	Points      []Point      `json:"points"`
+	Transitions []Transition `json:"transitions"` // Within the range
+}
+
+// Query returns the history of an identity over the named range
+func (s *Store) Query(identity, rangeName string, now time.Time) (*View, error) {
+	index := -1
+	for i, r := range Ranges {
+		if r.Name == rangeName {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("unknown range %q", rangeName)
+	}
+	r := Ranges[index]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ser, ok := s.series[identity]
+	if !ok {
+		return nil, fmt.Errorf("no history for %s", identity)
+	}
+
+	view := &View{
+		Identity:    identity,
+		Name:        ser.Name,
+		Addresses:   append([]string{}, ser.Addresses...),
+		Range:       r.Name,
+		Step:        int64(r.Step / time.Second),
+		Points:      []Point{},
+		Transitions: []Transition{},
+	}
+	since := now.Add(-r.Span).Unix()
+	for _, p := range ser.Rings[index] {
+		if p.Samples > 0 && p.Time > since {
+			view.Points = append(view.Points, p)
+		}
+	}
+	sort.Slice(view.Points, func(i, j int) bool { return view.Points[i].Time < view.Points[j].Time })
+	for _, t := range ser.Transitions {
+		if t.Time > since {
+			view.Transitions = append(view.Transitions, t)
+		}
+	}
+	return view, nil
+}
+
+// Forget drops the history of an identity (e.g. no longer authorized)
+func (s *Store) Forget(identity string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.series, identity)
+}
+
+// Save writes the history to its file (atomically, through a rename)
+func (s *Store) Save() error {
+	if s.file == "" {
+		return nil
+	}
+	s.mu.Lock()
+	data, err := json.Marshal(s.series)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
@@ -0,0 +1,225 @@
+package ipam
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var ErrPoolExhausted = errors.New("address pool exhausted")
+
+// Pool hands out Virtual IPs from an IPv4 or IPv6 subnet to peer identities.
+// A lease is sticky: the same identity always gets the same address back,
+// and leases are written to disk so they survive Hub restarts.
+type Pool struct {
+	sync.Mutex
+	network  *net.IPNet
+	reserved map[string]bool   // addresses never handed out (Hub, network, broadcast)
+	leases   map[string]string // identity -> IP
+	owners   map[string]string // IP -> identity
+	path     string
+}
+
+// leaseFile is the on-disk format of the lease database
+type leaseFile struct {
+	Network string            `json:"network"`
+	Leases  map[string]string `json:"leases"`
+}
+
+// New creates a pool for cidr, loading existing leases from path (if any).
+// The addresses in reserved (e.g. the Hub's own TUN IP) are never leased.
+func New(cidr string, reserved []string, path string) (*Pool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pool %q: %w", cidr, err)
+	}
+	if ip4 := network.IP.To4(); ip4 != nil {
+		network.IP = ip4
+	}
+	ones, bits := network.Mask.Size()
+	if bits-ones < 2 {
+		return nil, fmt.Errorf("pool %s is too small", cidr)
+	}
+
+	p := &Pool{
+		network:  network,
+		reserved: make(map[string]bool),
+		leases:   make(map[string]string),
+		owners:   make(map[string]string),
+		path:     path,
+	}
+	p.reserved[network.IP.String()] = true
+	p.reserved[broadcast(network).String()] = true
+	for _, ip := range reserved {
+		if addr := net.ParseIP(ip); addr != nil {
+			ip = addr.String() // Canonical form (IPv6 has many spellings)
+		}
+		p.reserved[ip] = true
+	}
+
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Network returns the subnet served by the pool.
+func (p *Pool) Network() *net.IPNet {
+	return p.network
+}
+
+// Reserve pins addr to identity (static assignment from the peers file).
+func (p *Pool) Reserve(identity string, addr net.IP) error {
+	p.Lock()
+	defer p.Unlock()
+
+	ip := addr.String()
+	if !p.network.Contains(addr) {
+		return fmt.Errorf("%s is outside pool %s", ip, p.network)
+	}
+	if owner, ok := p.owners[ip]; ok && owner != identity {
+		return fmt.Errorf("%s is already leased to %s", ip, owner)
+	}
+	if current, ok := p.leases[identity]; ok && current == ip {
+		return nil
+	}
+	p.bind(identity, ip)
+	return p.save()
+}
+
+// Lease returns the address of identity, allocating one if needed.
+func (p *Pool) Lease(identity string) (net.IP, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if ip, ok := p.leases[identity]; ok {
+		return p.parse(ip), nil
+	}
+
+	// First free address after the network one; the search stops at the
+	// first gap, so it stays short even in a huge IPv6 pool
+	last := broadcast(p.network)
+	for candidate := next(p.network.IP); !candidate.Equal(last); candidate = next(candidate) {
+		ip := candidate.String()
+		if p.reserved[ip] {
+			continue
+		}
+		if _, taken := p.owners[ip]; taken {
+			continue
+		}
+		p.bind(identity, ip)
+		if err := p.save(); err != nil {
+			log.Printf("[IPAM] Failed to persist leases: %v", err)
+		}
+		log.Printf("[IPAM] Leased %s to %s", ip, identity)
+		return candidate, nil
+	}
+	return nil, ErrPoolExhausted
+}
+
+// Leases returns a copy of the identity -> address table.
+func (p *Pool) Leases() map[string]string {
+	p.Lock()
+	defer p.Unlock()
+	out := make(map[string]string, len(p.leases))
+	for k, v := range p.leases {
+		out[k] = v
+	}
+	return out
+}
+
+func (p *Pool) bind(identity, ip string) {
+	if old, ok := p.leases[identity]; ok {
+		delete(p.owners, old)
+	}
+	p.leases[identity] = ip
+	p.owners[ip] = identity
+}
+
+func (p *Pool) load() error {
+	if p.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(p.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var file leaseFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("corrupt lease file %s: %w", p.path, err)
+	}
+	for identity, ip := range file.Leases {
+		addr := net.ParseIP(ip)
+		if addr == nil || !p.network.Contains(addr) || p.reserved[ip] {
+			log.Printf("[IPAM] Dropping stale lease %s -> %s (outside pool %s)", identity, ip, p.network)
+			continue
+		}
+		p.bind(identity, ip)
+	}
+	log.Printf("[IPAM] Loaded %d leases from %s", len(p.leases), p.path)
+	return nil
+}
+
+// save writes the lease table atomically (temp file + rename)
+func (p *Pool) save() error {
+	if p.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(leaseFile{Network: p.network.String(), Leases: p.leases}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p.path), ".leases-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p.path)
+}
+
+// parse decodes a stored address in the pool's family (4 or 16 bytes)
+func (p *Pool) parse(s string) net.IP {
+	ip := net.ParseIP(s)
+	if len(p.network.IP) == net.IPv4len {
+		return ip.To4()
+	}
+	return ip
+}
+
+// broadcast returns the last address of n (reserved in IPv4 pools and kept
+// free in IPv6 ones for symmetry)
+func broadcast(n *net.IPNet) net.IP {
+	out := make(net.IP, len(n.IP))
+	for i := range out {
+		out[i] = n.IP[i] | ^n.Mask[i]
+	}
+	return out
+}
+
+// next returns the address following ip
+func next(ip net.IP) net.IP {
+	out := append(net.IP(nil), ip...)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i]++
+		if out[i] != 0 {
+			break
+		}
+	}
+	return out
+}
@@ -0,0 +1,124 @@
+package ipam
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestLease(t *testing.T) {
+	tests := []struct {
+		name       string
+		cidr       string
+		reserved   []string
+		identities []string
+		want       []string
+	}{
+		{"first free addresses", "10.0.0.0/24", []string{"10.0.0.1"}, []string{"a", "b", "c"}, []string{"10.0.0.2", "10.0.0.3", "10.0.0.4"}},
+		{"sticky per identity", "10.0.0.0/24", nil, []string{"a", "b", "a"}, []string{"10.0.0.1", "10.0.0.2", "10.0.0.1"}},
+		{"skips reserved", "10.0.0.0/29", []string{"10.0.0.1", "10.0.0.3"}, []string{"a", "b"}, []string{"10.0.0.2", "10.0.0.4"}},
+		{"ipv6", "fd00::/64", []string{"fd00:0::1"}, []string{"a", "b"}, []string{"fd00::2", "fd00::3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := New(tt.cidr, tt.reserved, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, identity := range tt.identities {
+				ip, err := pool.Lease(identity)
+				if err != nil {
+					t.Fatalf("Lease(%s): %v", identity, err)
+				}
+				if ip.String() != tt.want[i] {
+					t.Fatalf("Lease(%s) = %s, want %s", identity, ip, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLeaseExhausted(t *testing.T) {
+	// /30: network, Hub, one peer, broadcast
+	pool, err := New("10.0.0.0/30", []string{"10.0.0.1"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Lease("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Lease("b"); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("Lease on a full pool: got %v, want ErrPoolExhausted", err)
+	}
+	// Known identities still get their address back
+	if ip, err := pool.Lease("a"); err != nil || ip.String() != "10.0.0.2" {
+		t.Fatalf("Lease(a) = %v, %v; want 10.0.0.2", ip, err)
+	}
+}
+
+func TestNewRejectsTinyPools(t *testing.T) {
+	for _, cidr := range []string{"10.0.0.0/31", "10.0.0.1/32", "not-a-cidr"} {
+		if _, err := New(cidr, nil, ""); err == nil {
+			t.Errorf("New(%q) accepted", cidr)
+		}
+	}
+}
+
+func TestReserve(t *testing.T) {
+	pool, err := New("10.0.0.0/24", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Reserve("a", net.ParseIP("10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if ip, _ := pool.Lease("b"); ip.String() != "10.0.0.2" {
+		t.Fatalf("Lease(b) = %s, want 10.0.0.2 (10.0.0.1 is reserved for a)", ip)
+	}
+	if err := pool.Reserve("c", net.ParseIP("10.0.0.2")); err == nil {
+		t.Fatal("Reserve of an address leased to another identity succeeded")
+	}
+	if err := pool.Reserve("c", net.ParseIP("192.168.1.1")); err == nil {
+		t.Fatal("Reserve outside the pool succeeded")
+	}
+	// Moving a reservation frees the old address
+	if err := pool.Reserve("a", net.ParseIP("10.0.0.9")); err != nil {
+		t.Fatal(err)
+	}
+	if ip, _ := pool.Lease("d"); ip.String() != "10.0.0.1" {
+		t.Fatalf("Lease(d) = %s, want the freed 10.0.0.1", ip)
+	}
+}
+
+func TestLeasesPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	pool, err := New("10.0.0.0/24", []string{"10.0.0.1"}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, identity := range []string{"a", "b"} {
+		if _, err := pool.Lease(identity); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reloaded, err := New("10.0.0.0/24", []string{"10.0.0.1"}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "10.0.0.2", "b": "10.0.0.3"}
+	got := reloaded.Leases()
+	if len(got) != len(want) || got["a"] != want["a"] || got["b"] != want["b"] {
+		t.Fatalf("reloaded leases = %v, want %v", got, want)
+	}
+
+	// Leases outside a shrunk pool, or on a now reserved address, are dropped
+	shrunk, err := New("10.0.0.0/30", []string{"10.0.0.1", "10.0.0.2"}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := shrunk.Leases(); len(got) != 0 {
+		t.Fatalf("stale leases kept: %v", got)
+	}
+}
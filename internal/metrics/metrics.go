@@ -0,0 +1,96 @@
+// Package metrics implements the few Prometheus metric types the Hub and
+// the Agent need, and the text exposition format to serve them.
+package metrics
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counter is a value that only goes up
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc() { c.v.Add(1) }
+
+func (c *Counter) Add(n uint64) { c.v.Add(n) }
+
+func (c *Counter) Value() uint64 { return c.v.Load() }
+
+// CounterVec is a set of counters told apart by the value of one label
+type CounterVec struct {
+	mu     sync.Mutex
+	values map[string]*Counter
+}
+
+// NewCounterVec creates a vector with the given label values already at
+// zero, so they are exported before the first event
+func NewCounterVec(initial ...string) *CounterVec {
+	v := &CounterVec{values: make(map[string]*Counter)}
+	for _, value := range initial {
+		v.With(value)
+	}
+	return v
+}
+
+// With returns the counter for a label value
+func (v *CounterVec) With(value string) *Counter {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.values[value]
+	if !ok {
+		c = &Counter{}
+		v.values[value] = c
+	}
+	return c
+}
+
+// each visits the counters sorted by label value
+func (v *CounterVec) each(fn func(value string, c *Counter)) {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	v.mu.Unlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		fn(k, v.With(k))
+	}
+}
+
+// LatencyBuckets are the histogram bounds (seconds) used for packet
+// forwarding, from 10µs to 100ms
+var LatencyBuckets = []float64{.00001, .000025, .00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .1}
+
+// Histogram counts observations into cumulative buckets
+type Histogram struct {
+	bounds []float64
+	counts []atomic.Uint64 // One per bound, plus +Inf
+	sum    atomic.Uint64   // float64 bits
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+// Observe records a value in seconds
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i].Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// Since records the time elapsed since start
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Writer produces the Prometheus text exposition format (version 0.0.4)
+type Writer struct {
+	w *bufio.Writer
+}
+
+// Labels are written in the given order: name, value, name, value...
+type Labels []string
+
+// Handler serves the metrics written by collect on every scrape
+func Handler(collect func(*Writer)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		mw := &Writer{w: bufio.NewWriter(w)}
+		collect(mw)
+		mw.w.Flush()
+	})
+}
+
+// Header starts a metric family; kind is counter, gauge or histogram
+func (mw *Writer) Header(name, kind, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Sample writes one value of the current family
+func (mw *Writer) Sample(name string, labels Labels, value float64) {
+	mw.w.WriteString(name)
+	if len(labels) > 0 {
+		mw.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				mw.w.WriteByte(',')
+			}
+			fmt.Fprintf(mw.w, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		mw.w.WriteByte('}')
+	}
+	mw.w.WriteByte(' ')
+	mw.w.WriteString(formatValue(value))
+	mw.w.WriteByte('\n')
+}
+
+// Counter writes a whole counter family with a single sample
+func (mw *Writer) Counter(name, help string, c *Counter) {
+	mw.Header(name, "counter", help)
+	mw.Sample(name, nil, float64(c.Value()))
+}
+
+// Gauge writes a whole gauge family with a single sample
+func (mw *Writer) Gauge(name, help string, value float64) {
+	mw.Header(name, "gauge", help)
+	mw.Sample(name, nil, value)
+}
+
+// CounterVec writes a counter family with one sample per label value
+func (mw *Writer) CounterVec(name, help, label string, v *CounterVec) {
+	mw.Header(name, "counter", help)
+	v.each(func(value string, c *Counter) {
+		mw.Sample(name, Labels{label, value}, float64(c.Value()))
+	})
+}
+
+// Histogram writes a histogram family
+func (mw *Writer) Histogram(name, help string, h *Histogram) {
+	mw.Header(name, "histogram", help)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i].Load()
+		mw.Sample(name+"_bucket", Labels{"le", formatValue(bound)}, float64(cumulative))
+	}
+	cumulative += h.counts[len(h.bounds)].Load()
+	mw.Sample(name+"_bucket", Labels{"le", "+Inf"}, float64(cumulative))
+	mw.Sample(name+"_sum", nil, math.Float64frombits(h.sum.Load()))
+	mw.Sample(name+"_count", nil, float64(cumulative))
+}
+
+func formatValue(v float64) string {
+	if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+		return strconv.FormatFloat(v, 'f', 0, 64) // Counters and timestamps
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,184 @@
+package policy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// FlowTimeout is how long an allowed flow stays open without packets.
+// While it is open, packets in both directions pass without evaluating
+// the rules again, so replies need no rule of their own.
+const FlowTimeout = 5 * time.Minute
+
+// maxFlows bounds the state table; when full, expired flows are dropped
+// first and then the whole table
+const maxFlows = 1 << 16
+
+// Peer is what rules may know about the owner of an address
+type Peer struct {
+	Identity string   `json:"identity"`
+	Name     string   `json:"name"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+func (p *Peer) hasTag(tag string) bool {
+	for _, t := range p.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Engine evaluates the policy on the forwarding path. Without rules it
+// allows everything, as the mesh did before policies existed.
+type Engine struct {
+	mu    sync.Mutex
+	rules []Rule
+	peers map[string]*Peer      // Identity -> Peer
+	flows map[flowKey]time.Time // Open flows (each direction) -> expiry
+}
+
+// New creates an Engine with no rules (allow all)
+func New() *Engine {
+	return &Engine{
+		peers: make(map[string]*Peer),
+		flows: make(map[flowKey]time.Time),
+	}
+}
+
+// Update replaces the rules and the peer tags. Open flows are closed so
+// the new rules apply to established connections too.
+func (e *Engine) Update(rules []Rule, peers []Peer) {
+	byIdentity := make(map[string]*Peer, len(peers))
+	for i := range peers {
+		byIdentity[peers[i].Identity] = &peers[i]
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rules = rules
+	e.peers = byIdentity
+	e.flows = make(map[flowKey]time.Time)
+}
+
+// Enabled reports whether any rule is configured (and so default deny applies)
+func (e *Engine) Enabled() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.rules) > 0
+}
+
+// Rules returns the rules in evaluation order
+func (e *Engine) Rules() []Rule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Rule(nil), e.rules...)
+}
+
+// Allow decides on a packet of the forwarding path. from and to are the
+// identities owning the source and destination ("" for none).
+func (e *Engine) Allow(f Flow, from, to string, now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.rules) == 0 {
+		return true
+	}
+
+	key := keyOf(f)
+	if expires, ok := e.flows[key]; ok && now.Before(expires) {
+		e.flows[key] = now.Add(FlowTimeout)
+		return true
+	}
+
+	index := e.matchLocked(f, e.peers[from], e.peers[to])
+	if index < 0 || e.rules[index].Action == Deny {
+		return false
+	}
+	e.openLocked(key, now)
+	return true
+}
+
+// Track opens a flow for a packet that does not go through the policy,
+// such as traffic sent by the Hub itself, so that its replies pass
+func (e *Engine) Track(f Flow, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.rules) > 0 {
+		e.openLocked(keyOf(f), now)
+	}
+}
+
+func (e *Engine) openLocked(key flowKey, now time.Time) {
+	if len(e.flows) >= maxFlows {
+		e.expireLocked(now)
+		if len(e.flows) >= maxFlows {
+			e.flows = make(map[flowKey]time.Time)
+		}
+	}
+	e.flows[key] = now.Add(FlowTimeout)
+	e.flows[key.reverse()] = now.Add(FlowTimeout)
+}
+
+// Expire drops the flows that timed out
+func (e *Engine) Expire(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.expireLocked(now)
+}
+
+func (e *Engine) expireLocked(now time.Time) {
+	for key, expires := range e.flows {
+		if !now.Before(expires) {
+			delete(e.flows, key)
+		}
+	}
+}
+
+// matchLocked returns the index of the first rule matching the flow, or -1
+func (e *Engine) matchLocked(f Flow, from, to *Peer) int {
+	for i := range e.rules {
+		if e.rules[i].matches(f, from, to) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Explanation tells why a flow is allowed or denied
+type Explanation struct {
+	Allowed bool   `json:"allowed"`
+	Index   int    `json:"index"` // Position of the matching rule, -1 if none matched
+	Rule    string `json:"rule,omitempty"`
+	Reason  string `json:"reason"`
+	From    *Peer  `json:"from,omitempty"` // Owners of the addresses, if peers
+	To      *Peer  `json:"to,omitempty"`
+}
+
+// Explain evaluates the rules for a flow without opening it, for the
+// "test this flow" API. Open flows are ignored: the answer is what a new
+// connection would get.
+func (e *Engine) Explain(f Flow, from, to string) Explanation {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ex := Explanation{Index: -1, From: e.peers[from], To: e.peers[to]}
+	if len(e.rules) == 0 {
+		ex.Allowed = true
+		ex.Reason = "no policy configured: all traffic is allowed"
+		return ex
+	}
+	ex.Index = e.matchLocked(f, ex.From, ex.To)
+	if ex.Index < 0 {
+		ex.Reason = "no rule matched: denied by default"
+		return ex
+	}
+	rule := &e.rules[ex.Index]
+	ex.Allowed = rule.Action == Allow
+	ex.Rule = rule.Name
+	ex.Reason = fmt.Sprintf("rule %d matched: %s", ex.Index, rule)
+	if rule.Name != "" {
+		ex.Reason = fmt.Sprintf("rule %d (%s) matched: %s", ex.Index, rule.Name, rule)
+	}
+	return ex
+}
@@ -0,0 +1,119 @@
+package policy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func mustRule(t *testing.T, action string, from, to []string, proto string, ports ...string) Rule {
+	t.Helper()
+	rule, err := NewRule("", action, from, to, proto, ports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rule
+}
+
+func tcpFlow(src, dst string, port uint16) Flow {
+	return Flow{Src: net.ParseIP(src), Dst: net.ParseIP(dst), Proto: ProtoTCP, SrcPort: 40000, DstPort: port, HasPorts: true}
+}
+
+var testPeers = []Peer{
+	{Identity: "key-laptop", Name: "laptop", Tags: []string{"dev"}},
+	{Identity: "key-server", Name: "server", Tags: []string{"prod"}},
+}
+
+func TestFirstMatchWins(t *testing.T) {
+	rules := []Rule{
+		mustRule(t, "deny", []string{"tag:dev"}, []string{"10.0.0.3"}, "tcp", "22"),
+		mustRule(t, "allow", []string{"tag:dev"}, []string{"10.0.0.0/24"}, "tcp"),
+		mustRule(t, "allow", nil, []string{"10.0.0.3"}, "udp", "53"),
+		mustRule(t, "deny", nil, nil, ""),
+		mustRule(t, "allow", nil, nil, ""), // Never reached
+	}
+	udp := tcpFlow("10.0.0.2", "10.0.0.3", 53)
+	udp.Proto = ProtoUDP
+
+	tests := []struct {
+		name     string
+		flow     Flow
+		from, to string
+		index    int
+		allowed  bool
+	}{
+		{"denied before the broader allow", tcpFlow("10.0.0.2", "10.0.0.3", 22), "key-laptop", "key-server", 0, false},
+		{"allowed by the second rule", tcpFlow("10.0.0.2", "10.0.0.3", 443), "key-laptop", "key-server", 1, true},
+		{"other peers fall through", tcpFlow("10.0.0.4", "10.0.0.3", 443), "key-server", "key-server", 3, false},
+		{"protocol and port", udp, "key-server", "key-server", 2, true},
+		{"no peer owns the source", tcpFlow("192.0.2.1", "10.0.0.3", 443), "", "key-server", 3, false},
+	}
+	engine := New()
+	engine.Update(rules, testPeers)
+	for _, tt := range tests {
+		ex := engine.Explain(tt.flow, tt.from, tt.to)
+		if ex.Index != tt.index || ex.Allowed != tt.allowed {
+			t.Errorf("%s: Explain = rule %d allowed %v (%s), want rule %d allowed %v", tt.name, ex.Index, ex.Allowed, ex.Reason, tt.index, tt.allowed)
+		}
+		if got := engine.Allow(tt.flow, tt.from, tt.to, time.Now()); got != tt.allowed {
+			t.Errorf("%s: Allow = %v, want %v", tt.name, got, tt.allowed)
+		}
+	}
+}
+
+func TestDefaultDeny(t *testing.T) {
+	engine := New()
+	flow := tcpFlow("10.0.0.2", "10.0.0.3", 22)
+	if !engine.Allow(flow, "", "", time.Now()) || engine.Enabled() {
+		t.Fatal("an engine without rules must allow everything")
+	}
+
+	engine.Update([]Rule{mustRule(t, "allow", nil, nil, "udp")}, testPeers)
+	ex := engine.Explain(flow, "key-laptop", "key-server")
+	if ex.Allowed || ex.Index != -1 {
+		t.Fatalf("unmatched flow: %+v, want denied by default", ex)
+	}
+}
+
+func TestPortsNeedFirstFragment(t *testing.T) {
+	engine := New()
+	engine.Update([]Rule{mustRule(t, "allow", nil, nil, "tcp", "22")}, testPeers)
+	flow := tcpFlow("10.0.0.2", "10.0.0.3", 22)
+	flow.HasPorts = false
+	if engine.Allow(flow, "", "", time.Now()) {
+		t.Fatal("a rule with ports matched a packet without ports")
+	}
+}
+
+func TestFlowsAllowReplies(t *testing.T) {
+	engine := New()
+	engine.Update([]Rule{mustRule(t, "allow", []string{"tag:dev"}, nil, "tcp", "22")}, testPeers)
+	now := time.Now()
+
+	request := tcpFlow("10.0.0.2", "10.0.0.3", 22)
+	reply := Flow{Src: request.Dst, Dst: request.Src, Proto: ProtoTCP, SrcPort: 22, DstPort: request.SrcPort, HasPorts: true}
+
+	if engine.Allow(reply, "key-server", "key-laptop", now) {
+		t.Fatal("reply allowed before the request opened the flow")
+	}
+	if !engine.Allow(request, "key-laptop", "key-server", now) {
+		t.Fatal("request denied")
+	}
+	if !engine.Allow(reply, "key-server", "key-laptop", now.Add(time.Second)) {
+		t.Fatal("reply of an open flow denied")
+	}
+
+	// Idle flows close
+	later := now.Add(time.Second + FlowTimeout)
+	engine.Expire(later)
+	if engine.Allow(reply, "key-server", "key-laptop", later) {
+		t.Fatal("reply allowed after the flow timed out")
+	}
+
+	// New rules close open flows
+	engine.Allow(request, "key-laptop", "key-server", now)
+	engine.Update(engine.Rules(), testPeers)
+	if engine.Allow(reply, "key-server", "key-laptop", now) {
+		t.Fatal("reply allowed after the rules were reloaded")
+	}
+}
@@ -0,0 +1,98 @@
+package policy
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// Flow is what rules look at in a packet
+type Flow struct {
+	Src, Dst         net.IP
+	Proto            uint8
+	SrcPort, DstPort uint16
+	HasPorts         bool // False for non-TCP/UDP packets and non-first fragments
+}
+
+// IPv6 extension headers skipped to reach the transport header
+const (
+	ipv6HopByHop = 0
+	ipv6Routing  = 43
+	ipv6Fragment = 44
+	ipv6DestOpts = 60
+)
+
+// ParseFlow reads the addresses, protocol and ports of a raw IPv4 or IPv6
+// packet
+func ParseFlow(packet []byte) (Flow, bool) {
+	var f Flow
+	if len(packet) == 0 {
+		return f, false
+	}
+	var transport []byte
+	switch packet[0] >> 4 {
+	case 4:
+		ihl := int(packet[0]&0x0f) * 4
+		if len(packet) < 20 || ihl < 20 || len(packet) < ihl {
+			return f, false
+		}
+		f.Src, f.Dst = net.IP(packet[12:16]), net.IP(packet[16:20])
+		f.Proto = packet[9]
+		if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+			return f, true // Later fragment: only the first carries the ports
+		}
+		transport = packet[ihl:]
+	case 6:
+		if len(packet) < 40 {
+			return f, false
+		}
+		f.Src, f.Dst = net.IP(packet[8:24]), net.IP(packet[24:40])
+		next, rest := packet[6], packet[40:]
+		for next == ipv6HopByHop || next == ipv6Routing || next == ipv6DestOpts || next == ipv6Fragment {
+			if len(rest) < 8 {
+				return f, true
+			}
+			length := (int(rest[1]) + 1) * 8
+			if next == ipv6Fragment {
+				length = 8
+				if binary.BigEndian.Uint16(rest[2:4])&0xfff8 != 0 {
+					f.Proto = rest[0]
+					return f, true
+				}
+			}
+			if len(rest) < length {
+				return f, true
+			}
+			next, rest = rest[0], rest[length:]
+		}
+		f.Proto = next
+		transport = rest
+	default:
+		return f, false
+	}
+
+	if (f.Proto == ProtoTCP || f.Proto == ProtoUDP) && len(transport) >= 4 {
+		f.SrcPort = binary.BigEndian.Uint16(transport[0:2])
+		f.DstPort = binary.BigEndian.Uint16(transport[2:4])
+		f.HasPorts = true
+	}
+	return f, true
+}
+
+// flowKey identifies one direction of a flow in the state table
+type flowKey struct {
+	src, dst         [16]byte
+	proto            uint8
+	srcPort, dstPort uint16
+}
+
+func keyOf(f Flow) flowKey {
+	k := flowKey{proto: f.Proto, srcPort: f.SrcPort, dstPort: f.DstPort}
+	copy(k.src[:], f.Src.To16())
+	copy(k.dst[:], f.Dst.To16())
+	return k
+}
+
+// reverse is the key of the replies to k
+func (k flowKey) reverse() flowKey {
+	return flowKey{src: k.dst, dst: k.src, proto: k.proto, srcPort: k.dstPort, dstPort: k.srcPort}
+}
@@ -0,0 +1,255 @@
+// Package policy decides which flows the Hub forwards between peers (and
+// to the Exit Node). Rules are evaluated in order and the first match
+// wins; once any rule is configured, whatever no rule allows is denied.
+package policy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Action is what a matching rule does with a flow
+type Action bool
+
+const (
+	Deny  Action = false
+	Allow Action = true
+)
+
+func (a Action) String() string {
+	if a == Allow {
+		return "allow"
+	}
+	return "deny"
+}
+
+// IP protocol numbers understood by rules
+const (
+	ProtoICMP   = 1
+	ProtoTCP    = 6
+	ProtoUDP    = 17
+	ProtoICMPv6 = 58
+)
+
+// Selector matches one side of a flow: "*", "tag:<tag>", "peer:<name or
+// public key>", or an address or CIDR prefix
+type Selector struct {
+	text   string
+	tag    string
+	peer   string
+	prefix *net.IPNet
+}
+
+// ParseSelector parses the text form of a Selector
+func ParseSelector(s string) (Selector, error) {
+	s = strings.TrimSpace(s)
+	sel := Selector{text: s}
+	switch {
+	case s == "*" || s == "any":
+	case strings.HasPrefix(s, "tag:"):
+		if sel.tag = s[len("tag:"):]; sel.tag == "" {
+			return sel, fmt.Errorf("empty tag in %q", s)
+		}
+	case strings.HasPrefix(s, "peer:"):
+		if sel.peer = s[len("peer:"):]; sel.peer == "" {
+			return sel, fmt.Errorf("empty peer in %q", s)
+		}
+	case strings.Contains(s, "/"):
+		_, prefix, err := net.ParseCIDR(s)
+		if err != nil {
+			return sel, fmt.Errorf("invalid prefix %q", s)
+		}
+		sel.prefix = prefix
+	default:
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return sel, fmt.Errorf("invalid selector %q (expected *, tag:, peer:, an address or a prefix)", s)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		sel.prefix = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	return sel, nil
+}
+
+func (s Selector) String() string {
+	return s.text
+}
+
+// matches reports whether an endpoint of a flow (its address and the peer
+// owning it, if any) is selected
+func (s Selector) matches(ip net.IP, peer *Peer) bool {
+	switch {
+	case s.prefix != nil:
+		return s.prefix.Contains(ip)
+	case s.tag != "":
+		return peer != nil && peer.hasTag(s.tag)
+	case s.peer != "":
+		return peer != nil && (peer.Name == s.peer || peer.Identity == s.peer)
+	}
+	return true
+}
+
+// PortRange is an inclusive range of TCP/UDP ports
+type PortRange struct {
+	First, Last uint16
+}
+
+func (r PortRange) String() string {
+	if r.First == r.Last {
+		return strconv.Itoa(int(r.First))
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+// ParsePorts parses "22" or "8000-8100"
+func ParsePorts(s string) (PortRange, error) {
+	first, last, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	if !isRange {
+		last = first
+	}
+	a, err1 := strconv.ParseUint(first, 10, 16)
+	b, err2 := strconv.ParseUint(last, 10, 16)
+	if err1 != nil || err2 != nil || a == 0 || b < a {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return PortRange{First: uint16(a), Last: uint16(b)}, nil
+}
+
+// Rule is one entry of the policy
+type Rule struct {
+	Name   string
+	Action Action
+	From   []Selector // Empty matches any source
+	To     []Selector // Empty matches any destination
+	Proto  string     // "tcp", "udp", "icmp" or "" for any
+	Ports  []PortRange
+}
+
+// NewRule builds a Rule from its config file form
+func NewRule(name, action string, from, to []string, proto string, ports []string) (Rule, error) {
+	rule := Rule{Name: name}
+	switch action {
+	case "allow":
+		rule.Action = Allow
+	case "deny":
+		rule.Action = Deny
+	default:
+		return rule, fmt.Errorf("action must be allow or deny, got %q", action)
+	}
+	for _, s := range from {
+		sel, err := ParseSelector(s)
+		if err != nil {
+			return rule, fmt.Errorf("from: %v", err)
+		}
+		rule.From = append(rule.From, sel)
+	}
+	for _, s := range to {
+		sel, err := ParseSelector(s)
+		if err != nil {
+			return rule, fmt.Errorf("to: %v", err)
+		}
+		rule.To = append(rule.To, sel)
+	}
+	switch proto = strings.ToLower(proto); proto {
+	case "", "any":
+		proto = ""
+	case "tcp", "udp", "icmp":
+	default:
+		return rule, fmt.Errorf("proto must be tcp, udp, icmp or any, got %q", proto)
+	}
+	rule.Proto = proto
+	for _, s := range ports {
+		r, err := ParsePorts(s)
+		if err != nil {
+			return rule, fmt.Errorf("ports: %v", err)
+		}
+		rule.Ports = append(rule.Ports, r)
+	}
+	if len(rule.Ports) > 0 && proto != "tcp" && proto != "udp" {
+		return rule, fmt.Errorf("ports need proto tcp or udp")
+	}
+	return rule, nil
+}
+
+// matches reports whether the rule applies to a flow between two peers
+// (nil for addresses no peer owns, e.g. the Internet or the Hub)
+func (r *Rule) matches(f Flow, from, to *Peer) bool {
+	if !r.protoMatches(f.Proto) {
+		return false
+	}
+	if len(r.Ports) > 0 {
+		if !f.HasPorts {
+			return false // Non-first fragment: no ports to look at
+		}
+		inRange := false
+		for _, p := range r.Ports {
+			if f.DstPort >= p.First && f.DstPort <= p.Last {
+				inRange = true
+				break
+			}
+		}
+		if !inRange {
+			return false
+		}
+	}
+	return anyMatches(r.From, f.Src, from) && anyMatches(r.To, f.Dst, to)
+}
+
+func (r *Rule) protoMatches(proto uint8) bool {
+	switch r.Proto {
+	case "tcp":
+		return proto == ProtoTCP
+	case "udp":
+		return proto == ProtoUDP
+	case "icmp":
+		return proto == ProtoICMP || proto == ProtoICMPv6
+	}
+	return true
+}
+
+func anyMatches(selectors []Selector, ip net.IP, peer *Peer) bool {
+	if len(selectors) == 0 {
+		return true
+	}
+	for _, s := range selectors {
+		if s.matches(ip, peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// String describes the rule in one line, e.g.
+// "allow tcp 22,443 from tag:admins to 10.0.0.0/24"
+func (r *Rule) String() string {
+	var b strings.Builder
+	b.WriteString(r.Action.String())
+	if r.Proto != "" {
+		b.WriteString(" " + r.Proto)
+	}
+	if len(r.Ports) > 0 {
+		ports := make([]string, len(r.Ports))
+		for i, p := range r.Ports {
+			ports[i] = p.String()
+		}
+		b.WriteString(" " + strings.Join(ports, ","))
+	}
+	b.WriteString(" from " + selectors(r.From) + " to " + selectors(r.To))
+	return b.String()
+}
+
+func selectors(list []Selector) string {
+	if len(list) == 0 {
+		return "*"
+	}
+	parts := make([]string, len(list))
+	for i, s := range list {
+		parts[i] = s.String()
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,142 @@
+package policy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		in      string
+		ok      bool
+		matches []string // Addresses selected (with no owning peer)
+		misses  []string
+	}{
+		{"*", true, []string{"10.0.0.1", "fd00::1"}, nil},
+		{"any", true, []string{"8.8.8.8"}, nil},
+		{"10.0.0.0/24", true, []string{"10.0.0.1", "10.0.0.255"}, []string{"10.0.1.1"}},
+		{" 10.0.0.5 ", true, []string{"10.0.0.5"}, []string{"10.0.0.6"}},
+		{"fd00::/64", true, []string{"fd00::1"}, []string{"fd01::1"}},
+		{"fd00::1", true, []string{"fd00::1"}, []string{"fd00::2"}},
+		{"tag:dev", true, nil, []string{"10.0.0.1"}},
+		{"peer:laptop", true, nil, []string{"10.0.0.1"}},
+		{"tag:", false, nil, nil},
+		{"peer:", false, nil, nil},
+		{"10.0.0.0/33", false, nil, nil},
+		{"laptop", false, nil, nil},
+	}
+	for _, tt := range tests {
+		sel, err := ParseSelector(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseSelector(%q) error = %v, want ok %v", tt.in, err, tt.ok)
+			continue
+		}
+		for _, ip := range tt.matches {
+			if !sel.matches(net.ParseIP(ip), nil) {
+				t.Errorf("%q does not match %s", tt.in, ip)
+			}
+		}
+		for _, ip := range tt.misses {
+			if sel.matches(net.ParseIP(ip), nil) {
+				t.Errorf("%q matches %s", tt.in, ip)
+			}
+		}
+	}
+}
+
+func TestSelectorPeers(t *testing.T) {
+	laptop := &Peer{Identity: "key-laptop", Name: "laptop", Tags: []string{"dev", "admins"}}
+	server := &Peer{Identity: "key-server", Name: "server", Tags: []string{"prod"}}
+	ip := net.ParseIP("10.0.0.2")
+
+	tests := []struct {
+		sel  string
+		peer *Peer
+		want bool
+	}{
+		{"tag:dev", laptop, true},
+		{"tag:admins", laptop, true},
+		{"tag:dev", server, false},
+		{"tag:dev", nil, false},
+		{"peer:laptop", laptop, true},
+		{"peer:key-laptop", laptop, true},
+		{"peer:laptop", server, false},
+		{"peer:laptop", nil, false},
+		{"*", nil, true},
+	}
+	for _, tt := range tests {
+		sel, err := ParseSelector(tt.sel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sel.matches(ip, tt.peer); got != tt.want {
+			t.Errorf("%q matches %v = %v, want %v", tt.sel, tt.peer, got, tt.want)
+		}
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		in          string
+		first, last uint16
+		ok          bool
+	}{
+		{"22", 22, 22, true},
+		{" 8000-8100 ", 8000, 8100, true},
+		{"65535", 65535, 65535, true},
+		{"0", 0, 0, false},
+		{"65536", 0, 0, false},
+		{"100-10", 0, 0, false},
+		{"ssh", 0, 0, false},
+		{"10-", 0, 0, false},
+	}
+	for _, tt := range tests {
+		r, err := ParsePorts(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParsePorts(%q) error = %v, want ok %v", tt.in, err, tt.ok)
+			continue
+		}
+		if tt.ok && (r.First != tt.first || r.Last != tt.last) {
+			t.Errorf("ParsePorts(%q) = %v, want %d-%d", tt.in, r, tt.first, tt.last)
+		}
+	}
+}
+
+func TestNewRule(t *testing.T) {
+	tests := []struct {
+		name   string
+		action string
+		from   []string
+		to     []string
+		proto  string
+		ports  []string
+		want   string // String() of the rule, "" if it must be rejected
+	}{
+		{"ssh", "allow", []string{"tag:admins"}, []string{"10.0.0.0/24"}, "tcp", []string{"22", "443"}, "allow tcp 22,443 from tag:admins to 10.0.0.0/24"},
+		{"any", "deny", nil, nil, "ANY", nil, "deny from * to *"},
+		{"icmp", "allow", nil, []string{"peer:server"}, "icmp", nil, "allow icmp from * to peer:server"},
+		{"bad action", "permit", nil, nil, "", nil, ""},
+		{"bad proto", "allow", nil, nil, "gre", nil, ""},
+		{"ports without proto", "allow", nil, nil, "", []string{"22"}, ""},
+		{"ports with icmp", "allow", nil, nil, "icmp", []string{"22"}, ""},
+		{"bad port", "allow", nil, nil, "tcp", []string{"x"}, ""},
+		{"bad from", "allow", []string{"tag:"}, nil, "", nil, ""},
+		{"bad to", "allow", nil, []string{"nowhere"}, "", nil, ""},
+	}
+	for _, tt := range tests {
+		rule, err := NewRule(tt.name, tt.action, tt.from, tt.to, tt.proto, tt.ports)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: accepted as %q", tt.name, rule.String())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := rule.String(); got != tt.want {
+			t.Errorf("%s: String() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
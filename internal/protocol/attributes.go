@@ -0,0 +1,159 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// Handshake payloads are encrypted by the Noise layer and carry a list of
+// TLV attributes:
+//
+//	+------+-------------+-------------+
+//	| type | length (LE) |    value    |
+//	+------+-------------+-------------+
+//	  1 B       2 B         length B
+//
+// Receivers skip attribute types they don't know, so new attributes can be
+// added without a protocol version bump.
+
+// AttrType identifies a handshake attribute.
+type AttrType byte
+
+const (
+	// AttrAddress is the Virtual IP leased to the Agent (Hub -> Agent),
+	// encoded as a prefix so the Agent also learns the overlay subnet.
+	AttrAddress AttrType = 1
+	// AttrRoute is a subnet reachable through the mesh. Agents send the LANs
+	// they advertise; the Hub sends the LANs advertised by everyone else.
+	AttrRoute AttrType = 2
+	// AttrPublicKey is the static key of another Agent (hole punching).
+	AttrPublicKey AttrType = 3
+	// AttrEndpoint is a UDP endpoint as seen by the Hub: [address][port LE].
+	AttrEndpoint AttrType = 4
+	// AttrAllowedIP is a prefix another Agent may use as inner source
+	// address, so direct traffic gets the same anti-spoofing as relayed one.
+	AttrAllowedIP AttrType = 5
+	// AttrCookie is an opaque value the receiver echoes back (ping/pong).
+	AttrCookie AttrType = 6
+	// AttrExitNode is the Exit Node an Agent wants for its Internet traffic
+	// (Agent -> Hub), as a single-address prefix.
+	AttrExitNode AttrType = 7
+	// AttrExitOffer tells the Hub that the Agent forwards Internet traffic
+	// for the mesh (Agent -> Hub, -exit-node). It has no value.
+	AttrExitOffer AttrType = 8
+)
+
+var ErrBadAttribute = errors.New("malformed attribute")
+
+// Attr is a single handshake attribute.
+type Attr struct {
+	Type  AttrType
+	Value []byte
+}
+
+// MarshalAttrs encodes a list of attributes.
+func MarshalAttrs(attrs []Attr) []byte {
+	var out []byte
+	for _, a := range attrs {
+		out = append(out, byte(a.Type))
+		out = binary.LittleEndian.AppendUint16(out, uint16(len(a.Value)))
+		out = append(out, a.Value...)
+	}
+	return out
+}
+
+// ParseAttrs decodes a list of attributes.
+func ParseAttrs(b []byte) ([]Attr, error) {
+	var attrs []Attr
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, ErrBadAttribute
+		}
+		length := int(binary.LittleEndian.Uint16(b[1:3]))
+		if len(b) < 3+length {
+			return nil, ErrBadAttribute
+		}
+		attrs = append(attrs, Attr{Type: AttrType(b[0]), Value: b[3 : 3+length]})
+		b = b[3+length:]
+	}
+	return attrs, nil
+}
+
+// PrefixAttr encodes an IP prefix as [address][prefix length].
+func PrefixAttr(t AttrType, prefix *net.IPNet) Attr {
+	ip := prefix.IP.To4()
+	if ip == nil {
+		ip = prefix.IP.To16()
+	}
+	ones, _ := prefix.Mask.Size()
+	value := append(append([]byte{}, ip...), byte(ones))
+	return Attr{Type: t, Value: value}
+}
+
+// Prefix decodes an attribute created with PrefixAttr. The address keeps
+// its host bits (e.g. 10.0.0.5/24).
+func (a Attr) Prefix() (*net.IPNet, error) {
+	var bits int
+	switch len(a.Value) {
+	case net.IPv4len + 1:
+		bits = 32
+	case net.IPv6len + 1:
+		bits = 128
+	default:
+		return nil, ErrBadAttribute
+	}
+	ones := int(a.Value[len(a.Value)-1])
+	if ones > bits {
+		return nil, ErrBadAttribute
+	}
+	ip := make(net.IP, len(a.Value)-1)
+	copy(ip, a.Value)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)}, nil
+}
+
+// EndpointAttr encodes a UDP endpoint as [address][port].
+func EndpointAttr(t AttrType, addr *net.UDPAddr) Attr {
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+	value := binary.LittleEndian.AppendUint16(append([]byte{}, ip...), uint16(addr.Port))
+	return Attr{Type: t, Value: value}
+}
+
+// Endpoint decodes an attribute created with EndpointAttr.
+func (a Attr) Endpoint() (*net.UDPAddr, error) {
+	if len(a.Value) != net.IPv4len+2 && len(a.Value) != net.IPv6len+2 {
+		return nil, ErrBadAttribute
+	}
+	ip := make(net.IP, len(a.Value)-2)
+	copy(ip, a.Value)
+	port := binary.LittleEndian.Uint16(a.Value[len(ip):])
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// Prefixes decodes every prefix attribute of the given type, skipping
+// malformed ones.
+func Prefixes(attrs []Attr, t AttrType) []*net.IPNet {
+	var prefixes []*net.IPNet
+	for _, a := range attrs {
+		if a.Type != t {
+			continue
+		}
+		if prefix, err := a.Prefix(); err == nil {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// Find returns the first attribute of the given type.
+func Find(attrs []Attr, t AttrType) (Attr, bool) {
+	for _, a := range attrs {
+		if a.Type == t {
+			return a, true
+		}
+	}
+	return Attr{}, false
+}
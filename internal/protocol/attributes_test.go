@@ -0,0 +1,147 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestParseAttrs(t *testing.T) {
+	big := bytes.Repeat([]byte{7}, 0xffff)
+	tests := []struct {
+		name string
+		b    []byte
+		want []Attr // nil with ok false: rejected
+		ok   bool
+	}{
+		{"empty", nil, nil, true},
+		{"one", []byte{1, 2, 0, 0xaa, 0xbb}, []Attr{{1, []byte{0xaa, 0xbb}}}, true},
+		{"no value", []byte{8, 0, 0}, []Attr{{8, []byte{}}}, true},
+		{"two", []byte{1, 1, 0, 0xaa, 9, 0, 0}, []Attr{{1, []byte{0xaa}}, {9, []byte{}}}, true},
+		{"largest value", append([]byte{6, 0xff, 0xff}, big...), []Attr{{6, big}}, true},
+		{"type only", []byte{1}, nil, false},
+		{"half a length", []byte{1, 2}, nil, false},
+		{"value truncated", []byte{1, 3, 0, 0xaa, 0xbb}, nil, false},
+		{"length past the end", []byte{1, 0xff, 0xff, 0xaa}, nil, false},
+		{"second one truncated", []byte{1, 1, 0, 0xaa, 2, 4, 0, 1}, nil, false},
+		{"trailing byte", []byte{1, 1, 0, 0xaa, 2}, nil, false},
+	}
+	for _, tt := range tests {
+		attrs, err := ParseAttrs(tt.b)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			if !errors.Is(err, ErrBadAttribute) || attrs != nil {
+				t.Errorf("%s: got %v, %v; want nil, ErrBadAttribute", tt.name, attrs, err)
+			}
+			continue
+		}
+		if len(attrs) != len(tt.want) {
+			t.Errorf("%s: %d attributes, want %d", tt.name, len(attrs), len(tt.want))
+			continue
+		}
+		for i := range attrs {
+			if attrs[i].Type != tt.want[i].Type || !bytes.Equal(attrs[i].Value, tt.want[i].Value) {
+				t.Errorf("%s: attribute %d = %v, want %v", tt.name, i, attrs[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestAttrsRoundTrip(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.50.0/24")
+	_, v6, _ := net.ParseCIDR("fd00:1::/48")
+	endpoint := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51820}
+	attrs := []Attr{
+		PrefixAttr(AttrRoute, lan),
+		PrefixAttr(AttrRoute, v6),
+		EndpointAttr(AttrEndpoint, endpoint),
+		{Type: AttrExitOffer},
+		{Type: 200, Value: []byte("from a newer peer")},
+	}
+	code, parsed, err := ParseControl(MarshalControl(ControlPeer, attrs))
+	if err != nil || code != ControlPeer {
+		t.Fatalf("ParseControl = %v, %v", code, err)
+	}
+	prefixes := Prefixes(parsed, AttrRoute)
+	if len(prefixes) != 2 || prefixes[0].String() != lan.String() || prefixes[1].String() != v6.String() {
+		t.Fatalf("Prefixes = %v, want [%s %s]", prefixes, lan, v6)
+	}
+	a, ok := Find(parsed, AttrEndpoint)
+	if !ok {
+		t.Fatal("endpoint missing")
+	}
+	if got, err := a.Endpoint(); err != nil || got.String() != endpoint.String() {
+		t.Fatalf("Endpoint = %v, %v; want %s", got, err, endpoint)
+	}
+	if _, ok := Find(parsed, AttrExitOffer); !ok {
+		t.Fatal("empty attribute missing")
+	}
+	if a, ok := Find(parsed, 200); !ok || string(a.Value) != "from a newer peer" {
+		t.Fatal("unknown attribute not kept for the caller to skip")
+	}
+
+	if _, _, err := ParseControl(nil); !errors.Is(err, ErrShortPacket) {
+		t.Fatalf("empty control message: %v, want ErrShortPacket", err)
+	}
+	if _, _, err := ParseControl([]byte{byte(ControlPeer), 1, 9, 0}); !errors.Is(err, ErrBadAttribute) {
+		t.Fatalf("truncated attribute: %v, want ErrBadAttribute", err)
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	tests := []struct {
+		name  string
+		value []byte
+		want  string // "" if rejected
+	}{
+		{"ipv4 keeps host bits", []byte{10, 0, 0, 5, 24}, "10.0.0.5/24"},
+		{"ipv4 /32", []byte{10, 0, 0, 5, 32}, "10.0.0.5/32"},
+		{"ipv4 /0", []byte{0, 0, 0, 0, 0}, "0.0.0.0/0"},
+		{"ipv6", append(net.ParseIP("fd00::1").To16(), 64), "fd00::1/64"},
+		{"ipv4 /33", []byte{10, 0, 0, 5, 33}, ""},
+		{"ipv6 /129", append(net.ParseIP("fd00::1").To16(), 129), ""},
+		{"empty", nil, ""},
+		{"no length", []byte{10, 0, 0, 5}, ""},
+		{"between families", make([]byte, 9), ""},
+		{"oversized", make([]byte, 18), ""},
+	}
+	for _, tt := range tests {
+		prefix, err := Attr{Type: AttrRoute, Value: tt.value}.Prefix()
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: accepted as %s", tt.name, prefix)
+			}
+			continue
+		}
+		if err != nil || prefix.String() != tt.want {
+			t.Errorf("%s: Prefix = %v, %v; want %s", tt.name, prefix, err, tt.want)
+		}
+	}
+
+	// Prefixes skips the malformed ones and the other types
+	attrs := []Attr{
+		{Type: AttrRoute, Value: []byte{10, 0, 0, 0, 8}},
+		{Type: AttrRoute, Value: []byte{10, 0, 0, 0, 99}},
+		{Type: AttrRoute, Value: []byte{1, 2, 3}},
+		{Type: AttrAllowedIP, Value: []byte{10, 0, 0, 2, 32}},
+	}
+	if got := Prefixes(attrs, AttrRoute); len(got) != 1 || got[0].String() != "10.0.0.0/8" {
+		t.Fatalf("Prefixes = %v, want [10.0.0.0/8]", got)
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	for _, size := range []int{0, 4, 5, 7, 17, 19} {
+		if addr, err := (Attr{Type: AttrEndpoint, Value: make([]byte, size)}).Endpoint(); err == nil {
+			t.Errorf("%d byte endpoint accepted as %s", size, addr)
+		}
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 65535}
+	if got, err := EndpointAttr(AttrEndpoint, addr).Endpoint(); err != nil || got.String() != "192.0.2.1:65535" {
+		t.Fatalf("Endpoint = %v, %v", got, err)
+	}
+}
@@ -0,0 +1,47 @@
+package protocol
+
+// Control messages travel encrypted inside TypeControl datagrams:
+//
+//	+------+----------------------+
+//	| code | attributes (TLV)     |
+//	+------+----------------------+
+//
+// Unknown codes are ignored by the receiver.
+
+// ControlCode identifies a control message.
+type ControlCode byte
+
+const (
+	// ControlRoutes carries the full list of mesh subnets (AttrRoute).
+	// It replaces whatever the receiver knew before.
+	ControlRoutes ControlCode = 1
+	// ControlPeer introduces another Agent for a direct tunnel: its key
+	// (AttrPublicKey), its endpoint (AttrEndpoint) and its allowed IPs
+	// (AttrAllowedIP). Both sides get the message and start punching.
+	ControlPeer ControlCode = 2
+	// ControlPing asks the receiver to answer with a ControlPong carrying
+	// the same attributes (an AttrCookie), so the sender measures the RTT.
+	ControlPing ControlCode = 3
+	ControlPong ControlCode = 4
+	// ControlDropPeer tells an Agent to close its direct tunnel with another
+	// one (AttrPublicKey): the Hub no longer vouches for it (ban, kick,
+	// revoked key) or the acl rules now forbid direct tunnels.
+	ControlDropPeer ControlCode = 5
+)
+
+// MarshalControl encodes a control message.
+func MarshalControl(code ControlCode, attrs []Attr) []byte {
+	return append([]byte{byte(code)}, MarshalAttrs(attrs)...)
+}
+
+// ParseControl decodes a control message.
+func ParseControl(b []byte) (ControlCode, []Attr, error) {
+	if len(b) < 1 {
+		return 0, nil, ErrShortPacket
+	}
+	attrs, err := ParseAttrs(b[1:])
+	if err != nil {
+		return 0, nil, err
+	}
+	return ControlCode(b[0]), attrs, nil
+}
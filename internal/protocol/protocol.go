@@ -0,0 +1,136 @@
+// Package protocol defines the framing of every UDP datagram exchanged
+// between the Hub and the Agents.
+//
+// Each datagram starts with a fixed 8 byte header:
+//
+//	0      1      2             4                        8
+//	+------+------+-------------+------------------------+
+//	| ver  | type |  reserved   | receiver session index |
+//	+------+------+-------------+------------------------+
+//
+// The receiver index is chosen by the receiving side during the handshake,
+// so it can find the right session without trying every key it holds.
+// Handshake messages add the sender index right after the header; the rest
+// of the datagram belongs to the cryptographic layer.
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Version is the protocol version spoken by this build.
+// Receivers answer a handshake with the version the initiator used, so a
+// newer Hub keeps serving older Agents as long as it still supports it.
+const Version byte = 1
+
+// MinVersion is the oldest version this build still accepts.
+const MinVersion byte = 1
+
+const (
+	// HeaderSize is the length of the fixed header.
+	HeaderSize = 8
+	// IndexSize is the length of a session index.
+	IndexSize = 4
+)
+
+// MessageType identifies the payload carried after the header.
+type MessageType byte
+
+const (
+	TypeHandshakeInit     MessageType = 1
+	TypeHandshakeResponse MessageType = 2
+	TypeData              MessageType = 3 // Encrypted IP packet
+	TypeKeepalive         MessageType = 4 // Encrypted empty payload
+	TypeControl           MessageType = 5 // Encrypted control message
+	TypeDisconnect        MessageType = 6 // Encrypted empty payload, peer is leaving
+	TypePunch             MessageType = 7 // Cleartext, opens a NAT mapping towards another Agent
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case TypeHandshakeInit:
+		return "handshake-init"
+	case TypeHandshakeResponse:
+		return "handshake-response"
+	case TypeData:
+		return "data"
+	case TypeKeepalive:
+		return "keepalive"
+	case TypeControl:
+		return "control"
+	case TypeDisconnect:
+		return "disconnect"
+	case TypePunch:
+		return "punch"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(t))
+}
+
+// IsTransport reports whether the message is encrypted with session keys.
+func (t MessageType) IsTransport() bool {
+	return t >= TypeData && t <= TypeDisconnect
+}
+
+var (
+	ErrShortPacket        = errors.New("packet too short")
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrUnknownType        = errors.New("unknown message type")
+)
+
+// Header is the decoded fixed header.
+type Header struct {
+	Version  byte
+	Type     MessageType
+	Receiver uint32
+}
+
+// NewHeader creates a header for the current protocol version.
+func NewHeader(t MessageType, receiver uint32) Header {
+	return Header{Version: Version, Type: t, Receiver: receiver}
+}
+
+// AppendTo encodes the header at the end of b.
+func (h Header) AppendTo(b []byte) []byte {
+	var raw [HeaderSize]byte
+	raw[0] = h.Version
+	raw[1] = byte(h.Type)
+	binary.LittleEndian.PutUint32(raw[4:], h.Receiver)
+	return append(b, raw[:]...)
+}
+
+// Parse decodes the header of a datagram and returns it with the body.
+func Parse(packet []byte) (Header, []byte, error) {
+	if len(packet) < HeaderSize {
+		return Header{}, nil, ErrShortPacket
+	}
+	h := Header{
+		Version:  packet[0],
+		Type:     MessageType(packet[1]),
+		Receiver: binary.LittleEndian.Uint32(packet[4:HeaderSize]),
+	}
+	if h.Version < MinVersion || h.Version > Version {
+		return h, nil, ErrUnsupportedVersion
+	}
+	if h.Type < TypeHandshakeInit || h.Type > TypePunch {
+		return h, nil, ErrUnknownType
+	}
+	return h, packet[HeaderSize:], nil
+}
+
+// AppendHandshake builds the cleartext prefix of a handshake message:
+// header followed by the sender index. The prefix is also mixed into the
+// handshake hash, so tampering with it breaks the handshake.
+func AppendHandshake(b []byte, h Header, sender uint32) []byte {
+	b = h.AppendTo(b)
+	return binary.LittleEndian.AppendUint32(b, sender)
+}
+
+// SplitHandshake extracts the sender index from a handshake body.
+func SplitHandshake(body []byte) (uint32, []byte, error) {
+	if len(body) < IndexSize {
+		return 0, nil, ErrShortPacket
+	}
+	return binary.LittleEndian.Uint32(body[:IndexSize]), body[IndexSize:], nil
+}
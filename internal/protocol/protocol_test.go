@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	valid := NewHeader(TypeData, 0x01020304).AppendTo(nil)
+	with := func(i int, v byte) []byte {
+		b := bytes.Clone(valid)
+		b[i] = v
+		return b
+	}
+
+	tests := []struct {
+		name   string
+		packet []byte
+		err    error
+		body   []byte
+	}{
+		{"header only", valid, nil, []byte{}},
+		{"with body", append(bytes.Clone(valid), 0xaa, 0xbb), nil, []byte{0xaa, 0xbb}},
+		{"empty", nil, ErrShortPacket, nil},
+		{"one byte short", valid[:HeaderSize-1], ErrShortPacket, nil},
+		{"version 0", with(0, 0), ErrUnsupportedVersion, nil},
+		{"future version", with(0, Version+1), ErrUnsupportedVersion, nil},
+		{"type 0", with(1, 0), ErrUnknownType, nil},
+		{"unknown type", with(1, byte(TypePunch)+1), ErrUnknownType, nil},
+	}
+	for _, tt := range tests {
+		h, body, err := Parse(tt.packet)
+		if !errors.Is(err, tt.err) || (err == nil) != (tt.err == nil) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if h != NewHeader(TypeData, 0x01020304) {
+			t.Errorf("%s: header = %+v", tt.name, h)
+		}
+		if !bytes.Equal(body, tt.body) {
+			t.Errorf("%s: body = % x, want % x", tt.name, body, tt.body)
+		}
+	}
+}
+
+func TestSplitHandshake(t *testing.T) {
+	packet := AppendHandshake(nil, NewHeader(TypeHandshakeInit, 0), 42)
+	packet = append(packet, "noise"...)
+	h, body, err := Parse(packet)
+	if err != nil || h.Type != TypeHandshakeInit {
+		t.Fatalf("Parse = %+v, %v", h, err)
+	}
+	sender, rest, err := SplitHandshake(body)
+	if err != nil || sender != 42 || string(rest) != "noise" {
+		t.Fatalf("SplitHandshake = %d, %q, %v; want 42, noise", sender, rest, err)
+	}
+	if _, _, err := SplitHandshake(body[:IndexSize-1]); !errors.Is(err, ErrShortPacket) {
+		t.Fatalf("truncated sender index: %v, want ErrShortPacket", err)
+	}
+}
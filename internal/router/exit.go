@@ -0,0 +1,271 @@
+package router
+
+import (
+	"log"
+	"time"
+)
+
+// returnTimeout is how long replies from the Internet are let back in
+// through an Exit Node after a peer last sent traffic through it. It
+// covers flows that outlive a failover to another exit.
+const returnTimeout = 5 * time.Minute
+
+// returnRefresh is how old the return path of a flow may get before
+// GetRoute takes the write lock to refresh it
+const returnRefresh = 10 * time.Second
+
+// Exit is an Exit Node: a Virtual IP that carries Internet traffic for the
+// mesh, and the identity owning it when known ("" until the table learns it)
+type Exit struct {
+	IP       string
+	Identity string
+}
+
+// SetExitNodes replaces the Exit Nodes, in order of preference. Peers
+// without a choice of their own use the first healthy one.
+func (t *Table) SetExitNodes(exits []Exit) {
+	t.Lock()
+	defer t.Unlock()
+	changed := len(exits) != len(t.exits)
+	for i := 0; !changed && i < len(exits); i++ {
+		changed = exits[i].IP != t.exits[i].IP
+	}
+	t.exits = exits
+	if !changed {
+		return
+	}
+	t.exitUp = make(map[string]bool)
+	ips := make([]string, len(exits))
+	for i, e := range exits {
+		ips[i] = e.IP
+	}
+	log.Printf("[ROUTER] Exit Nodes set to: %v", ips)
+}
+
+// ExitNodes returns the Virtual IPs of the Exit Nodes, in order of preference
+func (t *Table) ExitNodes() []string {
+	t.RLock()
+	defer t.RUnlock()
+	ips := make([]string, len(t.exits))
+	for i, e := range t.exits {
+		ips[i] = e.IP
+	}
+	return ips
+}
+
+// SetLocal declares the Hub's own Virtual IPs. As an Exit Node, the Hub
+// is always healthy.
+func (t *Table) SetLocal(ips ...string) {
+	t.Lock()
+	defer t.Unlock()
+	t.local = make(map[string]bool)
+	for _, ip := range ips {
+		if ip != "" {
+			t.local[ip] = true
+		}
+	}
+}
+
+// AssignExit pins the Exit Node of an identity ("" goes back to the
+// Agent's request or the default). It wins over what the Agent asks for.
+func (t *Table) AssignExit(identity, ip string) {
+	t.Lock()
+	defer t.Unlock()
+	if ip == "" {
+		delete(t.assigned, identity)
+		return
+	}
+	t.assigned[identity] = ip
+}
+
+// SetAssignments replaces every admin assignment (identity -> Exit Node)
+func (t *Table) SetAssignments(assigned map[string]string) {
+	t.Lock()
+	defer t.Unlock()
+	t.assigned = assigned
+}
+
+// RequestExit records the Exit Node an Agent asked for in its handshake
+// ("" for no preference)
+func (t *Table) RequestExit(identity, ip string) {
+	t.Lock()
+	defer t.Unlock()
+	if ip == "" {
+		delete(t.requested, identity)
+		return
+	}
+	t.requested[identity] = ip
+}
+
+// OfferExit records whether the Agent of an identity forwards Internet
+// traffic, as told in its handshake. An Agent listed as Exit Node is only
+// used while it does. It returns true if that changed.
+func (t *Table) OfferExit(identity string, offered bool) bool {
+	t.Lock()
+	defer t.Unlock()
+	if t.offers[identity] == offered {
+		return false
+	}
+	if offered {
+		t.offers[identity] = true
+	} else {
+		delete(t.offers, identity)
+	}
+	return true
+}
+
+// ExitPreference returns the Exit Node chosen for an identity, by the admin
+// or by the Agent ("" if none). ExitFor tells which one it actually uses.
+func (t *Table) ExitPreference(identity string) string {
+	t.RLock()
+	defer t.RUnlock()
+	return t.preferenceLocked(identity)
+}
+
+func (t *Table) preferenceLocked(identity string) string {
+	if ip, ok := t.assigned[identity]; ok {
+		return ip
+	}
+	return t.requested[identity]
+}
+
+// ExitFor returns the Virtual IP of the Exit Node carrying the Internet
+// traffic of an identity (one of the Hub's own, see SetLocal, when the Hub
+// is the exit), false if no Exit Node is healthy
+func (t *Table) ExitFor(identity string) (string, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	exit := t.exitForLocked(identity, time.Now())
+	return exit, exit != ""
+}
+
+// exitForLocked picks the preferred Exit Node of identity if it is healthy,
+// otherwise fails over to the first healthy one in order. Exits that are
+// quiet (idle) are only used when no other one is active. A peer never
+// exits through itself.
+func (t *Table) exitForLocked(identity string, now time.Time) string {
+	if len(t.exits) == 0 {
+		return ""
+	}
+	pref := t.exitByIP(t.preferenceLocked(identity))
+	for _, fresh := range []bool{true, false} {
+		if pref.IP != "" && t.usableExitLocked(pref, identity, fresh, now) {
+			return pref.IP
+		}
+		for _, e := range t.exits {
+			if t.usableExitLocked(e, identity, fresh, now) {
+				return e.IP
+			}
+		}
+	}
+	return ""
+}
+
+func (t *Table) usableExitLocked(e Exit, identity string, fresh bool, now time.Time) bool {
+	if owner := t.exitOwnerLocked(e); owner != "" && owner == identity {
+		return false
+	}
+	return t.exitHealthyLocked(e, fresh, now)
+}
+
+// exitByIP returns the registered Exit Node with that Virtual IP, if any
+func (t *Table) exitByIP(ip string) Exit {
+	for _, e := range t.exits {
+		if ip != "" && e.IP == ip {
+			return e
+		}
+	}
+	return Exit{}
+}
+
+// exitOwnerLocked returns the identity behind an Exit Node, learning it
+// from the routes when it wasn't known when the exit was registered
+func (t *Table) exitOwnerLocked(e Exit) string {
+	if e.Identity != "" {
+		return e.Identity
+	}
+	if peer, ok := t.routes[e.IP]; ok {
+		return peer.Identity
+	}
+	return ""
+}
+
+// exitHealthyLocked reports whether an Exit Node forwards Internet traffic
+// and was heard from recently: within the idle threshold when fresh,
+// otherwise before it expires
+func (t *Table) exitHealthyLocked(e Exit, fresh bool, now time.Time) bool {
+	if t.local[e.IP] {
+		return true
+	}
+	owner := t.exitOwnerLocked(e)
+	if !t.offers[owner] {
+		return false
+	}
+	ep, ok := t.endpoints[owner]
+	if !ok {
+		return false
+	}
+	limit := t.deadAfter
+	if fresh {
+		limit = t.idleAfter
+	}
+	return now.Sub(ep.lastSeen) <= limit
+}
+
+// checkExitsLocked logs the Exit Nodes going down (peers using them fail
+// over to the next healthy one) and coming back
+func (t *Table) checkExitsLocked(now time.Time) {
+	for _, e := range t.exits {
+		up := t.exitHealthyLocked(e, true, now)
+		if was, seen := t.exitUp[e.IP]; seen && was != up {
+			if up {
+				log.Printf("[ROUTER] Exit Node %s is back, its peers return to it", e.IP)
+			} else {
+				log.Printf("[ROUTER] Exit Node %s went quiet, its peers fail over to the next healthy one", e.IP)
+			}
+		}
+		t.exitUp[e.IP] = up
+	}
+}
+
+// useExitLocked remembers that src ("" for the Hub) sent Internet traffic
+// through the Exit Node exit
+func (t *Table) useExitLocked(src, exit string, now time.Time) {
+	used, ok := t.returns[src]
+	if !ok {
+		used = make(map[string]time.Time)
+		t.returns[src] = used
+	}
+	used[exit] = now
+}
+
+// ReturnPath reports whether a packet from the identity exit whose source
+// is not one of its addresses is a reply from the Internet for dst ("" for
+// the Hub): dst sent traffic through an Exit Node of exit recently. It
+// returns the Virtual IP of that Exit Node.
+func (t *Table) ReturnPath(exit, dst string) (string, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	now := time.Now()
+	for ip, last := range t.returns[dst] {
+		e := t.exitByIP(ip)
+		if e.IP != "" && t.exitOwnerLocked(e) == exit && now.Sub(last) <= returnTimeout {
+			return ip, true
+		}
+	}
+	return "", false
+}
+
+// expireReturnsLocked forgets the return paths that timed out
+func (t *Table) expireReturnsLocked(now time.Time) {
+	for src, used := range t.returns {
+		for ip, last := range used {
+			if now.Sub(last) > returnTimeout {
+				delete(used, ip)
+			}
+		}
+		if len(used) == 0 {
+			delete(t.returns, src)
+		}
+	}
+}
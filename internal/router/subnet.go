@@ -0,0 +1,67 @@
+package router
+
+import (
+	"log"
+	"net"
+	"sort"
+	"time"
+)
+
+// Subnet is a LAN prefix reachable through a peer
+type Subnet struct {
+	Prefix   *net.IPNet
+	Identity string // Public key of the advertising peer
+}
+
+// SetSubnets replaces the prefixes advertised by an identity and records the
+// endpoint where that peer can be reached.
+// It returns true if the mesh-wide set of subnets changed.
+func (t *Table) SetSubnets(identity string, realAddr *net.UDPAddr, prefixes []*net.IPNet) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	if realAddr != nil {
+		t.touchLocked(identity, realAddr.String(), time.Now())
+	}
+
+	var kept []Subnet
+	var previous []string
+	for _, s := range t.subnets {
+		if s.Identity == identity {
+			previous = append(previous, s.Prefix.String())
+			continue
+		}
+		kept = append(kept, s)
+	}
+	var current []string
+	for _, prefix := range prefixes {
+		kept = append(kept, Subnet{Prefix: prefix, Identity: identity})
+		current = append(current, prefix.String())
+	}
+
+	// Keep the list ordered by prefix length so the first match is the longest
+	sort.SliceStable(kept, func(i, j int) bool {
+		a, _ := kept[i].Prefix.Mask.Size()
+		b, _ := kept[j].Prefix.Mask.Size()
+		return a > b
+	})
+	t.subnets = kept
+
+	sort.Strings(previous)
+	sort.Strings(current)
+	changed := len(previous) != len(current)
+	for i := 0; !changed && i < len(current); i++ {
+		changed = previous[i] != current[i]
+	}
+	if changed {
+		log.Printf("[ROUTE] Subnets of %s: %v", identity, current)
+	}
+	return changed
+}
+
+// Subnets returns a copy of all advertised subnets
+func (t *Table) Subnets() []Subnet {
+	t.RLock()
+	defer t.RUnlock()
+	return append([]Subnet(nil), t.subnets...)
+}
@@ -7,77 +7,258 @@ import (
 	"time"
 )
 
+// PeerState is the liveness of a route entry, refreshed by Reap
+type PeerState int
+
+const (
+	StateActive  PeerState = iota // Heard from within the idle threshold
+	StateIdle                     // Quiet, but still routed
+	StateExpired                  // Silent past the dead threshold: no longer routed
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case StateActive:
+		return "active"
+	case StateIdle:
+		return "idle"
+	case StateExpired:
+		return "expired"
+	}
+	return "unknown"
+}
+
+// Default liveness thresholds (Agents send a keepalive every 20s)
+const (
+	DefaultIdleAfter = 30 * time.Second
+	DefaultDeadAfter = 2 * time.Minute
+)
+
 // PeerStats holds the state of a connected client
 type PeerStats struct {
 	VirtualIP string
+	Identity  string // Public key of the authenticated owner of VirtualIP
 	RealAddr  string
 	LastSeen  time.Time
+	State     PeerState
 	RxBytes   uint64
 	TxBytes   uint64
+	RxPackets uint64
+	TxPackets uint64
+	Exit      string // Exit Node carrying the Internet traffic of the owner, if any
+}
+
+// endpoint is where an identity was last heard from
+type endpoint struct {
+	addr      string
+	lastSeen  time.Time
+	virtualIP string // Last Virtual IP it sent from, counts its LAN traffic
 }
 
 // Table manages the mapping between Virtual IPs and Peer Data
 type Table struct {
 	sync.RWMutex
-	routes map[string]*PeerStats
-	exitNodeIP string
+	routes    map[string]*PeerStats
+	subnets   []Subnet             // Advertised LANs, longest prefix first
+	endpoints map[string]*endpoint // Identity -> last known Real Address
+
+	exits     []Exit                          // Exit Nodes in order of preference
+	local     map[string]bool                 // The Hub's own Virtual IPs (an always healthy exit)
+	assigned  map[string]string               // Identity -> Exit Node set by the admin
+	requested map[string]string               // Identity -> Exit Node asked for by the Agent
+	offers    map[string]bool                 // Identities whose Agent forwards Internet traffic
+	exitUp    map[string]bool                 // Last health of each exit, to log changes
+	returns   map[string]map[string]time.Time // Identity -> Agent exits it used -> when
+
+	idleAfter time.Duration
+	deadAfter time.Duration
 }
 
 func NewTable() *Table {
 	return &Table{
-		routes: make(map[string]*PeerStats),
+		routes:    make(map[string]*PeerStats),
+		endpoints: make(map[string]*endpoint),
+		local:     make(map[string]bool),
+		assigned:  make(map[string]string),
+		requested: make(map[string]string),
+		offers:    make(map[string]bool),
+		exitUp:    make(map[string]bool),
+		returns:   make(map[string]map[string]time.Time),
+		idleAfter: DefaultIdleAfter,
+		deadAfter: DefaultDeadAfter,
 	}
 }
 
-// Learn updates the route and refreshes "LastSeen"
-// It returns the PeerStats object so we can update RxBytes externally if needed
-func (t *Table) Learn(virtualIP string, realAddr *net.UDPAddr) {
+// SetThresholds changes after how long without traffic a peer becomes
+// idle and then expired. Expired entries are forgotten after twice dead.
+func (t *Table) SetThresholds(idle, dead time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	t.idleAfter = idle
+	t.deadAfter = dead
+}
+
+// Learn updates the route and refreshes "LastSeen".
+// A Virtual IP is bound to the first authenticated identity that uses it;
+// a different identity claiming it is rejected and Learn returns false.
+func (t *Table) Learn(virtualIP string, identity string, realAddr *net.UDPAddr) bool {
 	t.Lock()
 	defer t.Unlock()
 
 	peer, exists := t.routes[virtualIP]
 	if !exists {
-		peer = &PeerStats{VirtualIP: virtualIP}
+		peer = &PeerStats{VirtualIP: virtualIP, Identity: identity}
 		t.routes[virtualIP] = peer
 		log.Printf("[ROUTE] New Peer Learned: %s at %s", virtualIP, realAddr)
 	}
 
+	if peer.Identity != identity {
+		log.Printf("[SEC] Spoofing attempt: %s at %s claimed %s owned by %s", identity, realAddr, virtualIP, peer.Identity)
+		return false
+	}
+
 	// Update dynamic fields
 	if peer.RealAddr != realAddr.String() {
 		log.Printf("[ROUTE] Peer %s moved to %s", virtualIP, realAddr)
 		peer.RealAddr = realAddr.String()
 	}
 	peer.LastSeen = time.Now()
+	peer.State = StateActive
+	t.touchLocked(identity, peer.RealAddr, peer.LastSeen)
+	t.endpoints[identity].virtualIP = virtualIP
+	return true
 }
 
-// Lookup finds the Real UDP Address for a given Virtual IP
+// Touch records that an identity was heard from at realAddr (any
+// authenticated packet, keepalives included). It keeps all the routes of
+// the peer alive and follows it when its endpoint changes.
+func (t *Table) Touch(identity string, realAddr *net.UDPAddr) {
+	t.Lock()
+	defer t.Unlock()
+	t.touchLocked(identity, realAddr.String(), time.Now())
+}
+
+func (t *Table) touchLocked(identity, realAddr string, now time.Time) {
+	ep, ok := t.endpoints[identity]
+	if !ok {
+		ep = &endpoint{}
+		t.endpoints[identity] = ep
+	}
+	ep.addr = realAddr
+	ep.lastSeen = now
+}
+
+// lastSeenLocked is the newest of the entry's own traffic and its owner's
+func (t *Table) lastSeenLocked(peer *PeerStats) time.Time {
+	if ep, ok := t.endpoints[peer.Identity]; ok && ep.lastSeen.After(peer.LastSeen) {
+		return ep.lastSeen
+	}
+	return peer.LastSeen
+}
+
+// aliveLocked reports whether the endpoint of an identity may still get traffic
+func (t *Table) aliveLocked(identity string) (*endpoint, bool) {
+	ep, ok := t.endpoints[identity]
+	if !ok || time.Since(ep.lastSeen) > t.deadAfter {
+		return nil, false
+	}
+	return ep, true
+}
+
+// Lookup finds the Real UDP Address for a given Virtual IP, or for the peer
+// advertising the most specific subnet that contains it
 func (t *Table) Lookup(virtualIP string) *net.UDPAddr {
 	t.RLock()
 	defer t.RUnlock()
+	return t.lookupLocked(virtualIP)
+}
 
-	if peer, ok := t.routes[virtualIP]; ok {
+func (t *Table) lookupLocked(dstIP string) *net.UDPAddr {
+	if peer, ok := t.routes[dstIP]; ok {
+		// Expired peers get nothing: they are gone or moved without telling us
+		ep, alive := t.aliveLocked(peer.Identity)
+		if !alive {
+			return nil
+		}
 		// Convert string back to UDPAddr (cached or parsed)
-		addr, _ := net.ResolveUDPAddr("udp", peer.RealAddr)
+		addr, _ := net.ResolveUDPAddr("udp", ep.addr)
 		return addr
 	}
+
+	// Longest prefix match over advertised subnets
+	if ip := net.ParseIP(dstIP); ip != nil {
+		for _, subnet := range t.subnets {
+			if subnet.Prefix.Contains(ip) {
+				if ep, alive := t.aliveLocked(subnet.Identity); alive {
+					addr, _ := net.ResolveUDPAddr("udp", ep.addr)
+					return addr
+				}
+			}
+		}
+	}
 	return nil
 }
 
-// RecordRx increments the Received Bytes counter for a peer
+// Owner returns the identity a Virtual IP, or an address inside an
+// advertised subnet, belongs to (live or not)
+func (t *Table) Owner(ip string) (string, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	if peer, ok := t.routes[ip]; ok {
+		return peer.Identity, true
+	}
+	if addr := net.ParseIP(ip); addr != nil {
+		for _, subnet := range t.subnets {
+			if subnet.Prefix.Contains(addr) {
+				return subnet.Identity, true
+			}
+		}
+	}
+	return "", false
+}
+
+// RecordRx counts a packet of the given size received from a peer
 func (t *Table) RecordRx(virtualIP string, bytes int) {
 	t.Lock()
 	defer t.Unlock()
 	if peer, ok := t.routes[virtualIP]; ok {
 		peer.RxBytes += uint64(bytes)
+		peer.RxPackets++
 	}
 }
 
-// RecordTx increments the Transmitted Bytes counter for a peer
+// RecordSubnetRx records a packet from a host on a LAN advertised by
+// identity, received from realAddr. LAN hosts are not peers of their own:
+// the packet keeps the owner alive and counts toward its Virtual IP.
+func (t *Table) RecordSubnetRx(identity string, realAddr *net.UDPAddr, bytes int) {
+	t.Lock()
+	defer t.Unlock()
+	t.touchLocked(identity, realAddr.String(), time.Now())
+	if peer, ok := t.routes[t.endpoints[identity].virtualIP]; ok && peer.Identity == identity {
+		peer.RxBytes += uint64(bytes)
+		peer.RxPackets++
+	}
+}
+
+// Advertises tells whether ip is on a LAN advertised by identity
+func (t *Table) Advertises(identity string, ip net.IP) bool {
+	t.RLock()
+	defer t.RUnlock()
+	for _, subnet := range t.subnets {
+		if subnet.Identity == identity && subnet.Prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordTx counts a packet of the given size sent to a peer
 func (t *Table) RecordTx(virtualIP string, bytes int) {
 	t.Lock()
 	defer t.Unlock()
 	if peer, ok := t.routes[virtualIP]; ok {
 		peer.TxBytes += uint64(bytes)
+		peer.TxPackets++
 	}
 }
 
@@ -86,46 +267,182 @@ func (t *Table) Snapshot() []PeerStats {
 	t.RLock()
 	defer t.RUnlock()
 
+	now := time.Now()
 	peers := make([]PeerStats, 0, len(t.routes))
 	for _, p := range t.routes {
 		// Return a copy, not a pointer, to prevent race conditions in UI rendering
-		peers = append(peers, *p)
+		peer := *p
+		peer.LastSeen = t.lastSeenLocked(p)
+		if ep, ok := t.endpoints[p.Identity]; ok {
+			peer.RealAddr = ep.addr
+		}
+		peer.Exit = t.exitForLocked(p.Identity, now)
+		peers = append(peers, peer)
 	}
 	return peers
 }
 
-// SetExitNode defines which Virtual IP acts as the default gateway for internet traffic
-func (t *Table) SetExitNode(virtualIP string) {
-    t.Lock()
-    defer t.Unlock()
-    t.exitNodeIP = virtualIP
-    log.Printf("[ROUTER] Exit Node set to: %s", virtualIP)
+// GetRoute decides where to send a packet from the src identity ("" for
+// the Hub itself) based on its Destination IP.
+// This implements the core "Split Tunneling" vs "Full Tunneling" logic support.
+// Internet traffic sent to an Agent exit opens the return path of its replies.
+func (t *Table) GetRoute(src, dstIP string) (*net.UDPAddr, bool) {
+	now := time.Now()
+	t.RLock()
+	addr, exit := t.routeLocked(src, dstIP, now)
+	// The write lock is only needed to open or refresh the return path
+	stale := exit != "" && now.Sub(t.returns[src][exit]) > returnRefresh
+	t.RUnlock()
+
+	if stale {
+		t.Lock()
+		t.useExitLocked(src, exit, now)
+		t.Unlock()
+	}
+	return addr, addr != nil
+}
+
+// routeLocked returns the address for a packet, and the Exit Node it goes
+// through if it is Internet traffic sent to an Agent exit
+func (t *Table) routeLocked(src, dstIP string, now time.Time) (*net.UDPAddr, string) {
+	// 1. Direct Peer or Subnet Match (VPN Mesh Traffic)
+	// Example: 10.0.0.2 talking to 10.0.0.3, or to 192.168.50.10 behind it
+	if addr := t.lookupLocked(dstIP); addr != nil {
+		return addr, ""
+	}
+	if _, known := t.routes[dstIP]; known {
+		return nil, "" // Expired peer: not Internet traffic either
+	}
+
+	// 2. Default Route (Internet Traffic via the Exit Node of the sender)
+	// If destination is NOT a peer (e.g. 8.8.8.8), and a healthy Exit Node is
+	// available, we look up the Real Address of the Exit Node itself.
+	// The Hub handles its own exit: no address to send to.
+	exit := t.exitForLocked(src, now)
+	if exit == "" || t.local[exit] {
+		return nil, ""
+	}
+	if ep, alive := t.aliveLocked(t.exitOwnerLocked(t.exitByIP(exit))); alive {
+		addr, _ := net.ResolveUDPAddr("udp", ep.addr)
+		return addr, exit
+	}
+
+	// 3. No Route Found (Drop packet)
+	return nil, ""
 }
 
-// GetRoute decides where to send the packet based on Destination IP.
-// This implements the core "Split Tunneling" vs "Full Tunneling" logic support.
-func (t *Table) GetRoute(dstIP string) (*net.UDPAddr, bool) {
-    t.RLock()
-    defer t.RUnlock()
-
-    // 1. Direct Peer Match (VPN Mesh Traffic)
-    // Example: 10.0.0.2 talking to 10.0.0.3
-    if peer, ok := t.routes[dstIP]; ok {
-        // Resolve stored address string back to UDPAddr
-        addr, _ := net.ResolveUDPAddr("udp", peer.RealAddr)
-        return addr, true
-    }
-
-    // 2. Default Route (Internet Traffic via Exit Node)
-    // If destination is NOT a peer (e.g. 8.8.8.8), and we have an Exit Node configured...
-    if t.exitNodeIP != "" {
-        // We look up the Real Address of the Exit Node itself
-        if exitPeer, ok := t.routes[t.exitNodeIP]; ok {
-            addr, _ := net.ResolveUDPAddr("udp", exitPeer.RealAddr)
-            return addr, true
-        }
-    }
-
-    // 3. No Route Found (Drop packet)
-    return nil, false
-}
\ No newline at end of file
+// Forget drops every route, subnet and endpoint of an identity (e.g. when
+// its key is no longer authorized). It returns true if the mesh-wide set of
+// subnets changed.
+func (t *Table) Forget(identity string) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	for ip, peer := range t.routes {
+		if peer.Identity == identity {
+			delete(t.routes, ip)
+		}
+	}
+	delete(t.endpoints, identity)
+	delete(t.requested, identity)
+	delete(t.offers, identity)
+	delete(t.returns, identity)
+
+	var kept []Subnet
+	for _, s := range t.subnets {
+		if s.Identity != identity {
+			kept = append(kept, s)
+		}
+	}
+	changed := len(kept) != len(t.subnets)
+	t.subnets = kept
+	return changed
+}
+
+// Prune drops the routes and subnets an identity may no longer use, e.g.
+// after a reload narrowed its allowed IPs. allowed tells whether identity
+// may use the whole prefix (a single address for a route). It returns true
+// if the mesh-wide set of subnets changed.
+func (t *Table) Prune(allowed func(identity string, prefix *net.IPNet) bool) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	for ip, peer := range t.routes {
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			continue
+		}
+		if v4 := addr.To4(); v4 != nil {
+			addr = v4
+		}
+		bits := len(addr) * 8
+		if !allowed(peer.Identity, &net.IPNet{IP: addr, Mask: net.CIDRMask(bits, bits)}) {
+			delete(t.routes, ip)
+			log.Printf("[ROUTE] Forgot %s: no longer in the allowed IPs of its peer", ip)
+		}
+	}
+
+	var kept []Subnet
+	for _, s := range t.subnets {
+		if allowed(s.Identity, s.Prefix) {
+			kept = append(kept, s)
+		} else {
+			log.Printf("[ROUTE] Withdrawing subnet %s: no longer in the allowed IPs of its peer", s.Prefix)
+		}
+	}
+	changed := len(kept) != len(t.subnets)
+	t.subnets = kept
+	return changed
+}
+
+// Reap refreshes the state of every entry and garbage collects peers that
+// have been silent for too long: expired entries are forgotten after twice
+// the dead threshold, together with the subnets of their owner.
+// It returns true if the mesh-wide set of subnets changed.
+func (t *Table) Reap() bool {
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+
+	for ip, peer := range t.routes {
+		silent := now.Sub(t.lastSeenLocked(peer))
+		switch {
+		case silent > 2*t.deadAfter:
+			delete(t.routes, ip)
+			log.Printf("[ROUTE] Forgot %s (silent for %s)", ip, silent.Round(time.Second))
+		case silent > t.deadAfter:
+			if peer.State != StateExpired {
+				log.Printf("[ROUTE] Peer %s expired (silent for %s), no longer routed", ip, silent.Round(time.Second))
+			}
+			peer.State = StateExpired
+		case silent > t.idleAfter:
+			peer.State = StateIdle
+		default:
+			peer.State = StateActive
+		}
+	}
+
+	t.checkExitsLocked(now)
+	t.expireReturnsLocked(now)
+
+	changed := false
+	for identity, ep := range t.endpoints {
+		if now.Sub(ep.lastSeen) <= 2*t.deadAfter {
+			continue
+		}
+		delete(t.endpoints, identity)
+		var kept []Subnet
+		for _, s := range t.subnets {
+			if s.Identity != identity {
+				kept = append(kept, s)
+			} else {
+				log.Printf("[ROUTE] Withdrawing subnet %s of silent peer %s", s.Prefix, identity)
+			}
+		}
+		if len(kept) != len(t.subnets) {
+			changed = true
+		}
+		t.subnets = kept
+	}
+	return changed
+}
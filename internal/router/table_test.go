@@ -0,0 +1,250 @@
+package router
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func mustPrefix(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prefix
+}
+
+func mustAddr(t *testing.T, s string) *net.UDPAddr {
+	t.Helper()
+	addr, err := net.ResolveUDPAddr("udp", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+// The peers of the lookup tests, each advertising one subnet
+var lookupPeers = []struct {
+	identity, addr, subnet string
+}{
+	{"wide", "192.0.2.1:5000", "10.0.0.0/8"},
+	{"site", "192.0.2.2:5000", "10.1.0.0/16"},
+	{"lab", "192.0.2.3:5000", "10.1.2.0/24"},
+	{"host", "192.0.2.4:5000", "10.1.2.3/32"},
+	{"v6", "192.0.2.5:5000", "fd00:1::/32"},
+	{"v6lab", "192.0.2.6:5000", "fd00:1:2::/48"},
+}
+
+func TestLookupLongestPrefix(t *testing.T) {
+	tests := []struct {
+		dst  string
+		want string // Identity expected to get the packet, "" for none
+	}{
+		{"10.1.2.3", "host"},
+		{"10.1.2.4", "lab"},
+		{"10.1.3.1", "site"},
+		{"10.2.0.1", "wide"},
+		{"11.0.0.1", ""},
+		{"fd00:1:2::1", "v6lab"},
+		{"fd00:1:3::1", "v6"},
+		{"fd00:2::1", ""},
+		{"not-an-ip", ""},
+	}
+
+	// The match must not depend on the order the subnets were advertised in
+	orders := map[string][]int{
+		"shortest first": {0, 1, 2, 3, 4, 5},
+		"longest first":  {5, 4, 3, 2, 1, 0},
+		"mixed":          {2, 0, 5, 3, 1, 4},
+	}
+	for name, order := range orders {
+		t.Run(name, func(t *testing.T) {
+			table := NewTable()
+			addrs := make(map[string]string)
+			for _, i := range order {
+				p := lookupPeers[i]
+				table.SetSubnets(p.identity, mustAddr(t, p.addr), []*net.IPNet{mustPrefix(t, p.subnet)})
+				addrs[p.identity] = p.addr
+			}
+			for _, tt := range tests {
+				got := table.Lookup(tt.dst)
+				if tt.want == "" {
+					if got != nil {
+						t.Errorf("Lookup(%s) = %s, want no route", tt.dst, got)
+					}
+					continue
+				}
+				if got == nil || got.String() != addrs[tt.want] {
+					t.Errorf("Lookup(%s) = %v, want %s (%s)", tt.dst, got, addrs[tt.want], tt.want)
+				}
+				if owner, _ := table.Owner(tt.dst); owner != tt.want {
+					t.Errorf("Owner(%s) = %q, want %q", tt.dst, owner, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLookupVirtualIPBeforeSubnets(t *testing.T) {
+	table := NewTable()
+	table.SetSubnets("lan", mustAddr(t, "192.0.2.1:5000"), []*net.IPNet{mustPrefix(t, "10.0.0.0/24")})
+	table.Learn("10.0.0.7", "agent", mustAddr(t, "192.0.2.2:5000"))
+
+	if got := table.Lookup("10.0.0.7"); got == nil || got.String() != "192.0.2.2:5000" {
+		t.Fatalf("Lookup(10.0.0.7) = %v, want the Agent owning the Virtual IP", got)
+	}
+	if got := table.Lookup("10.0.0.8"); got == nil || got.String() != "192.0.2.1:5000" {
+		t.Fatalf("Lookup(10.0.0.8) = %v, want the subnet router", got)
+	}
+}
+
+func TestLookupSkipsExpiredSubnets(t *testing.T) {
+	table := NewTable()
+	table.SetThresholds(time.Second, 2*time.Second)
+	table.SetSubnets("wide", mustAddr(t, "192.0.2.1:5000"), []*net.IPNet{mustPrefix(t, "10.0.0.0/8")})
+	table.SetSubnets("lab", mustAddr(t, "192.0.2.2:5000"), []*net.IPNet{mustPrefix(t, "10.1.2.0/24")})
+
+	// The more specific route goes silent: the less specific one takes over
+	table.Lock()
+	table.endpoints["lab"].lastSeen = time.Now().Add(-time.Minute)
+	table.Unlock()
+
+	if got := table.Lookup("10.1.2.3"); got == nil || got.String() != "192.0.2.1:5000" {
+		t.Fatalf("Lookup(10.1.2.3) = %v, want the live /8", got)
+	}
+	if owner, _ := table.Owner("10.1.2.3"); owner != "lab" {
+		t.Fatalf("Owner(10.1.2.3) = %q, want lab (live or not)", owner)
+	}
+}
+
+func TestSetSubnetsReplaces(t *testing.T) {
+	table := NewTable()
+	addr := mustAddr(t, "192.0.2.1:5000")
+	if !table.SetSubnets("lab", addr, []*net.IPNet{mustPrefix(t, "10.1.0.0/16")}) {
+		t.Fatal("first advertisement reported no change")
+	}
+	if table.SetSubnets("lab", addr, []*net.IPNet{mustPrefix(t, "10.1.0.0/16")}) {
+		t.Fatal("same advertisement reported a change")
+	}
+	if !table.SetSubnets("lab", addr, []*net.IPNet{mustPrefix(t, "10.2.0.0/16")}) {
+		t.Fatal("new advertisement reported no change")
+	}
+	if got := table.Lookup("10.1.0.1"); got != nil {
+		t.Fatalf("withdrawn subnet still routed to %s", got)
+	}
+	if got := table.Lookup("10.2.0.1"); got == nil {
+		t.Fatal("new subnet not routed")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	table := NewTable()
+	table.Learn("10.0.0.2", "a", mustAddr(t, "192.0.2.1:5000"))
+	table.Learn("10.0.0.3", "b", mustAddr(t, "192.0.2.2:5000"))
+	table.SetSubnets("a", nil, []*net.IPNet{mustPrefix(t, "192.168.1.0/24"), mustPrefix(t, "192.168.2.0/24")})
+
+	// a keeps its address and its first LAN only; b lost everything
+	allowed := map[string][]*net.IPNet{
+		"a": {mustPrefix(t, "10.0.0.2/32"), mustPrefix(t, "192.168.1.0/24")},
+	}
+	covered := func(identity string, prefix *net.IPNet) bool {
+		for _, p := range allowed[identity] {
+			ones, _ := prefix.Mask.Size()
+			allowedOnes, _ := p.Mask.Size()
+			if p.Contains(prefix.IP) && allowedOnes <= ones {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !table.Prune(covered) {
+		t.Fatal("Prune reported no subnet change")
+	}
+	if owner, ok := table.Owner("10.0.0.2"); !ok || owner != "a" {
+		t.Fatalf("Owner(10.0.0.2) = %q, %v; want a", owner, ok)
+	}
+	if _, ok := table.Owner("10.0.0.3"); ok {
+		t.Fatal("the route of b survived")
+	}
+	if _, ok := table.Owner("192.168.1.1"); !ok {
+		t.Fatal("the allowed subnet was withdrawn")
+	}
+	if _, ok := table.Owner("192.168.2.1"); ok {
+		t.Fatal("the subnet no longer allowed is still advertised")
+	}
+	if table.Prune(covered) {
+		t.Fatal("a second Prune reported a change")
+	}
+}
+
+func TestGetRouteOpensReturnPath(t *testing.T) {
+	table := NewTable()
+	table.SetExitNodes([]Exit{{IP: "10.0.0.3", Identity: "exit"}})
+	table.OfferExit("exit", true)
+	table.Learn("10.0.0.3", "exit", mustAddr(t, "192.0.2.3:5000"))
+	table.Learn("10.0.0.2", "client", mustAddr(t, "192.0.2.2:5000"))
+
+	if _, ok := table.ReturnPath("exit", "client"); ok {
+		t.Fatal("return path open before any Internet traffic")
+	}
+	addr, ok := table.GetRoute("client", "198.51.100.1")
+	if !ok || addr.String() != "192.0.2.3:5000" {
+		t.Fatalf("GetRoute = %v, %v; want the exit Agent", addr, ok)
+	}
+	if ip, ok := table.ReturnPath("exit", "client"); !ok || ip != "10.0.0.3" {
+		t.Fatalf("ReturnPath = %q, %v; want 10.0.0.3", ip, ok)
+	}
+
+	// Mesh traffic does not touch the return paths
+	table.Lock()
+	delete(table.returns, "client")
+	table.Unlock()
+	if addr, ok := table.GetRoute("client", "10.0.0.3"); !ok || addr.String() != "192.0.2.3:5000" {
+		t.Fatalf("GetRoute(10.0.0.3) = %v, %v", addr, ok)
+	}
+	if _, ok := table.ReturnPath("exit", "client"); ok {
+		t.Fatal("mesh traffic opened a return path")
+	}
+}
+
+func TestRecordSubnetRx(t *testing.T) {
+	table := NewTable()
+	addr := mustAddr(t, "192.0.2.1:5000")
+	table.Learn("10.0.0.2", "router", addr)
+	table.SetSubnets("router", addr, []*net.IPNet{mustPrefix(t, "192.168.50.0/24")})
+
+	host := net.ParseIP("192.168.50.7")
+	if !table.Advertises("router", host) || table.Advertises("other", host) {
+		t.Fatal("Advertises does not follow the advertised subnets")
+	}
+	if table.Advertises("router", net.ParseIP("10.0.0.2")) {
+		t.Fatal("a Virtual IP counted as a LAN host")
+	}
+
+	table.RecordSubnetRx("router", mustAddr(t, "192.0.2.9:5000"), 100)
+	snapshot := table.Snapshot()
+	if len(snapshot) != 1 {
+		t.Fatalf("LAN host became a peer: %+v", snapshot)
+	}
+	if p := snapshot[0]; p.VirtualIP != "10.0.0.2" || p.RxBytes != 100 || p.RxPackets != 1 {
+		t.Fatalf("router = %+v, want 100 bytes on 10.0.0.2", p)
+	}
+	// The owner follows its new endpoint
+	if got := table.Lookup("192.168.50.7"); got == nil || got.String() != "192.0.2.9:5000" {
+		t.Fatalf("Lookup(192.168.50.7) = %v, want the new endpoint", got)
+	}
+}
+
+func TestExitForHub(t *testing.T) {
+	table := NewTable()
+	if exit, ok := table.ExitFor("client"); ok {
+		t.Fatalf("ExitFor = %q without Exit Nodes", exit)
+	}
+	table.SetLocal("10.0.0.1", "")
+	table.SetExitNodes([]Exit{{IP: "10.0.0.1"}})
+	if exit, ok := table.ExitFor("client"); !ok || exit != "10.0.0.1" {
+		t.Fatalf("ExitFor = %q, %v; want the Hub's 10.0.0.1", exit, ok)
+	}
+}
@@ -2,56 +2,133 @@ package security
 
 import (
 	"crypto/cipher"
-	"crypto/rand"
-	"crypto/sha256"
+	"encoding/binary"
 	"errors"
-	"io"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
-type Manager struct {
-	aead cipher.AEAD
+// Session holds the transport keys derived from a completed handshake.
+// Each direction uses its own key, so a peer can never decrypt traffic
+// that was not addressed to it.
+type Session struct {
+	Remote  PublicKey
+	Created time.Time
+	Epoch   uint64 // Set by the Keyring; increases with every handshake
+
+	// Session indexes carried in the protocol header: the peer addresses
+	// packets to LocalIndex, we address ours to RemoteIndex.
+	LocalIndex  uint32
+	RemoteIndex uint32
+	send        cipher.AEAD
+	recv        cipher.AEAD
+
+	sendCounter atomic.Uint64
+	replay      replayFilter
+
+	// Drop counters for the data path
+	replayed atomic.Uint64
+	tooOld   atomic.Uint64
 }
 
-// New creates a new security manager with the hashed secret
-func New(secret string) (*Manager, error) {
-	key := sha256.Sum256([]byte(secret))
-	aead, err := chacha20poly1305.New(key[:])
+const (
+	// counterSize is the length of the per-packet counter on the wire.
+	counterSize = 8
+	// RejectAfterMessages is the absolute nonce limit of a single key,
+	// whatever the configured Limits say.
+	RejectAfterMessages = ^uint64(0) - (1 << 13)
+)
+
+var ErrPacketTooShort = errors.New("packet too short")
+
+func newSession(remote PublicKey, sendKey, recvKey [chacha20poly1305.KeySize]byte) (*Session, error) {
+	send, err := chacha20poly1305.New(sendKey[:])
+	if err != nil {
+		return nil, err
+	}
+	recv, err := chacha20poly1305.New(recvKey[:])
 	if err != nil {
 		return nil, err
 	}
-	return &Manager{aead: aead}, nil
+	return &Session{
+		Remote:  remote,
+		Created: time.Now(),
+		send:    send,
+		recv:    recv,
+	}, nil
 }
 
-// Encrypt generates a nonce, encrypts data, and prepends the nonce
-func (m *Manager) Encrypt(plaintext []byte) ([]byte, error) {
-	nonce := make([]byte, m.aead.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, err
+// PackAndEncrypt appends [counter][ciphertext] to header.
+// The counter is the AEAD nonce, so it must never repeat for a key;
+// the header is authenticated as additional data.
+func (s *Session) PackAndEncrypt(header, plaintext []byte) ([]byte, error) {
+	counter := s.sendCounter.Add(1) - 1
+	if counter >= RejectAfterMessages {
+		return nil, ErrNoSession
 	}
-	return m.aead.Seal(nil, nonce, plaintext, nil), nil
+
+	hdrLen := len(header)
+	out := make([]byte, hdrLen+counterSize, hdrLen+counterSize+len(plaintext)+s.send.Overhead())
+	copy(out, header)
+	binary.LittleEndian.PutUint64(out[hdrLen:], counter)
+
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+
+	// Seal appends encrypted data after the counter
+	return s.send.Seal(out, nonce[:], plaintext, out[:hdrLen]), nil
 }
 
-// PackAndEncrypt combines nonce generation and appending into one step for transmission
-func (m *Manager) PackAndEncrypt(plaintext []byte) ([]byte, error) {
-	nonce := make([]byte, m.aead.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+// DecryptUnpack decrypts a transport body ([counter][ciphertext]) and rejects
+// packets whose counter was already seen or fell behind the replay window.
+func (s *Session) DecryptUnpack(header, body []byte) ([]byte, error) {
+	if len(body) < counterSize+s.recv.Overhead() {
+		return nil, ErrPacketTooShort
+	}
+
+	counter := binary.LittleEndian.Uint64(body[:counterSize])
+
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+	plaintext, err := s.recv.Open(nil, nonce[:], body[counterSize:], header)
+	if err != nil {
 		return nil, err
 	}
-	// Seal appends encrypted data to the nonce slice
-	return m.aead.Seal(nonce, nonce, plaintext, nil), nil
-}
 
-// DecryptUnpack extracts the nonce and decrypts the payload
-func (m *Manager) DecryptUnpack(packet []byte) ([]byte, error) {
-	nonceSize := m.aead.NonceSize()
-	if len(packet) < nonceSize {
-		return nil, errors.New("packet too short")
+	// Only authenticated packets may move the window or count as replays
+	if err := s.replay.accept(counter); err != nil {
+		s.countDrop(err)
+		return nil, err
 	}
+	return plaintext, nil
+}
 
-	nonce := packet[:nonceSize]
-	ciphertext := packet[nonceSize:]
+// NeedsRekey reports whether the session reached the rekey thresholds,
+// counting both the packets we sent and the highest counter we received.
+func (s *Session) NeedsRekey(l Limits) bool {
+	return time.Since(s.Created) >= l.RekeyAfterTime ||
+		s.sendCounter.Load() >= l.RekeyAfterMessages ||
+		s.replay.highest() >= l.RekeyAfterMessages
+}
 
-	return m.aead.Open(nil, nonce, ciphertext, nil)
-}
\ No newline at end of file
+// Expired reports whether the session must no longer be used at all.
+func (s *Session) Expired(l Limits) bool {
+	return time.Since(s.Created) >= l.RejectAfterTime ||
+		s.sendCounter.Load() >= l.RejectAfterMessages ||
+		s.replay.highest() >= l.RejectAfterMessages
+}
+
+// Drops returns how many packets were rejected as replays or as too old.
+func (s *Session) Drops() (replayed, tooOld uint64) {
+	return s.replayed.Load(), s.tooOld.Load()
+}
+
+func (s *Session) countDrop(err error) {
+	if errors.Is(err, ErrReplayed) {
+		s.replayed.Add(1)
+	} else if errors.Is(err, ErrTooOld) {
+		s.tooOld.Add(1)
+	}
+}
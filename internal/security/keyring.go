@@ -0,0 +1,186 @@
+package security
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Limits controls when a session must be replaced by a fresh handshake.
+// The initiator rekeys once RekeyAfter* is reached; both sides refuse to
+// use a session past RejectAfter*, which bounds how much data a single
+// key ever protects.
+type Limits struct {
+	RekeyAfterTime      time.Duration
+	RekeyAfterMessages  uint64
+	RejectAfterTime     time.Duration
+	RejectAfterMessages uint64
+}
+
+// DefaultLimits mirrors the WireGuard timers.
+func DefaultLimits() Limits {
+	return NewLimits(2*time.Minute, 1<<60)
+}
+
+// NewLimits derives the hard reject limits from the rekey thresholds,
+// leaving the initiator enough margin to finish a handshake in time.
+func NewLimits(rekeyTime time.Duration, rekeyMessages uint64) Limits {
+	rejectMessages := rekeyMessages + rekeyMessages/2
+	if rejectMessages < rekeyMessages || rejectMessages > RejectAfterMessages {
+		rejectMessages = RejectAfterMessages
+	}
+	return Limits{
+		RekeyAfterTime:      rekeyTime,
+		RekeyAfterMessages:  rekeyMessages,
+		RejectAfterTime:     rekeyTime + rekeyTime/2,
+		RejectAfterMessages: rejectMessages,
+	}
+}
+
+var ErrNoSession = errors.New("no valid session")
+
+// Keyring holds the sessions of one peer during a key rotation:
+//
+//   - current:  used for sending
+//   - next:     established by the responder, promoted once the initiator
+//     proves it has the keys by sending data with them
+//   - previous: kept to decrypt packets that were in flight during the switch
+type Keyring struct {
+	sync.RWMutex
+	current  *Session
+	previous *Session
+	next     *Session
+	epoch    uint64
+	limits   Limits
+}
+
+// NewKeyring creates an empty keyring enforcing the given limits.
+func NewKeyring(limits Limits) *Keyring {
+	return &Keyring{limits: limits}
+}
+
+// Install adds a freshly derived session. The initiator already knows the
+// responder has the keys and installs it as current (confirmed=true); the
+// responder waits for the first packet before switching.
+// It returns the sessions that were dropped, so their indexes can be freed.
+func (k *Keyring) Install(s *Session, confirmed bool) []*Session {
+	k.Lock()
+	defer k.Unlock()
+
+	k.epoch++
+	s.Epoch = k.epoch
+	var dropped []*Session
+	if confirmed || k.current == nil {
+		dropped = appendSession(dropped, k.previous, k.next)
+		k.previous = k.current
+		k.current = s
+		k.next = nil
+		return dropped
+	}
+	dropped = appendSession(dropped, k.next)
+	k.next = s
+	return dropped
+}
+
+// Clear drops every session, forcing a new handshake.
+func (k *Keyring) Clear() {
+	k.Lock()
+	defer k.Unlock()
+	k.current, k.next, k.previous = nil, nil, nil
+}
+
+// Sessions returns every session held by the keyring.
+func (k *Keyring) Sessions() []*Session {
+	k.RLock()
+	defer k.RUnlock()
+	return appendSession(nil, k.current, k.next, k.previous)
+}
+
+func appendSession(list []*Session, sessions ...*Session) []*Session {
+	for _, s := range sessions {
+		if s != nil {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// Current returns the session to encrypt with, or nil if it expired.
+func (k *Keyring) Current() *Session {
+	k.RLock()
+	defer k.RUnlock()
+	if k.current == nil || k.current.Expired(k.limits) {
+		return nil
+	}
+	return k.current
+}
+
+// NeedsRekey reports whether the initiator should start a new handshake.
+func (k *Keyring) NeedsRekey() bool {
+	k.RLock()
+	defer k.RUnlock()
+	return k.current == nil || k.current.NeedsRekey(k.limits)
+}
+
+// Owns reports whether one of the sessions uses the given local index.
+func (k *Keyring) Owns(index uint32) bool {
+	k.RLock()
+	defer k.RUnlock()
+	for _, s := range [3]*Session{k.current, k.next, k.previous} {
+		if s != nil && s.LocalIndex == index {
+			return true
+		}
+	}
+	return false
+}
+
+// Decrypt authenticates a transport packet addressed to the session with
+// the given local index. A packet authenticated by the next session
+// confirms the rotation.
+func (k *Keyring) Decrypt(index uint32, header, body []byte) ([]byte, *Session, error) {
+	plaintext, session, _, err := k.decrypt(index, header, body)
+	return plaintext, session, err
+}
+
+// decrypt is Decrypt, also returning the previous session a confirmed
+// rotation evicted (nil if none), so its index can be freed.
+func (k *Keyring) decrypt(index uint32, header, body []byte) ([]byte, *Session, *Session, error) {
+	k.RLock()
+	var session *Session
+	for _, s := range [3]*Session{k.current, k.next, k.previous} {
+		if s != nil && s.LocalIndex == index {
+			session = s
+			break
+		}
+	}
+	isNext := session != nil && session == k.next
+	k.RUnlock()
+
+	if session == nil || session.Expired(k.limits) {
+		return nil, nil, nil, ErrNoSession
+	}
+	plaintext, err := session.DecryptUnpack(header, body)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var evicted *Session
+	if isNext {
+		evicted = k.promote(session)
+	}
+	return plaintext, session, evicted, nil
+}
+
+// promote makes s, the next session, current. It returns the previous
+// session it drops.
+func (k *Keyring) promote(s *Session) *Session {
+	k.Lock()
+	defer k.Unlock()
+	if k.next != s {
+		return nil
+	}
+	evicted := k.previous
+	k.previous = k.current
+	k.current = s
+	k.next = nil
+	return evicted
+}
@@ -0,0 +1,133 @@
+package security
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// KeySize is the length in bytes of a Curve25519 key.
+const KeySize = 32
+
+// PrivateKey is a Curve25519 static or ephemeral secret.
+type PrivateKey [KeySize]byte
+
+// PublicKey is a Curve25519 public key. It doubles as the peer identity.
+type PublicKey [KeySize]byte
+
+// GeneratePrivateKey creates a new clamped Curve25519 private key.
+func GeneratePrivateKey() (PrivateKey, error) {
+	var k PrivateKey
+	if _, err := rand.Read(k[:]); err != nil {
+		return k, err
+	}
+	// Clamping as described in RFC 7748
+	k[0] &= 248
+	k[31] = (k[31] & 127) | 64
+	return k, nil
+}
+
+// PublicKey derives the public half of the key pair.
+func (k PrivateKey) PublicKey() PublicKey {
+	var pub PublicKey
+	out, _ := curve25519.X25519(k[:], curve25519.Basepoint)
+	copy(pub[:], out)
+	return pub
+}
+
+// String encodes the private key as standard base64.
+func (k PrivateKey) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// String encodes the public key as standard base64 (WireGuard style).
+func (k PublicKey) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// IsZero reports whether the key is unset.
+func (k PublicKey) IsZero() bool {
+	return k == PublicKey{}
+}
+
+// ParsePublicKey decodes a base64 encoded public key.
+func ParsePublicKey(s string) (PublicKey, error) {
+	var k PublicKey
+	if err := decodeKey(s, k[:]); err != nil {
+		return k, err
+	}
+	return k, nil
+}
+
+// ParsePrivateKey decodes a base64 encoded private key.
+func ParsePrivateKey(s string) (PrivateKey, error) {
+	var k PrivateKey
+	if err := decodeKey(s, k[:]); err != nil {
+		return k, err
+	}
+	return k, nil
+}
+
+func decodeKey(s string, dst []byte) error {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return fmt.Errorf("invalid key encoding: %w", err)
+	}
+	if len(raw) != KeySize {
+		return fmt.Errorf("invalid key length %d, expected %d", len(raw), KeySize)
+	}
+	copy(dst, raw)
+	return nil
+}
+
+// LoadOrCreatePrivateKey reads a base64 private key from path.
+// If the file does not exist a new key is generated and stored with 0600 permissions,
+// so first-time deployments only need to copy the printed public key to the Hub.
+func LoadOrCreatePrivateKey(path string) (PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return ParsePrivateKey(string(data))
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return PrivateKey{}, err
+	}
+
+	key, err := GeneratePrivateKey()
+	if err != nil {
+		return PrivateKey{}, err
+	}
+	if err := os.WriteFile(path, []byte(key.String()+"\n"), 0600); err != nil {
+		return PrivateKey{}, fmt.Errorf("failed to store new key: %w", err)
+	}
+	log.Printf("[SEC] Generated new private key at %s", path)
+	return key, nil
+}
+
+// RandomIndex returns a random non-zero session index.
+func RandomIndex() uint32 {
+	var b [4]byte
+	for {
+		rand.Read(b[:])
+		if index := binary.LittleEndian.Uint32(b[:]); index != 0 {
+			return index
+		}
+	}
+}
+
+// sharedSecret performs the X25519 Diffie-Hellman operation.
+func sharedSecret(priv PrivateKey, pub PublicKey) ([KeySize]byte, error) {
+	var out [KeySize]byte
+	ss, err := curve25519.X25519(priv[:], pub[:])
+	if err != nil {
+		return out, err
+	}
+	copy(out[:], ss)
+	return out, nil
+}
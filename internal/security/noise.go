@@ -0,0 +1,339 @@
+package security
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Noise IK handshake (Noise_IK_25519_ChaChaPoly_BLAKE2s).
+//
+// The Agent (initiator) already knows the Hub's static public key. The first
+// message carries the Agent's static key encrypted to the Hub, so the Hub learns
+// who is connecting before it answers. Two messages later both sides share a
+// pair of transport keys that only these two parties can derive.
+//
+//	-> e, es, s, ss, {timestamp || payload}
+//	<- e, ee, se, {payload}
+//
+// The cleartext framing of each message (see internal/protocol) is passed as
+// prologue and mixed into the handshake hash, which authenticates it.
+const (
+	noiseConstruction = "Noise_IK_25519_ChaChaPoly_BLAKE2s"
+	noiseIdentifier   = "go-mesh-hub v1"
+)
+
+// TimestampSize is the length of the anti-replay timestamp in the initiation.
+const TimestampSize = 12
+
+const (
+	tagSize = chacha20poly1305.Overhead
+	// initiationMinSize: ephemeral + encrypted static + encrypted timestamp
+	initiationMinSize = KeySize + (KeySize + tagSize) + (TimestampSize + tagSize)
+	// responseMinSize: ephemeral + encrypted empty payload
+	responseMinSize = KeySize + tagSize
+)
+
+var (
+	ErrHandshakeFailed = errors.New("handshake failed")
+	ErrMessageTooShort = errors.New("message too short")
+)
+
+var (
+	initialChainKey [blake2s.Size]byte
+	initialHash     [blake2s.Size]byte
+)
+
+func init() {
+	initialChainKey = blake2s.Sum256([]byte(noiseConstruction))
+	initialHash = mixHash(initialChainKey, []byte(noiseIdentifier))
+}
+
+// Timestamp is a TAI64N-like monotonic marker used by the responder to reject
+// replayed initiation messages.
+type Timestamp [TimestampSize]byte
+
+// Now returns the current time encoded as a Timestamp.
+func Now() Timestamp {
+	var ts Timestamp
+	now := time.Now()
+	binary.BigEndian.PutUint64(ts[:8], uint64(now.Unix()))
+	binary.BigEndian.PutUint32(ts[8:], uint32(now.Nanosecond()))
+	return ts
+}
+
+// After reports whether ts is strictly newer than other.
+func (ts Timestamp) After(other Timestamp) bool {
+	return bytes.Compare(ts[:], other[:]) > 0
+}
+
+// Handshake holds the symmetric state of one Noise IK exchange.
+type Handshake struct {
+	local     PrivateKey
+	remote    PublicKey
+	ephemeral PrivateKey
+	remoteEph PublicKey
+	chainKey  [blake2s.Size]byte
+	hash      [blake2s.Size]byte
+}
+
+// Remote returns the static public key of the other party.
+func (hs *Handshake) Remote() PublicKey {
+	return hs.remote
+}
+
+// NewInitiator prepares a handshake towards a responder whose static key is known.
+func NewInitiator(local PrivateKey, remote PublicKey) *Handshake {
+	hs := &Handshake{
+		local:    local,
+		remote:   remote,
+		chainKey: initialChainKey,
+	}
+	hs.hash = mixHash(initialHash, remote[:])
+	return hs
+}
+
+// CreateInitiation builds the first handshake message and appends it to prologue.
+func (hs *Handshake) CreateInitiation(prologue, payload []byte) ([]byte, error) {
+	eph, err := GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	hs.ephemeral = eph
+	ephPub := eph.PublicKey()
+
+	hs.hash = mixHash(hs.hash, prologue)
+	msg := make([]byte, 0, len(prologue)+initiationMinSize+len(payload))
+	msg = append(msg, prologue...)
+	msg = append(msg, ephPub[:]...)
+	hs.hash = mixHash(hs.hash, ephPub[:])
+	hs.chainKey = kdf1(hs.chainKey, ephPub[:])
+
+	// es
+	ss, err := sharedSecret(eph, hs.remote)
+	if err != nil {
+		return nil, ErrHandshakeFailed
+	}
+	var key [chacha20poly1305.KeySize]byte
+	hs.chainKey, key = kdf2(hs.chainKey, ss[:])
+
+	// s
+	localPub := hs.local.PublicKey()
+	start := len(msg)
+	msg = seal(msg, key, localPub[:], hs.hash[:])
+	hs.hash = mixHash(hs.hash, msg[start:])
+
+	// ss
+	ss, err = sharedSecret(hs.local, hs.remote)
+	if err != nil {
+		return nil, ErrHandshakeFailed
+	}
+	hs.chainKey, key = kdf2(hs.chainKey, ss[:])
+
+	// {timestamp || payload}
+	ts := Now()
+	start = len(msg)
+	msg = seal(msg, key, append(ts[:], payload...), hs.hash[:])
+	hs.hash = mixHash(hs.hash, msg[start:])
+
+	return msg, nil
+}
+
+// ConsumeInitiation processes a handshake initiation on the responder side.
+// The caller must check that hs.Remote() is authorized and that the returned
+// timestamp is newer than the last one seen from that peer.
+func ConsumeInitiation(local PrivateKey, prologue, msg []byte) (*Handshake, Timestamp, []byte, error) {
+	var ts Timestamp
+	if len(msg) < initiationMinSize {
+		return nil, ts, nil, ErrMessageTooShort
+	}
+	localPub := local.PublicKey()
+	hs := &Handshake{
+		local:    local,
+		chainKey: initialChainKey,
+	}
+	hs.hash = mixHash(initialHash, localPub[:])
+	hs.hash = mixHash(hs.hash, prologue)
+
+	off := 0
+	copy(hs.remoteEph[:], msg[off:off+KeySize])
+	off += KeySize
+	hs.hash = mixHash(hs.hash, hs.remoteEph[:])
+	hs.chainKey = kdf1(hs.chainKey, hs.remoteEph[:])
+
+	// es
+	ss, err := sharedSecret(local, hs.remoteEph)
+	if err != nil {
+		return nil, ts, nil, ErrHandshakeFailed
+	}
+	var key [chacha20poly1305.KeySize]byte
+	hs.chainKey, key = kdf2(hs.chainKey, ss[:])
+
+	// s
+	encStatic := msg[off : off+KeySize+tagSize]
+	off += KeySize + tagSize
+	static, err := open(key, encStatic, hs.hash[:])
+	if err != nil {
+		return nil, ts, nil, ErrHandshakeFailed
+	}
+	copy(hs.remote[:], static)
+	hs.hash = mixHash(hs.hash, encStatic)
+
+	// ss
+	ss, err = sharedSecret(local, hs.remote)
+	if err != nil {
+		return nil, ts, nil, ErrHandshakeFailed
+	}
+	hs.chainKey, key = kdf2(hs.chainKey, ss[:])
+
+	// {timestamp || payload}
+	encPayload := msg[off:]
+	plain, err := open(key, encPayload, hs.hash[:])
+	if err != nil {
+		return nil, ts, nil, ErrHandshakeFailed
+	}
+	hs.hash = mixHash(hs.hash, encPayload)
+	copy(ts[:], plain[:TimestampSize])
+
+	return hs, ts, plain[TimestampSize:], nil
+}
+
+// CreateResponse builds the second handshake message, appends it to prologue
+// and derives the responder's transport session.
+func (hs *Handshake) CreateResponse(prologue, payload []byte) ([]byte, *Session, error) {
+	eph, err := GeneratePrivateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	hs.ephemeral = eph
+	ephPub := eph.PublicKey()
+
+	hs.hash = mixHash(hs.hash, prologue)
+	msg := make([]byte, 0, len(prologue)+responseMinSize+len(payload))
+	msg = append(msg, prologue...)
+	msg = append(msg, ephPub[:]...)
+	hs.hash = mixHash(hs.hash, ephPub[:])
+	hs.chainKey = kdf1(hs.chainKey, ephPub[:])
+
+	// ee
+	ss, err := sharedSecret(eph, hs.remoteEph)
+	if err != nil {
+		return nil, nil, ErrHandshakeFailed
+	}
+	hs.chainKey = kdf1(hs.chainKey, ss[:])
+
+	// se
+	ss, err = sharedSecret(eph, hs.remote)
+	if err != nil {
+		return nil, nil, ErrHandshakeFailed
+	}
+	var key [chacha20poly1305.KeySize]byte
+	hs.chainKey, key = kdf2(hs.chainKey, ss[:])
+
+	// {payload}
+	start := len(msg)
+	msg = seal(msg, key, payload, hs.hash[:])
+	hs.hash = mixHash(hs.hash, msg[start:])
+
+	recvKey, sendKey := kdf2(hs.chainKey, nil)
+	session, err := newSession(hs.remote, sendKey, recvKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return msg, session, nil
+}
+
+// ConsumeResponse processes the responder's message and derives the
+// initiator's transport session.
+func (hs *Handshake) ConsumeResponse(prologue, msg []byte) ([]byte, *Session, error) {
+	if len(msg) < responseMinSize {
+		return nil, nil, ErrMessageTooShort
+	}
+	hs.hash = mixHash(hs.hash, prologue)
+	off := 0
+	copy(hs.remoteEph[:], msg[off:off+KeySize])
+	off += KeySize
+	hs.hash = mixHash(hs.hash, hs.remoteEph[:])
+	hs.chainKey = kdf1(hs.chainKey, hs.remoteEph[:])
+
+	// ee
+	ss, err := sharedSecret(hs.ephemeral, hs.remoteEph)
+	if err != nil {
+		return nil, nil, ErrHandshakeFailed
+	}
+	hs.chainKey = kdf1(hs.chainKey, ss[:])
+
+	// se
+	ss, err = sharedSecret(hs.local, hs.remoteEph)
+	if err != nil {
+		return nil, nil, ErrHandshakeFailed
+	}
+	var key [chacha20poly1305.KeySize]byte
+	hs.chainKey, key = kdf2(hs.chainKey, ss[:])
+
+	encPayload := msg[off:]
+	payload, err := open(key, encPayload, hs.hash[:])
+	if err != nil {
+		return nil, nil, ErrHandshakeFailed
+	}
+	hs.hash = mixHash(hs.hash, encPayload)
+
+	sendKey, recvKey := kdf2(hs.chainKey, nil)
+	session, err := newSession(hs.remote, sendKey, recvKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return payload, session, nil
+}
+
+// --- Noise primitives ---
+
+func newBlake2s() hash.Hash {
+	h, _ := blake2s.New256(nil)
+	return h
+}
+
+func mixHash(h [blake2s.Size]byte, data []byte) [blake2s.Size]byte {
+	return blake2s.Sum256(append(h[:], data...))
+}
+
+func hmacSum(key, data []byte) [blake2s.Size]byte {
+	var out [blake2s.Size]byte
+	mac := hmac.New(newBlake2s, key)
+	mac.Write(data)
+	copy(out[:], mac.Sum(nil))
+	return out
+}
+
+// kdf1 derives one new chaining key (HKDF with HMAC-BLAKE2s).
+func kdf1(ck [blake2s.Size]byte, input []byte) [blake2s.Size]byte {
+	prk := hmacSum(ck[:], input)
+	return hmacSum(prk[:], []byte{0x1})
+}
+
+// kdf2 derives a new chaining key and one cipher key.
+func kdf2(ck [blake2s.Size]byte, input []byte) ([blake2s.Size]byte, [blake2s.Size]byte) {
+	prk := hmacSum(ck[:], input)
+	t1 := hmacSum(prk[:], []byte{0x1})
+	t2 := hmacSum(prk[:], append(t1[:], 0x2))
+	return t1, t2
+}
+
+// seal encrypts with a zero nonce; every handshake key is used exactly once.
+func seal(dst []byte, key [chacha20poly1305.KeySize]byte, plaintext, ad []byte) []byte {
+	aead, _ := chacha20poly1305.New(key[:])
+	var nonce [chacha20poly1305.NonceSize]byte
+	return aead.Seal(dst, nonce[:], plaintext, ad)
+}
+
+func open(key [chacha20poly1305.KeySize]byte, ciphertext, ad []byte) ([]byte, error) {
+	aead, _ := chacha20poly1305.New(key[:])
+	var nonce [chacha20poly1305.NonceSize]byte
+	return aead.Open(nil, nonce[:], ciphertext, ad)
+}
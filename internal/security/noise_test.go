@@ -0,0 +1,149 @@
+package security
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func mustKey(t *testing.T) PrivateKey {
+	t.Helper()
+	key, err := GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// handshake runs both messages and returns the initiator's and the
+// responder's sessions
+func handshake(t *testing.T, initiator, responder PrivateKey) (*Session, *Session) {
+	t.Helper()
+	prologue := []byte("init")
+	hs := NewInitiator(initiator, responder.PublicKey())
+	msg, err := hs.CreateInitiation(prologue, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, _, payload, err := ConsumeInitiation(responder, prologue, msg[len(prologue):])
+	if err != nil {
+		t.Fatalf("ConsumeInitiation: %v", err)
+	}
+	if peer.Remote() != initiator.PublicKey() {
+		t.Fatalf("responder learned %s, want %s", peer.Remote(), initiator.PublicKey())
+	}
+	if string(payload) != "hello" {
+		t.Fatalf("initiation payload = %q, want %q", payload, "hello")
+	}
+
+	respPrologue := []byte("resp")
+	resp, respSession, err := peer.CreateResponse(respPrologue, []byte("welcome"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, initSession, err := hs.ConsumeResponse(respPrologue, resp[len(respPrologue):])
+	if err != nil {
+		t.Fatalf("ConsumeResponse: %v", err)
+	}
+	if string(payload) != "welcome" {
+		t.Fatalf("response payload = %q, want %q", payload, "welcome")
+	}
+	return initSession, respSession
+}
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	agent, hub := mustKey(t), mustKey(t)
+	agentSession, hubSession := handshake(t, agent, hub)
+
+	header := []byte{1, 2, 3, 4}
+	for _, dir := range []struct {
+		name     string
+		from, to *Session
+	}{
+		{"agent to hub", agentSession, hubSession},
+		{"hub to agent", hubSession, agentSession},
+	} {
+		packet, err := dir.from.PackAndEncrypt(header, []byte("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := dir.to.DecryptUnpack(header, packet[len(header):])
+		if err != nil {
+			t.Fatalf("%s: %v", dir.name, err)
+		}
+		if string(plain) != "payload" {
+			t.Fatalf("%s: got %q", dir.name, plain)
+		}
+		if _, err := dir.to.DecryptUnpack(header, packet[len(header):]); !errors.Is(err, ErrReplayed) {
+			t.Fatalf("%s: replayed packet: got %v, want ErrReplayed", dir.name, err)
+		}
+	}
+}
+
+func TestHandshakeTampered(t *testing.T) {
+	agent, hub := mustKey(t), mustKey(t)
+	prologue := []byte("init")
+
+	newInitiation := func() []byte {
+		msg, err := NewInitiator(agent, hub.PublicKey()).CreateInitiation(prologue, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg[len(prologue):]
+	}
+
+	t.Run("flipped bit", func(t *testing.T) {
+		for _, offset := range []int{0, KeySize + 3, len(newInitiation()) - 1} {
+			msg := newInitiation()
+			msg[offset] ^= 0x01
+			if _, _, _, err := ConsumeInitiation(hub, prologue, msg); !errors.Is(err, ErrHandshakeFailed) {
+				t.Fatalf("byte %d flipped: got %v, want ErrHandshakeFailed", offset, err)
+			}
+		}
+	})
+	t.Run("different prologue", func(t *testing.T) {
+		if _, _, _, err := ConsumeInitiation(hub, []byte("other"), newInitiation()); !errors.Is(err, ErrHandshakeFailed) {
+			t.Fatalf("got %v, want ErrHandshakeFailed", err)
+		}
+	})
+	t.Run("wrong responder", func(t *testing.T) {
+		if _, _, _, err := ConsumeInitiation(mustKey(t), prologue, newInitiation()); !errors.Is(err, ErrHandshakeFailed) {
+			t.Fatalf("got %v, want ErrHandshakeFailed", err)
+		}
+	})
+	t.Run("truncated", func(t *testing.T) {
+		msg := newInitiation()
+		if _, _, _, err := ConsumeInitiation(hub, prologue, msg[:initiationMinSize-1]); !errors.Is(err, ErrMessageTooShort) {
+			t.Fatalf("got %v, want ErrMessageTooShort", err)
+		}
+	})
+	t.Run("tampered response", func(t *testing.T) {
+		hs := NewInitiator(agent, hub.PublicKey())
+		msg, err := hs.CreateInitiation(prologue, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer, _, _, err := ConsumeInitiation(hub, prologue, msg[len(prologue):])
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, _, err := peer.CreateResponse(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tampered := bytes.Clone(resp)
+		tampered[len(tampered)-1] ^= 0x80
+		if _, _, err := hs.ConsumeResponse(nil, tampered); !errors.Is(err, ErrHandshakeFailed) {
+			t.Fatalf("got %v, want ErrHandshakeFailed", err)
+		}
+	})
+}
+
+func TestTimestampOrder(t *testing.T) {
+	first := Now()
+	second := Now()
+	if first.After(second) {
+		t.Fatal("an earlier timestamp compares as newer")
+	}
+}
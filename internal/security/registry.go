@@ -0,0 +1,343 @@
+package security
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// PeerInfo is the static configuration of an authorized peer.
+type PeerInfo struct {
+	Name       string
+	AllowedIPs []*net.IPNet // Inner source addresses bound to this identity
+}
+
+// Registry tracks which static keys are allowed to join the mesh and the
+// transport sessions currently established with each of them (Hub side).
+type Registry struct {
+	sync.RWMutex
+	authorized map[PublicKey]PeerInfo
+	lastInit   map[PublicKey]Timestamp // newest accepted initiation per peer
+	keyrings   map[PublicKey]*Keyring
+	byIndex    map[uint32]PublicKey // local session index -> identity
+	byAddr     map[string]PublicKey // UDP endpoint -> identity
+	addrOf     map[PublicKey]string
+	banned     map[PublicKey]bool // Refused even if authorized, until unbanned
+	limits     Limits
+}
+
+// NewRegistry creates a registry for the given set of authorized peers.
+func NewRegistry(authorized map[PublicKey]PeerInfo, limits Limits) *Registry {
+	return &Registry{
+		authorized: authorized,
+		lastInit:   make(map[PublicKey]Timestamp),
+		keyrings:   make(map[PublicKey]*Keyring),
+		byIndex:    make(map[uint32]PublicKey),
+		byAddr:     make(map[string]PublicKey),
+		addrOf:     make(map[PublicKey]string),
+		banned:     make(map[PublicKey]bool),
+		limits:     limits,
+	}
+}
+
+// Authorized returns the configured name of a peer and whether it may connect.
+func (r *Registry) Authorized(peer PublicKey) (string, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	info, ok := r.authorized[peer]
+	return info.Name, ok
+}
+
+// Allows reports whether ip is inside the allowed set of the identity.
+// Packets with any other inner source address are spoofed.
+func (r *Registry) Allows(peer PublicKey, ip net.IP) bool {
+	r.RLock()
+	defer r.RUnlock()
+	for _, prefix := range r.authorized[peer].AllowedIPs {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Owner returns the identity whose allowed IPs contain ip
+func (r *Registry) Owner(ip net.IP) (PublicKey, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	for peer, info := range r.authorized {
+		for _, prefix := range info.AllowedIPs {
+			if prefix.Contains(ip) {
+				return peer, true
+			}
+		}
+	}
+	return PublicKey{}, false
+}
+
+// AllowedIPs returns a copy of the allowed set of an identity.
+func (r *Registry) AllowedIPs(peer PublicKey) []*net.IPNet {
+	r.RLock()
+	defer r.RUnlock()
+	return append([]*net.IPNet(nil), r.authorized[peer].AllowedIPs...)
+}
+
+// Allow adds prefix to the allowed set of an identity (e.g. an IPAM lease).
+func (r *Registry) Allow(peer PublicKey, prefix *net.IPNet) {
+	r.Lock()
+	defer r.Unlock()
+	info, ok := r.authorized[peer]
+	if !ok {
+		return
+	}
+	for _, existing := range info.AllowedIPs {
+		if existing.String() == prefix.String() {
+			return
+		}
+	}
+	info.AllowedIPs = append(info.AllowedIPs, prefix)
+	r.authorized[peer] = info
+}
+
+// Covers reports whether the whole prefix lies inside the identity's
+// allowed set (e.g. before accepting an advertised subnet).
+func (r *Registry) Covers(peer PublicKey, prefix *net.IPNet) bool {
+	r.RLock()
+	defer r.RUnlock()
+	ones, _ := prefix.Mask.Size()
+	for _, allowed := range r.authorized[peer].AllowedIPs {
+		allowedOnes, _ := allowed.Mask.Size()
+		if allowed.Contains(prefix.IP) && allowedOnes <= ones {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptTimestamp records ts for peer if it is newer than the last accepted
+// initiation. A replayed initiation carries an old timestamp and is refused.
+func (r *Registry) AcceptTimestamp(peer PublicKey, ts Timestamp) bool {
+	r.Lock()
+	defer r.Unlock()
+	if last, ok := r.lastInit[peer]; ok && !ts.After(last) {
+		return false
+	}
+	r.lastInit[peer] = ts
+	return true
+}
+
+// AllocateIndex reserves a random, unused local session index.
+func (r *Registry) AllocateIndex() uint32 {
+	r.Lock()
+	defer r.Unlock()
+	for {
+		index := RandomIndex()
+		if _, taken := r.byIndex[index]; !taken {
+			r.byIndex[index] = PublicKey{}
+			return index
+		}
+	}
+}
+
+// ReleaseIndex frees an index whose handshake did not complete.
+func (r *Registry) ReleaseIndex(index uint32) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.byIndex, index)
+}
+
+// Establish installs a fresh session for a peer reachable at addr.
+// Older sessions of the same identity stay usable until the peer switches.
+func (r *Registry) Establish(addr string, s *Session) {
+	r.Lock()
+	defer r.Unlock()
+
+	ring, ok := r.keyrings[s.Remote]
+	if !ok {
+		ring = NewKeyring(r.limits)
+		r.keyrings[s.Remote] = ring
+	}
+	for _, old := range ring.Install(s, false) {
+		delete(r.byIndex, old.LocalIndex)
+	}
+	r.byIndex[s.LocalIndex] = s.Remote
+	r.bindAddr(s.Remote, addr)
+	log.Printf("[SEC] Session established with %s at %s (epoch %d)", s.Remote, addr, s.Epoch)
+}
+
+// bindAddr records the endpoint of an identity (caller holds the lock).
+func (r *Registry) bindAddr(peer PublicKey, addr string) {
+	if oldAddr, ok := r.addrOf[peer]; ok && oldAddr != addr {
+		delete(r.byAddr, oldAddr)
+	}
+	if old, ok := r.byAddr[addr]; ok && old != peer {
+		// Another identity used to live at this endpoint (NAT reuse)
+		delete(r.addrOf, old)
+	}
+	r.byAddr[addr] = peer
+	r.addrOf[peer] = addr
+}
+
+// Decrypt authenticates a transport packet addressed to a local session
+// index. If the peer roamed to a new endpoint, the endpoint is updated only
+// after the packet authenticated.
+func (r *Registry) Decrypt(addr string, index uint32, header, body []byte) ([]byte, *Session, error) {
+	r.RLock()
+	peer, ok := r.byIndex[index]
+	ring := r.keyrings[peer]
+	r.RUnlock()
+
+	if !ok || ring == nil {
+		return nil, nil, ErrNoSession
+	}
+	plaintext, session, evicted, err := ring.decrypt(index, header, body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r.Lock()
+	if evicted != nil && r.byIndex[evicted.LocalIndex] == peer {
+		delete(r.byIndex, evicted.LocalIndex)
+	}
+	if r.addrOf[peer] != addr {
+		r.bindAddr(peer, addr)
+	}
+	r.Unlock()
+	return plaintext, session, nil
+}
+
+// Update replaces the set of authorized peers (configuration reload).
+// Sessions of identities that stay authorized are kept untouched; the
+// identities that were dropped are returned so the caller can close them.
+func (r *Registry) Update(authorized map[PublicKey]PeerInfo) []PublicKey {
+	r.Lock()
+	defer r.Unlock()
+	var removed []PublicKey
+	for peer := range r.authorized {
+		if _, ok := authorized[peer]; !ok {
+			removed = append(removed, peer)
+		}
+	}
+	r.authorized = authorized
+	return removed
+}
+
+// Ban refuses new handshakes from an identity, whether it is authorized or
+// not. It survives configuration reloads but not a restart.
+func (r *Registry) Ban(peer PublicKey) {
+	r.Lock()
+	defer r.Unlock()
+	r.banned[peer] = true
+}
+
+// Unban lifts a ban. It returns false if the identity was not banned.
+func (r *Registry) Unban(peer PublicKey) bool {
+	r.Lock()
+	defer r.Unlock()
+	if !r.banned[peer] {
+		return false
+	}
+	delete(r.banned, peer)
+	return true
+}
+
+// Banned reports whether an identity is banned.
+func (r *Registry) Banned(peer PublicKey) bool {
+	r.RLock()
+	defer r.RUnlock()
+	return r.banned[peer]
+}
+
+// Bans returns every banned identity.
+func (r *Registry) Bans() []PublicKey {
+	r.RLock()
+	defer r.RUnlock()
+	bans := make([]PublicKey, 0, len(r.banned))
+	for peer := range r.banned {
+		bans = append(bans, peer)
+	}
+	return bans
+}
+
+// Remove forgets every session of an identity (e.g. after a disconnect).
+func (r *Registry) Remove(peer PublicKey) {
+	r.Lock()
+	defer r.Unlock()
+	if ring, ok := r.keyrings[peer]; ok {
+		for _, s := range ring.Sessions() {
+			delete(r.byIndex, s.LocalIndex)
+		}
+		delete(r.keyrings, peer)
+	}
+	if addr, ok := r.addrOf[peer]; ok {
+		delete(r.byAddr, addr)
+		delete(r.addrOf, peer)
+	}
+}
+
+// ByAddr returns the current session of the identity bound to a UDP endpoint.
+func (r *Registry) ByAddr(addr string) *Session {
+	r.RLock()
+	peer, ok := r.byAddr[addr]
+	r.RUnlock()
+	if !ok {
+		return nil
+	}
+	return r.ByPeer(peer)
+}
+
+// AddrOf returns the current UDP endpoint of an identity.
+func (r *Registry) AddrOf(peer PublicKey) *net.UDPAddr {
+	r.RLock()
+	addr, ok := r.addrOf[peer]
+	r.RUnlock()
+	if !ok {
+		return nil
+	}
+	udpAddr, _ := net.ResolveUDPAddr("udp", addr)
+	return udpAddr
+}
+
+// ByPeer returns the current session of an identity.
+func (r *Registry) ByPeer(peer PublicKey) *Session {
+	r.RLock()
+	ring := r.keyrings[peer]
+	r.RUnlock()
+	if ring == nil {
+		return nil
+	}
+	return ring.Current()
+}
+
+// Active returns the current session of every connected identity.
+func (r *Registry) Active() []*Session {
+	r.RLock()
+	rings := make([]*Keyring, 0, len(r.keyrings))
+	for _, ring := range r.keyrings {
+		rings = append(rings, ring)
+	}
+	r.RUnlock()
+
+	var sessions []*Session
+	for _, ring := range rings {
+		if s := ring.Current(); s != nil {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions
+}
+
+// KeyInfo returns the epoch and creation time of the current session of an
+// identity given in its base64 form (as stored in router.PeerStats).
+func (r *Registry) KeyInfo(identity string) (uint64, time.Time, bool) {
+	peer, err := ParsePublicKey(identity)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	session := r.ByPeer(peer)
+	if session == nil {
+		return 0, time.Time{}, false
+	}
+	return session.Epoch, session.Created, true
+}
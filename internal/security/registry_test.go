@@ -0,0 +1,38 @@
+package security
+
+import "testing"
+
+// Every confirmed rekey evicts the previous session: its index must be freed
+// instead of piling up for the life of the Hub.
+func TestRegistryRekeyFreesIndexes(t *testing.T) {
+	agent, hub := mustKey(t), mustKey(t)
+	registry := NewRegistry(map[PublicKey]PeerInfo{agent.PublicKey(): {Name: "agent"}}, DefaultLimits())
+	header := []byte{0, 0, 0, 0}
+
+	for i := 0; i < 10; i++ {
+		agentSession, hubSession := handshake(t, agent, hub)
+		hubSession.LocalIndex = registry.AllocateIndex()
+		registry.Establish("192.0.2.1:5000", hubSession)
+
+		// The first packet with the new keys confirms the rotation
+		packet, err := agentSession.PackAndEncrypt(header, []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := registry.Decrypt("192.0.2.1:5000", hubSession.LocalIndex, header, packet[len(header):]); err != nil {
+			t.Fatalf("rekey %d: %v", i, err)
+		}
+	}
+
+	registry.RLock()
+	defer registry.RUnlock()
+	// current and previous
+	if got := len(registry.byIndex); got != 2 {
+		t.Fatalf("%d indexes registered after 10 rekeys, want 2", got)
+	}
+	for index := range registry.byIndex {
+		if !registry.keyrings[agent.PublicKey()].Owns(index) {
+			t.Fatalf("index %d belongs to no session", index)
+		}
+	}
+}
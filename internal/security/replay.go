@@ -0,0 +1,83 @@
+package security
+
+import (
+	"errors"
+	"sync"
+)
+
+// Sliding window anti-replay filter (RFC 6479 / WireGuard style).
+// Counters are only recorded after the packet authenticated, so a forged
+// counter can neither slide the window nor be mistaken for a replay.
+// The bitmap is a ring of 64-bit blocks; sliding the window forward only
+// clears the blocks that fall out of it instead of shifting the whole bitmap.
+const (
+	replayBlockBits   = 64
+	replayRingBlocks  = 32
+	replayBlockMask   = replayRingBlocks - 1
+	replayWindowSize  = (replayRingBlocks - 1) * replayBlockBits
+	replayBitIndexLog = 6 // log2(replayBlockBits)
+)
+
+var (
+	ErrReplayed = errors.New("replayed packet")
+	ErrTooOld   = errors.New("packet outside replay window")
+)
+
+type replayFilter struct {
+	sync.Mutex
+	last uint64
+	ring [replayRingBlocks]uint64
+	seen bool
+}
+
+// accept records counter as received, or reports why it must be dropped.
+func (f *replayFilter) accept(counter uint64) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if err := f.test(counter); err != nil {
+		return err
+	}
+
+	block := counter >> replayBitIndexLog
+	if !f.seen || counter > f.last {
+		current := f.last >> replayBitIndexLog
+		diff := block - current
+		if !f.seen {
+			diff = replayRingBlocks
+		}
+		if diff > replayRingBlocks {
+			diff = replayRingBlocks
+		}
+		// Clear the blocks the window slid over
+		for i := uint64(1); i <= diff; i++ {
+			f.ring[(current+i)&replayBlockMask] = 0
+		}
+		f.last = counter
+		f.seen = true
+	}
+
+	f.ring[block&replayBlockMask] |= 1 << (counter & (replayBlockBits - 1))
+	return nil
+}
+
+// highest returns the largest counter accepted so far.
+func (f *replayFilter) highest() uint64 {
+	f.Lock()
+	defer f.Unlock()
+	return f.last
+}
+
+func (f *replayFilter) test(counter uint64) error {
+	if !f.seen || counter > f.last {
+		return nil
+	}
+	if f.last-counter >= replayWindowSize {
+		return ErrTooOld
+	}
+	block := (counter >> replayBitIndexLog) & replayBlockMask
+	if f.ring[block]&(1<<(counter&(replayBlockBits-1))) != 0 {
+		return ErrReplayed
+	}
+	return nil
+}
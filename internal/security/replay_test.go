@@ -0,0 +1,74 @@
+package security
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestReplayFilter(t *testing.T) {
+	type step struct {
+		counter uint64
+		want    error
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"in order", []step{{0, nil}, {1, nil}, {2, nil}, {3, nil}}},
+		{"out of order within the window", []step{{5, nil}, {3, nil}, {4, nil}, {0, nil}}},
+		{"duplicate", []step{{0, nil}, {1, nil}, {1, ErrReplayed}, {0, ErrReplayed}}},
+		{"duplicate of the highest", []step{{7, nil}, {7, ErrReplayed}}},
+		{"too old", []step{{replayWindowSize + 10, nil}, {10, ErrTooOld}, {9, ErrTooOld}}},
+		{"oldest counter still in the window", []step{{replayWindowSize, nil}, {1, nil}, {0, ErrTooOld}}},
+		{"window slide forgets old bits", []step{
+			{1, nil},
+			{1 + replayWindowSize, nil},
+			{1, ErrTooOld},
+			{2 + replayWindowSize/2, nil},
+			{2 + replayWindowSize/2, ErrReplayed},
+		}},
+		{"jump larger than the ring", []step{
+			{3, nil},
+			{3 + 10*replayWindowSize, nil},
+			// Every block was cleared: unseen counters in the window are new
+			{3 + 10*replayWindowSize - 100, nil},
+			{3 + 10*replayWindowSize - replayWindowSize + 1, nil},
+			{3 + 10*replayWindowSize, ErrReplayed},
+		}},
+		{"ring index wraps around", func() []step {
+			var steps []step
+			for c := uint64(0); c < 3*replayRingBlocks*replayBlockBits; c += replayBlockBits - 1 {
+				steps = append(steps, step{c, nil})
+			}
+			return append(steps, step{steps[len(steps)-1].counter, ErrReplayed})
+		}()},
+		{"counters near the top of the range", []step{
+			{math.MaxUint64 - 100, nil},
+			{math.MaxUint64 - 1, nil},
+			{math.MaxUint64 - 50, nil},
+			{math.MaxUint64 - 50, ErrReplayed},
+			{math.MaxUint64 - 1 - replayWindowSize, ErrTooOld},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f replayFilter
+			for i, s := range tt.steps {
+				if err := f.accept(s.counter); !errors.Is(err, s.want) {
+					t.Fatalf("step %d: accept(%d) = %v, want %v", i, s.counter, err, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayFilterHighest(t *testing.T) {
+	var f replayFilter
+	for _, c := range []uint64{4, 9, 2} {
+		f.accept(c)
+	}
+	if got := f.highest(); got != 9 {
+		t.Fatalf("highest() = %d, want 9", got)
+	}
+}
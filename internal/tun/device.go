@@ -1,15 +1,20 @@
 package tun
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os/exec"
+	"strings"
 
 	"github.com/songgao/water"
 )
 
-// Setup creates and configures the TUN interface
-func Setup(ip string) (*water.Interface, error) {
+// Setup creates and configures the TUN interface with one or more
+// addresses (e.g. an IPv4 and an IPv6 one for a dual-stack overlay).
+// Each may carry a prefix length (10.0.0.5/24, fd00::5/64); bare addresses
+// default to /24 for IPv4 and /64 for IPv6.
+func Setup(mtu int, addrs ...string) (*water.Interface, error) {
 	config := water.Config{DeviceType: water.TUN}
 	ifce, err := water.New(config)
 	if err != nil {
@@ -17,36 +22,47 @@ func Setup(ip string) (*water.Interface, error) {
 	}
 
 	log.Printf("[TUN] Interface %s created", ifce.Name())
-	
-	if err := configureInterface(ifce.Name(), ip); err != nil {
+
+	if err := configureInterface(ifce.Name(), addrs, mtu); err != nil {
+		ifce.Close()
 		return nil, err
 	}
 
 	return ifce, nil
 }
 
-// configureInterface runs Linux ip commands to set address and MTU
-func configureInterface(ifaceName, ip string) error {
-	cidr := ip + "/24"
-	
-	// Assign IP
-	if err := runCmd("ip", "addr", "add", cidr, "dev", ifaceName); err != nil {
-		log.Printf("[TUN] Note: IP assignment might already exist: %v", err)
+// configureInterface assigns the addresses, sets the MTU and brings the
+// interface up
+func configureInterface(ifaceName string, addrs []string, mtu int) error {
+	link := system()
+	for _, s := range addrs {
+		addr, err := ParseAddress(s)
+		if err != nil {
+			return fmt.Errorf("invalid address %q: %v", s, err)
+		}
+		// Assign IP (a leftover of an earlier run is fine)
+		if err := link.AddAddress(ifaceName, addr); errors.Is(err, ErrExists) {
+			log.Printf("[TUN] Note: %s is already assigned to %s", addr, ifaceName)
+		} else if err != nil {
+			return err
+		}
 	}
 
-	// Set MTU (1300 is safe for UDP encapsulation)
-	if err := runCmd("ip", "link", "set", "dev", ifaceName, "mtu", "1300"); err != nil {
-		return fmt.Errorf("failed to set MTU: %v", err)
+	// Set MTU (the default 1300 is safe for UDP encapsulation)
+	if err := link.SetMTU(ifaceName, mtu); err != nil {
+		return err
 	}
 
 	// Set UP
-	if err := runCmd("ip", "link", "set", "dev", ifaceName, "up"); err != nil {
-		return fmt.Errorf("failed to bring up interface: %v", err)
-	}
-
-	return nil
+	return link.SetUp(ifaceName)
 }
 
+// runCmd runs a system tool (sysctl, iptables); its output ends up in the
+// error
 func runCmd(name string, args ...string) error {
-	return exec.Command(name, args...).Run()
-}
\ No newline at end of file
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if msg := strings.TrimSpace(string(out)); err != nil && msg != "" {
+		return fmt.Errorf("%v: %s", err, msg)
+	}
+	return err
+}
@@ -0,0 +1,99 @@
+package tun
+
+import (
+	"errors"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// execBackend runs the ip command of iproute2
+type execBackend struct{}
+
+func newExec() (Backend, error) {
+	if _, err := exec.LookPath("ip"); err != nil {
+		return nil, err
+	}
+	return execBackend{}, nil
+}
+
+func (execBackend) Name() string { return BackendExec }
+
+func (b execBackend) AddAddress(dev string, addr *net.IPNet) error {
+	return b.ip("add address", addr.String()+" dev "+dev, "addr", "add", addr.String(), "dev", dev)
+}
+
+func (b execBackend) SetMTU(dev string, mtu int) error {
+	return b.ip("set mtu", dev, "link", "set", "dev", dev, "mtu", strconv.Itoa(mtu))
+}
+
+func (b execBackend) SetUp(dev string) error {
+	return b.ip("set up", dev, "link", "set", "dev", dev, "up")
+}
+
+func (b execBackend) AddRoute(r Route) error {
+	return b.ip("add route", r.String(), routeArgs("add", r)...)
+}
+
+func (b execBackend) ReplaceRoute(r Route) error {
+	return b.ip("replace route", r.String(), routeArgs("replace", r)...)
+}
+
+func (b execBackend) DelRoute(r Route) error {
+	return b.ip("delete route", r.String(), routeArgs("del", r)...)
+}
+
+func routeArgs(verb string, r Route) []string {
+	args := []string{"route", verb, r.Dst.String()}
+	if r.Dst.IP.To4() == nil {
+		args = append([]string{"-6"}, args...)
+	}
+	if r.Gateway != nil {
+		args = append(args, "via", r.Gateway.String())
+	}
+	if r.Dev != "" {
+		args = append(args, "dev", r.Dev)
+	}
+	return args
+}
+
+// ip runs the command and turns its complaint into an *OpError
+func (execBackend) ip(op, target string, args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	msg := strings.TrimSpace(string(out))
+	if msg == "" {
+		msg = err.Error()
+	}
+	return &OpError{Op: op, Target: target, Backend: BackendExec, Kind: kindOf(errnoOf(msg)), Err: errors.New(msg)}
+}
+
+// ipMessages are the strerror texts ip prints after "RTNETLINK answers:"
+// or "Error:", for the errors the callers care about
+var ipMessages = []struct {
+	text  string
+	errno syscall.Errno
+}{
+	{"File exists", syscall.EEXIST},
+	{"No such process", syscall.ESRCH},
+	{"No such file or directory", syscall.ENOENT},
+	{"Cannot assign requested address", syscall.EADDRNOTAVAIL},
+	{"Cannot find device", syscall.ENODEV},
+	{"No such device", syscall.ENODEV},
+	{"Operation not permitted", syscall.EPERM},
+	{"Invalid argument", syscall.EINVAL},
+	{"Network is unreachable", syscall.ENETUNREACH},
+}
+
+func errnoOf(msg string) syscall.Errno {
+	for _, m := range ipMessages {
+		if strings.Contains(msg, m.text) {
+			return m.errno
+		}
+	}
+	return 0
+}
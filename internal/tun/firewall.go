@@ -0,0 +1,131 @@
+package tun
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// The NAT and forwarding rules of an Exit Node are installed through a
+// Firewall: iptables, or nftables on hosts where iptables-legacy rules
+// would fight with the nf_tables ones.
+const (
+	FirewallAuto     = "auto" // See detectFirewall
+	FirewallIPTables = "iptables"
+	FirewallNFTables = "nftables"
+)
+
+// Firewall manages the packet filter rules of go-mesh-hub
+type Firewall interface {
+	Name() string
+	// EnableNAT masquerades the traffic forwarded from tunName to the
+	// other interfaces and lets the replies back in, for IPv6 too with
+	// ipv6. It is idempotent.
+	EnableNAT(tunName string, ipv6 bool) error
+	// DisableNAT removes what EnableNAT installed, in both families
+	DisableNAT(tunName string) error
+	// EnableKillSwitch drops the outgoing traffic that is not for the
+	// loopback, the TUN or the Hub. It replaces the kill switch in place,
+	// also one left by a previous run, without letting traffic through.
+	EnableKillSwitch(ks KillSwitch) error
+	// DisableKillSwitch removes the kill switch rules
+	DisableKillSwitch() error
+}
+
+// KillSwitch is the only outgoing traffic allowed while it is on
+type KillSwitch struct {
+	Tun string       // TUN interface, empty until it exists
+	Hub *net.UDPAddr // The Hub's real address
+}
+
+var (
+	firewallMu sync.Mutex
+	firewall   Firewall
+)
+
+// SetFirewall selects the firewall by name (see FirewallAuto). An explicit
+// name fails right away if its tool is missing; auto is detected on first
+// use, so hosts that never enable NAT need neither.
+func SetFirewall(name string) error {
+	var fw Firewall
+	if name != FirewallAuto && name != "" {
+		var err error
+		if fw, err = newFirewall(name); err != nil {
+			return err
+		}
+	}
+	firewallMu.Lock()
+	firewall = fw
+	firewallMu.Unlock()
+	return nil
+}
+
+// packetFilter returns the selected firewall
+func packetFilter() (Firewall, error) {
+	firewallMu.Lock()
+	defer firewallMu.Unlock()
+	if firewall == nil {
+		fw, err := newFirewall(FirewallAuto)
+		if err != nil {
+			return nil, err
+		}
+		firewall = fw
+	}
+	return firewall, nil
+}
+
+func newFirewall(name string) (Firewall, error) {
+	switch name {
+	case FirewallIPTables:
+		if _, err := exec.LookPath("iptables"); err != nil {
+			return nil, err
+		}
+		return iptables{}, nil
+	case FirewallNFTables:
+		if _, err := exec.LookPath("nft"); err != nil {
+			return nil, err
+		}
+		return newNFTables(), nil
+	case FirewallAuto, "":
+		fw, err := detectFirewall()
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("[NAT] Firewall detected: %s", fw.Name())
+		return fw, nil
+	}
+	return nil, fmt.Errorf("unknown firewall %q (auto, iptables or nftables)", name)
+}
+
+// detectFirewall picks nftables when it is what the host runs: nft is
+// installed and iptables is missing, is the nf_tables flavour, or is the
+// legacy one next to an nftables ruleset. Otherwise iptables.
+func detectFirewall() (Firewall, error) {
+	_, nftErr := exec.LookPath("nft")
+	_, iptErr := exec.LookPath("iptables")
+	switch {
+	case nftErr != nil && iptErr != nil:
+		return nil, fmt.Errorf("neither iptables nor nft found")
+	case nftErr != nil:
+		return iptables{}, nil
+	case iptErr != nil:
+		return newNFTables(), nil
+	}
+
+	version, _ := exec.Command("iptables", "--version").Output()
+	if strings.Contains(string(version), "nf_tables") {
+		return newNFTables(), nil
+	}
+	// iptables-legacy: nftables only if something else already uses it
+	tables, _ := exec.Command("nft", "list", "tables").Output()
+	for _, line := range strings.Split(string(tables), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasSuffix(line, " "+nftTable) && !strings.HasSuffix(line, " "+nftKillSwitchTable) {
+			return newNFTables(), nil
+		}
+	}
+	return iptables{}, nil
+}
@@ -0,0 +1,280 @@
+package tun
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// IPTables Constants to avoid "magic strings" and typos.
+const (
+	TableNat    = "nat"
+	TableFilter = "filter"
+
+	ChainPostRouting = "POSTROUTING"
+	ChainForward     = "FORWARD"
+	ChainOutput      = "OUTPUT"
+
+	TargetMasquerade = "MASQUERADE"
+	TargetAccept     = "ACCEPT"
+	TargetDrop       = "DROP"
+
+	// ChainKillSwitch holds the kill switch rules, jumped to from OUTPUT
+	ChainKillSwitch = "GO-MESH-KILLSWITCH"
+)
+
+// Rule represents a single iptables rule configuration.
+// We use a struct to ensure consistency between creation and deletion.
+type Rule struct {
+	Name  string   // Human-readable description for logs
+	Table string   // e.g., "nat"
+	Chain string   // e.g., "POSTROUTING"
+	Args  []string // The specific matchers (e.g., "-o", "tun0", "-j", "MASQUERADE")
+}
+
+// iptables inserts its rules at the top of the built-in chains
+type iptables struct{}
+
+func (iptables) Name() string { return FirewallIPTables }
+
+// natRules defines the Exit Node ruleset. We define it in one place to
+// ensure the exact same arguments are used for Add and Delete.
+// The "! -o tunName" logic ensures we masquerade traffic going out to physical interfaces (eth0/wlan0).
+func natRules(tunName string) []Rule {
+	return []Rule{
+		{
+			Name:  "Masquerade Outbound Traffic",
+			Table: TableNat,
+			Chain: ChainPostRouting,
+			Args:  []string{"!", "-o", tunName, "-j", TargetMasquerade},
+		},
+		{
+			Name:  "Allow Forwarding FROM Tunnel",
+			Table: TableFilter,
+			Chain: ChainForward,
+			Args:  []string{"-i", tunName, "-j", TargetAccept},
+		},
+		{
+			Name:  "Allow Forwarding TO Tunnel (Established)",
+			Table: TableFilter,
+			Chain: ChainForward,
+			Args:  []string{"-o", tunName, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", TargetAccept},
+		},
+	}
+}
+
+// EnableNAT applies the rules with iptables and, with ipv6, ip6tables
+func (iptables) EnableNAT(tunName string, ipv6 bool) error {
+	tools := []string{"iptables"}
+	if ipv6 {
+		if _, err := exec.LookPath("ip6tables"); err != nil {
+			log.Printf("[NAT] Warning: ip6tables not found, IPv6 traffic is forwarded without NAT")
+		} else {
+			tools = append(tools, "ip6tables")
+		}
+	}
+	// Apply Rules (Idempotent)
+	// We iterate through the definition list and ensure they exist.
+	for _, tool := range tools {
+		for _, rule := range natRules(tunName) {
+			if tool == "ip6tables" {
+				rule.Name += " (IPv6)"
+			}
+			if err := ensureRule(tool, rule); err != nil {
+				return fmt.Errorf("failed to apply rule '%s': %w", rule.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// DisableNAT removes the rules of both families: the journal does not
+// know whether IPv6 was on
+func (iptables) DisableNAT(tunName string) error {
+	var failed error
+	for _, tool := range []string{"iptables", "ip6tables"} {
+		if _, err := exec.LookPath(tool); err != nil && tool == "ip6tables" {
+			continue
+		}
+		for _, rule := range natRules(tunName) {
+			if tool == "ip6tables" {
+				rule.Name += " (IPv6)"
+			}
+			if err := deleteRule(tool, rule); err != nil {
+				// We log but do not fail here, as we want to attempt clearing all rules.
+				log.Printf("[NAT-ERR] Failed to cleanup rule '%s': %v", rule.Name, err)
+				failed = err
+			}
+		}
+	}
+	return failed
+}
+
+// ensureRule checks if a rule exists. If not, it inserts it at the top (Position 1).
+// tool is iptables or ip6tables.
+func ensureRule(tool string, r Rule) error {
+	// Step A: Check if rule exists (-C)
+	// iptables returns exit code 0 if found, 1 if not found.
+	checkArgs := append([]string{"-t", r.Table, "-C", r.Chain}, r.Args...)
+	cmdCheck := exec.Command(tool, checkArgs...)
+
+	if err := cmdCheck.Run(); err == nil {
+		// Rule already exists. No action needed.
+		return nil
+	}
+
+	// Step B: Insert rule at Position 1 (-I)
+	// We use Insert to ensure our rules take precedence over Docker or UFW rules.
+	insertArgs := append([]string{"-t", r.Table, "-I", r.Chain, "1"}, r.Args...)
+	if err := runCmd(tool, insertArgs...); err != nil {
+		return err
+	}
+
+	log.Printf("[NAT] Applied rule: %s", r.Name)
+	return nil
+}
+
+// deleteRule removes the exact rule specification from the chain. A rule
+// that is not there (e.g. already cleaned up) is skipped.
+func deleteRule(tool string, r Rule) error {
+	checkArgs := append([]string{"-t", r.Table, "-C", r.Chain}, r.Args...)
+	if exec.Command(tool, checkArgs...).Run() != nil {
+		return nil
+	}
+
+	// Delete (-D) requires the exact same arguments as Creation.
+	deleteArgs := append([]string{"-t", r.Table, "-D", r.Chain}, r.Args...)
+
+	if err := runCmd(tool, deleteArgs...); err != nil {
+		return err
+	}
+
+	log.Printf("[NAT] Removed rule: %s", r.Name)
+	return nil
+}
+
+// killSwitchRules defines the accept rules of the kill switch chain for
+// iptables, or ip6tables with v6. The Hub is only allowed in its family.
+func killSwitchRules(ks KillSwitch, v6 bool) []Rule {
+	rules := []Rule{{
+		Name:  "Kill switch: allow loopback",
+		Table: TableFilter,
+		Chain: ChainKillSwitch,
+		Args:  []string{"-o", "lo", "-j", TargetAccept},
+	}}
+	if ks.Tun != "" {
+		rules = append(rules, Rule{
+			Name:  "Kill switch: allow " + ks.Tun,
+			Table: TableFilter,
+			Chain: ChainKillSwitch,
+			Args:  []string{"-o", ks.Tun, "-j", TargetAccept},
+		})
+	}
+	if (ks.Hub.IP.To4() == nil) == v6 {
+		rules = append(rules, Rule{
+			Name:  "Kill switch: allow the Hub",
+			Table: TableFilter,
+			Chain: ChainKillSwitch,
+			Args:  []string{"-d", ks.Hub.IP.String(), "-p", "udp", "--dport", strconv.Itoa(ks.Hub.Port), "-j", TargetAccept},
+		})
+	}
+	if v6 {
+		// Without neighbor discovery the IPv6 gateway is unreachable
+		for _, icmpType := range []string{"neighbour-solicitation", "neighbour-advertisement", "router-solicitation"} {
+			rules = append(rules, Rule{
+				Name:  "Kill switch: allow " + icmpType,
+				Table: TableFilter,
+				Chain: ChainKillSwitch,
+				Args:  []string{"-p", "ipv6-icmp", "--icmpv6-type", icmpType, "-j", TargetAccept},
+			})
+		}
+	}
+	return rules
+}
+
+var (
+	killSwitchDrop = Rule{Name: "Kill switch: drop the rest", Table: TableFilter, Chain: ChainKillSwitch, Args: []string{"-j", TargetDrop}}
+	killSwitchJump = Rule{Name: "Kill switch", Table: TableFilter, Chain: ChainOutput, Args: []string{"-j", ChainKillSwitch}}
+)
+
+// EnableKillSwitch fills the kill switch chain with iptables and, when
+// installed, ip6tables. The chain is replaced in place without a gap: a
+// new drop rule goes in first, then the old rules go and the accept rules
+// are inserted above the drop.
+func (iptables) EnableKillSwitch(ks KillSwitch) error {
+	for _, tool := range []string{"iptables", "ip6tables"} {
+		if _, err := exec.LookPath(tool); err != nil && tool == "ip6tables" {
+			log.Printf("[SEC] Warning: ip6tables not found, the kill switch does not block IPv6")
+			continue
+		}
+		if err := resetKillSwitchChain(tool); err != nil {
+			return err
+		}
+		for _, rule := range append(killSwitchRules(ks, tool == "ip6tables"), killSwitchJump) {
+			if tool == "ip6tables" {
+				rule.Name += " (IPv6)"
+			}
+			if err := ensureRule(tool, rule); err != nil {
+				return fmt.Errorf("failed to apply rule '%s': %w", rule.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// resetKillSwitchChain leaves only the drop rule in the kill switch chain,
+// creating the chain if needed
+func resetKillSwitchChain(tool string) error {
+	out, err := exec.Command(tool, "-t", TableFilter, "-S", ChainKillSwitch).Output()
+	if err != nil {
+		if err := runCmd(tool, "-t", TableFilter, "-N", ChainKillSwitch); err != nil {
+			return fmt.Errorf("failed to create chain %s: %w", ChainKillSwitch, err)
+		}
+	}
+	var old int
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "-A ") {
+			old++
+		}
+	}
+	insertArgs := append([]string{"-t", TableFilter, "-I", ChainKillSwitch, "1"}, killSwitchDrop.Args...)
+	if err := runCmd(tool, insertArgs...); err != nil {
+		return fmt.Errorf("failed to apply rule '%s': %w", killSwitchDrop.Name, err)
+	}
+	// The old rules now follow the new drop
+	for range old {
+		if err := runCmd(tool, "-t", TableFilter, "-D", ChainKillSwitch, "2"); err != nil {
+			return fmt.Errorf("failed to replace chain %s: %w", ChainKillSwitch, err)
+		}
+	}
+	return nil
+}
+
+// DisableKillSwitch unhooks the kill switch chain, then flushes and deletes it
+func (iptables) DisableKillSwitch() error {
+	var failed error
+	for _, tool := range []string{"iptables", "ip6tables"} {
+		if exec.Command(tool, "-t", TableFilter, "-S", ChainKillSwitch).Run() != nil {
+			continue // No chain, or no ip6tables
+		}
+		jump := killSwitchJump
+		if tool == "ip6tables" {
+			jump.Name += " (IPv6)"
+		}
+		if err := deleteRule(tool, jump); err != nil {
+			log.Printf("[NAT-ERR] Failed to cleanup rule '%s': %v", jump.Name, err)
+			failed = err
+			continue
+		}
+		for _, op := range []string{"-F", "-X"} {
+			if err := runCmd(tool, "-t", TableFilter, op, ChainKillSwitch); err != nil {
+				log.Printf("[NAT-ERR] Failed to remove chain %s: %v", ChainKillSwitch, err)
+				failed = err
+				break
+			}
+		}
+	}
+	return failed
+}
@@ -0,0 +1,161 @@
+package tun
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"maps"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// The nftables tables owned by go-mesh-hub: the NAT rules and the kill
+// switch. Each one is replaced, or removed, in one transaction, and
+// reverting one (e.g. NAT left by a crash) never touches the other.
+const (
+	nftTable           = "go-mesh-hub"
+	nftKillSwitchTable = "go-mesh-hub-killswitch"
+)
+
+// nftables renders the tables from what is enabled and loads them
+// atomically with nft -f. The inet family covers IPv4 and IPv6 (NAT needs
+// Linux 5.2).
+//
+// Other tables still see the packets: an accept here does not override a
+// drop in another table's forward chain.
+type nftables struct {
+	mu         sync.Mutex
+	nat        map[string]bool // TUN interfaces with NAT enabled
+	killSwitch *KillSwitch     // nil when off
+}
+
+func newNFTables() *nftables {
+	return &nftables{nat: make(map[string]bool)}
+}
+
+func (n *nftables) Name() string { return FirewallNFTables }
+
+// EnableNAT covers IPv6 whatever ipv6 says: the inet table holds both
+// families
+func (n *nftables) EnableNAT(tunName string, ipv6 bool) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nat[tunName] = true
+	if err := n.syncNATLocked(); err != nil {
+		delete(n.nat, tunName)
+		return err
+	}
+	log.Printf("[NAT] Applied nftables table inet %s (masquerade from %s)", nftTable, tunName)
+	return nil
+}
+
+func (n *nftables) DisableNAT(tunName string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.nat, tunName)
+	if err := n.syncNATLocked(); err != nil {
+		return err
+	}
+	log.Printf("[NAT] Removed the nftables rules of %s", tunName)
+	return nil
+}
+
+// EnableKillSwitch replaces the kill switch, also one left by a previous
+// run: the new table is loaded in the same transaction that removes the
+// old one, so there is no gap
+func (n *nftables) EnableKillSwitch(ks KillSwitch) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	previous := n.killSwitch
+	n.killSwitch = &ks
+	if err := n.syncKillSwitchLocked(); err != nil {
+		n.killSwitch = previous
+		return err
+	}
+	log.Printf("[SEC] Applied the nftables kill switch in table inet %s", nftKillSwitchTable)
+	return nil
+}
+
+func (n *nftables) DisableKillSwitch() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.killSwitch = nil
+	return n.syncKillSwitchLocked()
+}
+
+// syncNATLocked replaces the NAT table with the current rules, or deletes
+// it when no TUN has NAT
+func (n *nftables) syncNATLocked() error {
+	if len(n.nat) == 0 {
+		return deleteNFTable(nftTable)
+	}
+	tuns := slices.Sorted(maps.Keys(n.nat))
+	var b strings.Builder
+	b.WriteString("\tchain postrouting {\n\t\ttype nat hook postrouting priority 100; policy accept;\n")
+	for _, tunName := range tuns {
+		fmt.Fprintf(&b, "\t\tiifname %q oifname != %q masquerade\n", tunName, tunName)
+	}
+	b.WriteString("\t}\n")
+
+	b.WriteString("\tchain forward {\n\t\ttype filter hook forward priority 0; policy accept;\n")
+	for _, tunName := range tuns {
+		fmt.Fprintf(&b, "\t\tiifname %q accept\n", tunName)
+		fmt.Fprintf(&b, "\t\toifname %q ct state established,related accept\n", tunName)
+	}
+	b.WriteString("\t}\n")
+	return nft(replaceNFTable(nftTable, b.String()))
+}
+
+// syncKillSwitchLocked replaces the kill switch table, or deletes it when
+// the kill switch is off
+func (n *nftables) syncKillSwitchLocked() error {
+	ks := n.killSwitch
+	if ks == nil {
+		return deleteNFTable(nftKillSwitchTable)
+	}
+	// Everything else is dropped, IPv4 and IPv6 alike
+	var b strings.Builder
+	b.WriteString("\tchain output {\n\t\ttype filter hook output priority 0; policy drop;\n")
+	b.WriteString("\t\toifname \"lo\" accept\n")
+	if ks.Tun != "" {
+		fmt.Fprintf(&b, "\t\toifname %q accept\n", ks.Tun)
+	}
+	family := "ip"
+	if ks.Hub.IP.To4() == nil {
+		family = "ip6"
+	}
+	fmt.Fprintf(&b, "\t\t%s daddr %s udp dport %d accept\n", family, ks.Hub.IP, ks.Hub.Port)
+	// Without neighbor discovery the IPv6 gateway is unreachable
+	b.WriteString("\t\ticmpv6 type { nd-neighbor-solicit, nd-neighbor-advert, nd-router-solicit } accept\n")
+	b.WriteString("\t}\n")
+	return nft(replaceNFTable(nftKillSwitchTable, b.String()))
+}
+
+// replaceNFTable is an nft script that creates the table (so the delete
+// never fails), deletes it and loads it again with chains: one atomic
+// replacement
+func replaceNFTable(name, chains string) string {
+	return fmt.Sprintf("table inet %s\ndelete table inet %s\ntable inet %s {\n%s}\n", name, name, name, chains)
+}
+
+// deleteNFTable removes a table and everything in it
+func deleteNFTable(name string) error {
+	return nft(fmt.Sprintf("table inet %s\ndelete table inet %s\n", name, name))
+}
+
+// nft loads a script in a single transaction
+func nft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("nft: %v: %s", err, msg)
+		}
+		return fmt.Errorf("nft: %v", err)
+	}
+	return nil
+}
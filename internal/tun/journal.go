@@ -0,0 +1,291 @@
+package tun
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// The journal is a state file listing the changes this package made to the
+// host and has not reverted yet. A change is recorded before it is applied,
+// so after a crash or a SIGKILL the next start (or the cleanup subcommand)
+// knows what to undo. The TUN device and its addresses go away with the
+// process and are not recorded.
+const (
+	changeRoute      = "route"
+	changeNAT        = "nat"
+	changeKillSwitch = "kill-switch"
+	changeSysctl     = "sysctl"
+)
+
+// change is one journal entry, with what is needed to revert it
+type change struct {
+	Kind     string `json:"kind"`
+	Dev      string `json:"dev,omitempty"`
+	Dst      string `json:"dst,omitempty"`      // Routes
+	Gateway  string `json:"gateway,omitempty"`  // Routes
+	Firewall string `json:"firewall,omitempty"` // NAT and kill switch: the firewall that installed it
+	Key      string `json:"key,omitempty"`      // Sysctls
+	Value    string `json:"value,omitempty"`    // Sysctls: the value to restore
+}
+
+// journalFile is the content of the state file
+type journalFile struct {
+	PID     int      `json:"pid"` // Process that made the changes
+	Changes []change `json:"changes"`
+}
+
+type journal struct {
+	mu      sync.Mutex
+	path    string // Empty: changes are not recorded
+	changes []change
+}
+
+var state journal
+
+func routeChange(r Route) change {
+	c := change{Kind: changeRoute, Dev: r.Dev, Dst: r.Dst.String()}
+	if r.Gateway != nil {
+		c.Gateway = r.Gateway.String()
+	}
+	return c
+}
+
+func natChange(fw Firewall, tunName string) change {
+	return change{Kind: changeNAT, Dev: tunName, Firewall: fw.Name()}
+}
+
+func killSwitchChange(fw Firewall) change {
+	return change{Kind: changeKillSwitch, Firewall: fw.Name()}
+}
+
+func sysctlChange(key, old string) change {
+	return change{Kind: changeSysctl, Key: key, Value: old}
+}
+
+func (c change) String() string {
+	switch c.Kind {
+	case changeSysctl:
+		return fmt.Sprintf("%s=%s", c.Key, c.Value)
+	case changeNAT:
+		return fmt.Sprintf("NAT on %s (%s)", c.Dev, c.Firewall)
+	case changeKillSwitch:
+		return fmt.Sprintf("kill switch (%s)", c.Firewall)
+	}
+	r, err := c.route()
+	if err != nil {
+		return "route " + c.Dst
+	}
+	return "route " + r.String()
+}
+
+func (c change) route() (Route, error) {
+	_, dst, err := net.ParseCIDR(c.Dst)
+	if err != nil {
+		return Route{}, fmt.Errorf("invalid route %q", c.Dst)
+	}
+	r := Route{Dst: dst, Dev: c.Dev}
+	if c.Gateway != "" {
+		if r.Gateway = net.ParseIP(c.Gateway); r.Gateway == nil {
+			return Route{}, fmt.Errorf("invalid gateway %q", c.Gateway)
+		}
+	}
+	return r, nil
+}
+
+// revert undoes a change; what is already gone counts as reverted
+func (c change) revert() error {
+	switch c.Kind {
+	case changeRoute:
+		r, err := c.route()
+		if err != nil {
+			return err
+		}
+		return delRoute(r)
+	case changeNAT:
+		fw, err := newFirewall(c.Firewall)
+		if err != nil {
+			return err
+		}
+		return fw.DisableNAT(c.Dev)
+	case changeKillSwitch:
+		fw, err := newFirewall(c.Firewall)
+		if err != nil {
+			return err
+		}
+		return fw.DisableKillSwitch()
+	case changeSysctl:
+		return runCmd("sysctl", "-w", c.Key+"="+c.Value)
+	}
+	return fmt.Errorf("unknown change %q", c.Kind)
+}
+
+// record adds a change to the journal before it is applied
+func (j *journal) record(c change) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if slices.Contains(j.changes, c) {
+		return
+	}
+	j.changes = append(j.changes, c)
+	j.saveLocked()
+}
+
+// forget removes a change once it is reverted (or failed to apply)
+func (j *journal) forget(c change) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if i := slices.Index(j.changes, c); i >= 0 {
+		j.changes = slices.Delete(j.changes, i, i+1)
+		j.saveLocked()
+	}
+}
+
+// pending returns the changes of a kind not reverted yet, newest first
+func (j *journal) pending(kind string) []change {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var changes []change
+	for i := len(j.changes) - 1; i >= 0; i-- {
+		if j.changes[i].Kind == kind {
+			changes = append(changes, j.changes[i])
+		}
+	}
+	return changes
+}
+
+func (j *journal) saveLocked() {
+	if j.path == "" {
+		return
+	}
+	if err := writeJournal(j.path, j.changes); err != nil {
+		log.Printf("[TUN] Failed to update the state file: %v", err)
+	}
+}
+
+// OpenJournal records the changes made from now on in path, after
+// reverting the ones a previous run left there. With keepKillSwitch a kill
+// switch left behind stays until EnableKillSwitch replaces it, so nothing
+// leaks during the restart. An empty path disables the journal. It fails
+// if the process that wrote path is still running.
+func OpenJournal(path string, keepKillSwitch bool) error {
+	if path == "" {
+		return nil
+	}
+	left, err := revertJournal(path, keepKillSwitch)
+	if err != nil {
+		return err
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.path = path
+	state.changes = left
+	state.saveLocked()
+	return nil
+}
+
+// Cleanup reverts the changes left in path by a process that is gone
+// (crashed or killed), e.g. from the cleanup subcommand.
+func Cleanup(path string) error {
+	left, err := revertJournal(path, false)
+	if err != nil {
+		return err
+	}
+	if len(left) > 0 {
+		return fmt.Errorf("%d changes could not be reverted, they are kept in %s", len(left), path)
+	}
+	return nil
+}
+
+// revertJournal undoes the changes of path, newest first. Those that fail,
+// and the kill switch with keepKillSwitch, are written back and returned.
+func revertJournal(path string, keepKillSwitch bool) ([]change, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file journalFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("state file %s: %v", path, err)
+	}
+	if running(file.PID) {
+		return nil, fmt.Errorf("state file %s belongs to a running process (pid %d), stop it first", path, file.PID)
+	}
+	if len(file.Changes) > 0 {
+		log.Printf("[TUN] Reverting %d changes left in %s by a previous run (pid %d)", len(file.Changes), path, file.PID)
+	}
+
+	var left []change
+	for i := len(file.Changes) - 1; i >= 0; i-- {
+		c := file.Changes[i]
+		if keepKillSwitch && c.Kind == changeKillSwitch {
+			log.Printf("[SEC] Keeping the %s until it is replaced", c)
+			left = append([]change{c}, left...)
+			continue
+		}
+		if err := c.revert(); err != nil {
+			log.Printf("[TUN] Could not revert %s: %v", c, err)
+			left = append([]change{c}, left...)
+			continue
+		}
+		log.Printf("[TUN] Reverted %s", c)
+	}
+	return left, writeJournal(path, left)
+}
+
+// writeJournal replaces the state file, or removes it when there is
+// nothing to revert
+func writeJournal(path string, changes []change) error {
+	if len(changes) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(journalFile{PID: os.Getpid(), Changes: changes}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".state-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	// The changes must survive a power loss as well as a crash
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// running tells whether pid is another live instance of this program (and
+// not an unrelated process that reused the pid)
+func running(pid int) bool {
+	if pid <= 0 || pid == os.Getpid() {
+		return false
+	}
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return false
+	}
+	own, err := os.ReadFile("/proc/self/comm")
+	return err == nil && bytes.Equal(comm, own)
+}
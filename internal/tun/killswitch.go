@@ -0,0 +1,51 @@
+package tun
+
+import (
+	"fmt"
+	"log"
+)
+
+// EnableKillSwitch blocks every outgoing packet except those for the
+// loopback, ks.Tun and the Hub, so nothing leaks outside the tunnel while
+// it is down. It replaces the rules in place, so call it again once the
+// TUN exists to let its traffic through. The rules outlive the process on
+// purpose: after a crash they stay until the next start replaces them (or
+// removes them, if the kill switch is now off) or the cleanup subcommand.
+func EnableKillSwitch(ks KillSwitch) error {
+	fw, err := packetFilter()
+	if err != nil {
+		return err
+	}
+	change := killSwitchChange(fw)
+	state.record(change)
+	// Kept in the journal on failure: some of the rules may be in place
+	if err := fw.EnableKillSwitch(ks); err != nil {
+		return fmt.Errorf("%s: %w", fw.Name(), err)
+	}
+	// A kill switch kept from a run with another firewall is obsolete now
+	for _, old := range state.pending(changeKillSwitch) {
+		if old == change {
+			continue
+		}
+		if err := old.revert(); err != nil {
+			log.Printf("[SEC] Could not remove the %s of the previous run: %v", old, err)
+			continue
+		}
+		state.forget(old)
+	}
+	return nil
+}
+
+// DisableKillSwitch removes the kill switch, on a deliberate disconnect
+func DisableKillSwitch() error {
+	fw, err := packetFilter()
+	if err != nil {
+		return err
+	}
+	if err := fw.DisableKillSwitch(); err != nil {
+		return fmt.Errorf("%s: %w", fw.Name(), err)
+	}
+	state.forget(killSwitchChange(fw))
+	log.Println("[SEC] Kill switch off: traffic may leave outside the tunnel again")
+	return nil
+}
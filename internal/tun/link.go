@@ -0,0 +1,177 @@
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Addresses, MTU, link state and routes are managed through a Backend:
+// netlink talks to the kernel directly, so iproute2 is not needed at
+// runtime; exec runs the ip command, for systems where the route netlink
+// socket is not usable.
+const (
+	BackendAuto    = "auto" // netlink if available, otherwise exec
+	BackendNetlink = "netlink"
+	BackendExec    = "exec"
+)
+
+// Errors of the backends, to be tested with errors.Is on an *OpError
+var (
+	ErrExists      = errors.New("already exists")
+	ErrNotFound    = errors.New("not found")
+	ErrNoDevice    = errors.New("no such device")
+	ErrPermission  = errors.New("operation not permitted")
+	ErrInvalid     = errors.New("invalid argument")
+	ErrUnreachable = errors.New("network unreachable")
+)
+
+// OpError is the error of a link, address or route operation. Kind is one
+// of the Err* values above (nil if the failure is of another kind) and Err
+// the underlying error: the errno of the kernel, or the output of ip.
+type OpError struct {
+	Op      string // e.g. "add address"
+	Target  string // e.g. "10.0.0.2/24 dev tun0"
+	Backend string
+	Kind    error
+	Err     error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("%s %s: %v (%s)", e.Op, e.Target, e.Err, e.Backend)
+}
+
+// Unwrap lets errors.Is match both the kind and the underlying error
+func (e *OpError) Unwrap() []error {
+	if e.Kind == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// kindOf classifies the errno returned by the kernel (or guessed from the
+// output of ip)
+func kindOf(errno syscall.Errno) error {
+	switch errno {
+	case syscall.EEXIST:
+		return ErrExists
+	case syscall.ESRCH, syscall.ENOENT, syscall.EADDRNOTAVAIL:
+		return ErrNotFound
+	case syscall.ENODEV:
+		return ErrNoDevice
+	case syscall.EPERM, syscall.EACCES:
+		return ErrPermission
+	case syscall.EINVAL:
+		return ErrInvalid
+	case syscall.ENETUNREACH:
+		return ErrUnreachable
+	}
+	return nil
+}
+
+// Route is a kernel route in the main table
+type Route struct {
+	Dst     *net.IPNet
+	Gateway net.IP // nil for a route straight out of Dev
+	Dev     string // Empty lets the kernel pick it from the gateway
+}
+
+func (r Route) String() string {
+	s := r.Dst.String()
+	if r.Gateway != nil {
+		s += " via " + r.Gateway.String()
+	}
+	if r.Dev != "" {
+		s += " dev " + r.Dev
+	}
+	return s
+}
+
+// Backend manages the interfaces and routes of the host
+type Backend interface {
+	Name() string
+	AddAddress(dev string, addr *net.IPNet) error // ErrExists if already assigned
+	SetMTU(dev string, mtu int) error
+	SetUp(dev string) error
+	AddRoute(r Route) error     // ErrExists if the route is there
+	ReplaceRoute(r Route) error // Adds or updates
+	DelRoute(r Route) error     // ErrNotFound if the route is not there
+}
+
+var (
+	backendMu sync.Mutex
+	backend   Backend
+)
+
+// SetBackend selects the backend by name (see BackendAuto). Without a
+// call, the first operation selects it automatically.
+func SetBackend(name string) error {
+	b, err := newBackend(name)
+	if err != nil {
+		return err
+	}
+	backendMu.Lock()
+	backend = b
+	backendMu.Unlock()
+	log.Printf("[TUN] Managing links and routes with %s", b.Name())
+	return nil
+}
+
+// system returns the selected backend
+func system() Backend {
+	backendMu.Lock()
+	defer backendMu.Unlock()
+	if backend == nil {
+		backend, _ = newBackend(BackendAuto) // auto always ends up with one
+	}
+	return backend
+}
+
+func newBackend(name string) (Backend, error) {
+	switch name {
+	case BackendNetlink:
+		return newNetlink()
+	case BackendExec:
+		return newExec()
+	case BackendAuto, "":
+		b, err := newNetlink()
+		if err == nil {
+			return b, nil
+		}
+		log.Printf("[TUN] Note: netlink unavailable (%v), falling back to the ip command", err)
+		return execBackend{}, nil
+	}
+	return nil, fmt.Errorf("unknown backend %q (auto, netlink or exec)", name)
+}
+
+// ParseAddress reads an address with an optional prefix length (10.0.0.5/24,
+// fd00::5/64). Bare addresses get /24 for IPv4 and /64 for IPv6.
+func ParseAddress(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		if strings.Contains(s, ":") {
+			s += "/64"
+		} else {
+			s += "/24"
+		}
+	}
+	ip, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() != nil {
+		ip = ip.To4()
+	}
+	return &net.IPNet{IP: ip, Mask: network.Mask}, nil
+}
+
+// hostRoute is the single-address prefix of ip
+func hostRoute(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
@@ -0,0 +1,87 @@
+package tun
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestKindOf(t *testing.T) {
+	tests := []struct {
+		errno syscall.Errno
+		kind  error
+	}{
+		{syscall.EEXIST, ErrExists},
+		{syscall.ESRCH, ErrNotFound},
+		{syscall.ENOENT, ErrNotFound},
+		{syscall.EADDRNOTAVAIL, ErrNotFound},
+		{syscall.ENODEV, ErrNoDevice},
+		{syscall.EPERM, ErrPermission},
+		{syscall.EACCES, ErrPermission},
+		{syscall.EINVAL, ErrInvalid},
+		{syscall.ENETUNREACH, ErrUnreachable},
+		{syscall.EBUSY, nil},
+		{0, nil},
+	}
+	for _, tt := range tests {
+		kind := kindOf(tt.errno)
+		if kind != tt.kind {
+			t.Errorf("kindOf(%v) = %v, want %v", tt.errno, kind, tt.kind)
+		}
+		// Callers match both the kind and the errno of an *OpError
+		err := error(&OpError{Op: "add route", Target: "10.0.0.0/24", Backend: BackendNetlink, Kind: kind, Err: tt.errno})
+		if tt.kind != nil && !errors.Is(err, tt.kind) {
+			t.Errorf("%v: errors.Is(%v) = false", tt.errno, tt.kind)
+		}
+		if !errors.Is(err, tt.errno) {
+			t.Errorf("%v: the errno does not unwrap", tt.errno)
+		}
+	}
+}
+
+func TestErrnoOf(t *testing.T) {
+	tests := []struct {
+		msg   string
+		errno syscall.Errno
+	}{
+		{"RTNETLINK answers: File exists", syscall.EEXIST},
+		{"RTNETLINK answers: No such process", syscall.ESRCH},
+		{"Error: ipv4: Address not found.\nRTNETLINK answers: Cannot assign requested address", syscall.EADDRNOTAVAIL},
+		{`Cannot find device "tun9"`, syscall.ENODEV},
+		{"RTNETLINK answers: Operation not permitted", syscall.EPERM},
+		{"Error: Invalid argument", syscall.EINVAL},
+		{"RTNETLINK answers: Network is unreachable", syscall.ENETUNREACH},
+		{"Error: Nexthop has invalid gateway.", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := errnoOf(tt.msg); got != tt.errno {
+			t.Errorf("errnoOf(%q) = %v, want %v", tt.msg, got, tt.errno)
+		}
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"10.0.0.5", "10.0.0.5/24"},
+		{"10.0.0.5/16", "10.0.0.5/16"},
+		{"fd00::5", "fd00::5/64"},
+		{"fd00::5/120", "fd00::5/120"},
+		{"10.0.0.5/33", ""},
+		{"nope", ""},
+	}
+	for _, tt := range tests {
+		addr, err := ParseAddress(tt.in)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("ParseAddress(%q) = %v, want an error", tt.in, addr)
+			}
+			continue
+		}
+		if err != nil || addr.String() != tt.want {
+			t.Errorf("ParseAddress(%q) = %v, %v; want %s", tt.in, addr, err, tt.want)
+		}
+	}
+}
@@ -3,126 +3,113 @@ package tun
 import (
 	"fmt"
 	"log"
-	"os/exec"
+	"os"
+	"strings"
 )
 
-// IPTables Constants to avoid "magic strings" and typos.
-const (
-	TableNat    = "nat"
-	TableFilter = "filter"
-
-	ChainPostRouting = "POSTROUTING"
-	ChainForward     = "FORWARD"
-
-	TargetMasquerade = "MASQUERADE"
-	TargetAccept     = "ACCEPT"
-)
-
-// Rule represents a single iptables rule configuration.
-// We use a struct to ensure consistency between creation and deletion.
-type Rule struct {
-	Name  string   // Human-readable description for logs
-	Table string   // e.g., "nat"
-	Chain string   // e.g., "POSTROUTING"
-	Args  []string // The specific matchers (e.g., "-o", "tun0", "-j", "MASQUERADE")
-}
-
 // EnableExitNode configures the Linux Kernel to act as a Router/NAT Gateway.
-// It applies necessary sysctl configurations and iptables rules.
+// It applies necessary sysctl configurations and the NAT rules, with the
+// selected firewall (see SetFirewall).
+// IPv6 forwarding is only turned on with ipv6 (see EnableForwarding).
 // Returns a cleanup function to revert changes upon shutdown.
-func EnableExitNode(tunName string) (func(), error) {
+func EnableExitNode(tunName string, ipv6 bool) (func(), error) {
 	log.Printf("[NAT] Initializing Exit Node logic on interface: %s", tunName)
 
 	// 1. Enable IP Forwarding (Kernel Level)
-	// Without this, the Linux kernel drops packets not destined for itself.
-	if err := runCmd("sysctl", "-w", "net.ipv4.ip_forward=1"); err != nil {
-		return nil, fmt.Errorf("failed to enable ip_forward: %w", err)
+	if err := EnableForwarding(ipv6); err != nil {
+		return nil, err
 	}
 
-	// 2. Define the Ruleset
-	// We define them here to ensure the exact same arguments are used for Add and Delete.
-	// The "! -o tunName" logic ensures we masquerade traffic going out to physical interfaces (eth0/wlan0).
-	rules := []Rule{
-		{
-			Name:  "Masquerade Outbound Traffic",
-			Table: TableNat,
-			Chain: ChainPostRouting,
-			Args:  []string{"!", "-o", tunName, "-j", TargetMasquerade},
-		},
-		{
-			Name:  "Allow Forwarding FROM Tunnel",
-			Table: TableFilter,
-			Chain: ChainForward,
-			Args:  []string{"-i", tunName, "-j", TargetAccept},
-		},
-		{
-			Name:  "Allow Forwarding TO Tunnel (Established)",
-			Table: TableFilter,
-			Chain: ChainForward,
-			Args:  []string{"-o", tunName, "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", TargetAccept},
-		},
+	// 2. Apply the masquerade and forwarding rules
+	fw, err := packetFilter()
+	if err != nil {
+		return nil, err
 	}
-
-	// 3. Apply Rules (Idempotent)
-	// We iterate through the definition list and ensure they exist.
-	for _, rule := range rules {
-		if err := ensureRule(rule); err != nil {
-			return nil, fmt.Errorf("failed to apply rule '%s': %w", rule.Name, err)
-		}
+	// Journaled first: a crash halfway still leaves a trace to revert
+	change := natChange(fw, tunName)
+	state.record(change)
+	if err := fw.EnableNAT(tunName, ipv6); err != nil {
+		state.forget(change)
+		return nil, fmt.Errorf("%s: %w", fw.Name(), err)
 	}
 
-	log.Println("[NAT] Exit Node Active: NAT and Forwarding rules applied.")
+	log.Printf("[NAT] Exit Node Active: NAT and Forwarding rules applied (%s).", fw.Name())
 
-	// 4. Construct Cleanup Closure
-	// This function captures the 'rules' slice via closure and reverses the operations.
+	// 3. Construct Cleanup Closure
 	cleanup := func() {
-		log.Println("[NAT] Shutdown sequence: cleaning up iptables rules...")
-		for _, rule := range rules {
-			if err := deleteRule(rule); err != nil {
-				// We log but do not fail here, as we want to attempt clearing all rules.
-				log.Printf("[NAT-ERR] Failed to cleanup rule '%s': %v", rule.Name, err)
-			}
+		log.Printf("[NAT] Shutdown sequence: cleaning up %s rules...", fw.Name())
+		if err := fw.DisableNAT(tunName); err != nil {
+			// Kept in the journal, the next start tries again
+			log.Printf("[NAT-ERR] Failed to cleanup: %v", err)
+			return
 		}
+		state.forget(change)
 	}
 
 	return cleanup, nil
 }
 
-// ensureRule checks if a rule exists. If not, it inserts it at the top (Position 1).
-func ensureRule(r Rule) error {
-	// Step A: Check if rule exists (-C)
-	// iptables returns exit code 0 if found, 1 if not found.
-	checkArgs := append([]string{"-t", r.Table, "-C", r.Chain}, r.Args...)
-	cmdCheck := exec.Command("iptables", checkArgs...)
-	
-	if err := cmdCheck.Run(); err == nil {
-		// Rule already exists. No action needed.
-		// log.Printf("[NAT-DEBUG] Rule '%s' already exists. Skipping.", r.Name)
+// Forwarding sysctls. The values they had before are journaled and put
+// back on shutdown (RestoreForwarding) or by the cleanup subcommand.
+const (
+	sysctlForward4 = "net.ipv4.ip_forward"
+	sysctlForward6 = "net.ipv6.conf.all.forwarding"
+)
+
+// EnableForwarding turns the host into a router.
+// Without this, the Linux kernel drops packets not destined for itself.
+// IPv6 forwarding is only enabled when ipv6 is set, i.e. when an IPv6
+// overlay address or prefix is in use.
+func EnableForwarding(ipv6 bool) error {
+	if err := setSysctl(sysctlForward4, "1"); err != nil {
+		return fmt.Errorf("failed to enable ip_forward: %w", err)
+	}
+	if !ipv6 {
 		return nil
 	}
-
-	// Step B: Insert rule at Position 1 (-I)
-	// We use Insert to ensure our rules take precedence over Docker or UFW rules.
-	insertArgs := append([]string{"-t", r.Table, "-I", r.Chain, "1"}, r.Args...)
-	if err := runCmd("iptables", insertArgs...); err != nil {
-		return err
+	// IPv6 may be disabled on the host; the IPv4 overlay still works then
+	if err := setSysctl(sysctlForward6, "1"); err != nil {
+		log.Printf("[NAT] Note: could not enable IPv6 forwarding: %v", err)
 	}
-
-	log.Printf("[NAT] Applied rule: %s", r.Name)
 	return nil
 }
 
-// deleteRule removes the exact rule specification from the chain.
-func deleteRule(r Rule) error {
-	// Delete (-D) requires the exact same arguments as Creation.
-	deleteArgs := append([]string{"-t", r.Table, "-D", r.Chain}, r.Args...)
-	
-	if err := runCmd("iptables", deleteArgs...); err != nil {
-		// If the error suggests the rule doesn't exist, we can ignore it during cleanup.
-		// However, standard runCmd doesn't return stdout, so we assume generic error.
+// RestoreForwarding puts back the forwarding settings EnableForwarding
+// changed
+func RestoreForwarding() {
+	for _, c := range state.pending(changeSysctl) {
+		if err := c.revert(); err != nil {
+			// Kept in the journal, the next start tries again
+			log.Printf("[NAT-ERR] Failed to restore %s: %v", c, err)
+			continue
+		}
+		state.forget(c)
+		log.Printf("[NAT] Restored %s", c)
+	}
+}
+
+// setSysctl sets key to value, journaling the value it replaces
+func setSysctl(key, value string) error {
+	old, err := readSysctl(key)
+	if err != nil {
+		return err
+	}
+	if old == value {
+		return nil // Nothing to restore later
+	}
+	change := sysctlChange(key, old)
+	state.record(change)
+	if err := runCmd("sysctl", "-w", key+"="+value); err != nil {
+		state.forget(change)
 		return err
 	}
-	
-	log.Printf("[NAT] Removed rule: %s", r.Name)
 	return nil
-}
\ No newline at end of file
+}
+
+func readSysctl(key string) (string, error) {
+	data, err := os.ReadFile("/proc/sys/" + strings.ReplaceAll(key, ".", "/"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
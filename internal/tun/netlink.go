@@ -0,0 +1,231 @@
+//go:build linux
+
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// netlinkBackend speaks rtnetlink on a NETLINK_ROUTE socket. Requests are
+// serialized and each one waits for the kernel's acknowledgement, which
+// carries the errno of the operation.
+type netlinkBackend struct {
+	mu  sync.Mutex
+	fd  int
+	seq uint32
+}
+
+func newNetlink() (Backend, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &netlinkBackend{fd: fd}, nil
+}
+
+func (n *netlinkBackend) Name() string { return BackendNetlink }
+
+func (n *netlinkBackend) AddAddress(dev string, addr *net.IPNet) error {
+	op, target := "add address", addr.String()+" dev "+dev
+	index, err := n.index(op, target, dev)
+	if err != nil {
+		return err
+	}
+	return n.do(op, target, unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL, ifaddrmsg(addr, index))
+}
+
+func (n *netlinkBackend) SetMTU(dev string, mtu int) error {
+	index, err := n.index("set mtu", dev, dev)
+	if err != nil {
+		return err
+	}
+	msg := appendAttr(ifinfomsg(index, 0, 0), unix.IFLA_MTU, binary.NativeEndian.AppendUint32(nil, uint32(mtu)))
+	return n.do("set mtu", dev, unix.RTM_NEWLINK, 0, msg)
+}
+
+func (n *netlinkBackend) SetUp(dev string) error {
+	index, err := n.index("set up", dev, dev)
+	if err != nil {
+		return err
+	}
+	return n.do("set up", dev, unix.RTM_NEWLINK, 0, ifinfomsg(index, unix.IFF_UP, unix.IFF_UP))
+}
+
+func (n *netlinkBackend) AddRoute(r Route) error {
+	return n.route("add route", r, unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL)
+}
+
+func (n *netlinkBackend) ReplaceRoute(r Route) error {
+	return n.route("replace route", r, unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_REPLACE)
+}
+
+func (n *netlinkBackend) DelRoute(r Route) error {
+	return n.route("delete route", r, unix.RTM_DELROUTE, 0)
+}
+
+func (n *netlinkBackend) route(op string, r Route, msgType, flags uint16) error {
+	target := r.String()
+	index := 0
+	if r.Dev != "" {
+		var err error
+		if index, err = n.index(op, target, r.Dev); err != nil {
+			return err
+		}
+	}
+	return n.do(op, target, msgType, flags, rtmsg(r, msgType, index))
+}
+
+// index resolves an interface name
+func (n *netlinkBackend) index(op, target, dev string) (int, error) {
+	ifce, err := net.InterfaceByName(dev)
+	if err != nil {
+		return 0, &OpError{Op: op, Target: target, Backend: BackendNetlink, Kind: ErrNoDevice, Err: err}
+	}
+	return ifce.Index, nil
+}
+
+// do sends one request and waits for its acknowledgement
+func (n *netlinkBackend) do(op, target string, msgType, flags uint16, body []byte) error {
+	if err := n.request(msgType, flags, body); err != nil {
+		var errno syscall.Errno
+		errors.As(err, &errno)
+		return &OpError{Op: op, Target: target, Backend: BackendNetlink, Kind: kindOf(errno), Err: err}
+	}
+	return nil
+}
+
+func (n *netlinkBackend) request(msgType, flags uint16, body []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.seq++
+
+	// struct nlmsghdr: len, type, flags, seq, pid (0: the kernel)
+	msg := binary.NativeEndian.AppendUint32(nil, uint32(unix.NLMSG_HDRLEN+len(body)))
+	msg = binary.NativeEndian.AppendUint16(msg, msgType)
+	msg = binary.NativeEndian.AppendUint16(msg, flags|unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	msg = binary.NativeEndian.AppendUint32(msg, n.seq)
+	msg = binary.NativeEndian.AppendUint32(msg, 0)
+	msg = append(msg, body...)
+	if err := unix.Sendto(n.fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 8192)
+	for {
+		size, _, err := unix.Recvfrom(n.fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		if done, err := ack(buf[:size], n.seq); done {
+			return err
+		}
+	}
+}
+
+// ack looks for the answer to request seq in a datagram of the kernel. It
+// returns done once found, with the errno it carries.
+func ack(b []byte, seq uint32) (done bool, err error) {
+	for len(b) >= unix.NLMSG_HDRLEN {
+		length := int(binary.NativeEndian.Uint32(b[0:4]))
+		if length < unix.NLMSG_HDRLEN || length > len(b) {
+			return true, syscall.EBADMSG
+		}
+		msgType := binary.NativeEndian.Uint16(b[4:6])
+		msgSeq := binary.NativeEndian.Uint32(b[8:12])
+		data := b[unix.NLMSG_HDRLEN:length]
+		b = b[min(nlmAlign(length), len(b)):]
+		if msgSeq != seq {
+			continue // Answer to an older request we gave up on
+		}
+		switch msgType {
+		case unix.NLMSG_ERROR:
+			if len(data) < 4 {
+				return true, syscall.EBADMSG
+			}
+			if code := int32(binary.NativeEndian.Uint32(data[0:4])); code != 0 {
+				return true, syscall.Errno(-code)
+			}
+			return true, nil
+		case unix.NLMSG_DONE:
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ifaddrmsg builds a struct ifaddrmsg (family, prefixlen, flags, scope,
+// index) with the address as local and peer attribute
+func ifaddrmsg(addr *net.IPNet, index int) []byte {
+	family, ip := familyOf(addr.IP)
+	ones, _ := addr.Mask.Size()
+	msg := []byte{family, byte(ones), 0, unix.RT_SCOPE_UNIVERSE}
+	msg = binary.NativeEndian.AppendUint32(msg, uint32(index))
+	msg = appendAttr(msg, unix.IFA_LOCAL, ip)
+	return appendAttr(msg, unix.IFA_ADDRESS, ip)
+}
+
+// rtmsg builds a struct rtmsg (family, dst_len, src_len, tos, table,
+// protocol, scope, type, flags) and the attributes of r, going out of the
+// interface index (0: none). Deletions leave protocol, scope and type
+// open, as ip does.
+func rtmsg(r Route, msgType uint16, index int) []byte {
+	family, dst := familyOf(r.Dst.IP)
+	ones, _ := r.Dst.Mask.Size()
+	protocol, scope, kind := byte(unix.RTPROT_BOOT), byte(unix.RT_SCOPE_UNIVERSE), byte(unix.RTN_UNICAST)
+	if msgType == unix.RTM_DELROUTE {
+		protocol, scope, kind = 0, unix.RT_SCOPE_NOWHERE, 0
+	} else if r.Gateway == nil {
+		scope = unix.RT_SCOPE_LINK
+	}
+	msg := []byte{family, byte(ones), 0, 0, unix.RT_TABLE_MAIN, protocol, scope, kind, 0, 0, 0, 0}
+	msg = appendAttr(msg, unix.RTA_DST, dst.Mask(r.Dst.Mask))
+	if r.Gateway != nil {
+		_, gw := familyOf(r.Gateway)
+		msg = appendAttr(msg, unix.RTA_GATEWAY, gw)
+	}
+	if index != 0 {
+		msg = appendAttr(msg, unix.RTA_OIF, binary.NativeEndian.AppendUint32(nil, uint32(index)))
+	}
+	return msg
+}
+
+// ifinfomsg builds a struct ifinfomsg: family, pad, type, index, flags, change
+func ifinfomsg(index int, flags, change uint32) []byte {
+	msg := []byte{unix.AF_UNSPEC, 0, 0, 0}
+	msg = binary.NativeEndian.AppendUint32(msg, uint32(index))
+	msg = binary.NativeEndian.AppendUint32(msg, flags)
+	return binary.NativeEndian.AppendUint32(msg, change)
+}
+
+// appendAttr appends a struct rtattr (len, type) and its padded value
+func appendAttr(msg []byte, attrType uint16, value []byte) []byte {
+	length := unix.SizeofRtAttr + len(value)
+	msg = binary.NativeEndian.AppendUint16(msg, uint16(length))
+	msg = binary.NativeEndian.AppendUint16(msg, attrType)
+	msg = append(msg, value...)
+	for i := length; i < rtaAlign(length); i++ {
+		msg = append(msg, 0)
+	}
+	return msg
+}
+
+// familyOf returns the address family and the 4 or 16 byte form of ip
+func familyOf(ip net.IP) (byte, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return unix.AF_INET, ip4
+	}
+	return unix.AF_INET6, ip.To16()
+}
+
+func nlmAlign(n int) int { return (n + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1) }
+func rtaAlign(n int) int { return (n + unix.RTA_ALIGNTO - 1) &^ (unix.RTA_ALIGNTO - 1) }
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package tun
+
+import "errors"
+
+func newNetlink() (Backend, error) {
+	return nil, errors.New("netlink is only available on Linux")
+}
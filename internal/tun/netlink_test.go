@@ -0,0 +1,186 @@
+//go:build linux
+
+package tun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// rta is a struct rtattr written out by hand, padded to 4 bytes
+func rta(attrType uint16, value ...byte) []byte {
+	b := binary.NativeEndian.AppendUint16(nil, uint16(4+len(value)))
+	b = binary.NativeEndian.AppendUint16(b, attrType)
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func u32(v uint32) []byte { return binary.NativeEndian.AppendUint32(nil, v) }
+
+func join(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+func mustNet(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	ip, network, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &net.IPNet{IP: ip, Mask: network.Mask}
+}
+
+func TestAppendAttr(t *testing.T) {
+	tests := []struct {
+		value      []byte
+		length     uint16 // Header field: without the padding
+		serialized int
+	}{
+		{nil, 4, 4},
+		{[]byte{1}, 5, 8},
+		{[]byte{1, 2, 3, 4}, 8, 8},
+		{make([]byte, 6), 10, 12},
+		{make([]byte, 16), 20, 20},
+	}
+	for _, tt := range tests {
+		got := appendAttr([]byte{0xff}, unix.RTA_DST, tt.value)[1:]
+		if len(got) != tt.serialized {
+			t.Errorf("%d byte value: %d bytes, want %d", len(tt.value), len(got), tt.serialized)
+			continue
+		}
+		if l := binary.NativeEndian.Uint16(got[0:2]); l != tt.length {
+			t.Errorf("%d byte value: length %d, want %d", len(tt.value), l, tt.length)
+		}
+		if typ := binary.NativeEndian.Uint16(got[2:4]); typ != unix.RTA_DST {
+			t.Errorf("%d byte value: type %d, want RTA_DST", len(tt.value), typ)
+		}
+		if !bytes.Equal(got[4:4+len(tt.value)], tt.value) || bytes.ContainsFunc(got[4+len(tt.value):], func(r rune) bool { return r != 0 }) {
+			t.Errorf("%d byte value: got % x", len(tt.value), got)
+		}
+	}
+}
+
+func TestRtmsg(t *testing.T) {
+	tests := []struct {
+		name    string
+		route   Route
+		msgType uint16
+		index   int
+		want    []byte
+	}{
+		{
+			"gateway and device",
+			Route{Dst: mustNet(t, "10.1.0.0/16"), Gateway: net.ParseIP("192.168.1.1"), Dev: "eth0"},
+			unix.RTM_NEWROUTE, 3,
+			join([]byte{unix.AF_INET, 16, 0, 0, unix.RT_TABLE_MAIN, unix.RTPROT_BOOT, unix.RT_SCOPE_UNIVERSE, unix.RTN_UNICAST, 0, 0, 0, 0},
+				rta(unix.RTA_DST, 10, 1, 0, 0),
+				rta(unix.RTA_GATEWAY, 192, 168, 1, 1),
+				rta(unix.RTA_OIF, u32(3)...)),
+		},
+		{
+			"link route, host bits cleared",
+			Route{Dst: mustNet(t, "10.1.2.3/8"), Dev: "tun0"},
+			unix.RTM_NEWROUTE, 7,
+			join([]byte{unix.AF_INET, 8, 0, 0, unix.RT_TABLE_MAIN, unix.RTPROT_BOOT, unix.RT_SCOPE_LINK, unix.RTN_UNICAST, 0, 0, 0, 0},
+				rta(unix.RTA_DST, 10, 0, 0, 0),
+				rta(unix.RTA_OIF, u32(7)...)),
+		},
+		{
+			"ipv6 deletion",
+			Route{Dst: mustNet(t, "fd00:1::/64")},
+			unix.RTM_DELROUTE, 0,
+			join([]byte{unix.AF_INET6, 64, 0, 0, unix.RT_TABLE_MAIN, 0, unix.RT_SCOPE_NOWHERE, 0, 0, 0, 0, 0},
+				rta(unix.RTA_DST, net.ParseIP("fd00:1::")...)),
+		},
+		{
+			"ipv6 link-local gateway",
+			Route{Dst: mustNet(t, "2001:db8::1/128"), Gateway: net.ParseIP("fe80::1"), Dev: "eth0"},
+			unix.RTM_NEWROUTE, 2,
+			join([]byte{unix.AF_INET6, 128, 0, 0, unix.RT_TABLE_MAIN, unix.RTPROT_BOOT, unix.RT_SCOPE_UNIVERSE, unix.RTN_UNICAST, 0, 0, 0, 0},
+				rta(unix.RTA_DST, net.ParseIP("2001:db8::1")...),
+				rta(unix.RTA_GATEWAY, net.ParseIP("fe80::1")...),
+				rta(unix.RTA_OIF, u32(2)...)),
+		},
+	}
+	for _, tt := range tests {
+		if got := rtmsg(tt.route, tt.msgType, tt.index); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s:\ngot  % x\nwant % x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIfaddrmsg(t *testing.T) {
+	tests := []struct {
+		addr  string
+		index int
+		want  []byte
+	}{
+		{"10.0.0.2/24", 5, join([]byte{unix.AF_INET, 24, 0, unix.RT_SCOPE_UNIVERSE}, u32(5),
+			rta(unix.IFA_LOCAL, 10, 0, 0, 2), rta(unix.IFA_ADDRESS, 10, 0, 0, 2))},
+		{"fd00::2/64", 9, join([]byte{unix.AF_INET6, 64, 0, unix.RT_SCOPE_UNIVERSE}, u32(9),
+			rta(unix.IFA_LOCAL, net.ParseIP("fd00::2")...), rta(unix.IFA_ADDRESS, net.ParseIP("fd00::2")...))},
+	}
+	for _, tt := range tests {
+		if got := ifaddrmsg(mustNet(t, tt.addr), tt.index); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s:\ngot  % x\nwant % x", tt.addr, got, tt.want)
+		}
+	}
+}
+
+// nlmsg is a struct nlmsghdr and its payload, padded to 4 bytes
+func nlmsg(msgType uint16, seq uint32, data []byte) []byte {
+	b := u32(uint32(unix.NLMSG_HDRLEN + len(data)))
+	b = binary.NativeEndian.AppendUint16(b, msgType)
+	b = binary.NativeEndian.AppendUint16(b, 0)
+	b = append(b, u32(seq)...)
+	b = append(b, u32(0)...)
+	b = append(b, data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// nlerr is the payload of an NLMSG_ERROR answer: the negated errno
+func nlerr(errno syscall.Errno) []byte {
+	return join(u32(uint32(-int32(errno))), make([]byte, unix.NLMSG_HDRLEN))
+}
+
+func TestAck(t *testing.T) {
+	truncated := nlmsg(unix.NLMSG_ERROR, 7, nlerr(0))
+	binary.NativeEndian.PutUint32(truncated[0:4], uint32(len(truncated)+4))
+	short := nlmsg(unix.NLMSG_ERROR, 7, nil)
+	binary.NativeEndian.PutUint32(short[0:4], unix.NLMSG_HDRLEN-1)
+
+	tests := []struct {
+		name string
+		b    []byte
+		done bool
+		err  error
+	}{
+		{"empty", nil, false, nil},
+		{"success", nlmsg(unix.NLMSG_ERROR, 7, nlerr(0)), true, nil},
+		{"errno", nlmsg(unix.NLMSG_ERROR, 7, nlerr(syscall.EEXIST)), true, syscall.EEXIST},
+		{"done", nlmsg(unix.NLMSG_DONE, 7, nil), true, nil},
+		{"older answer skipped", join(nlmsg(unix.NLMSG_ERROR, 6, nlerr(syscall.EPERM)), nlmsg(unix.NLMSG_ERROR, 7, nlerr(syscall.ESRCH))), true, syscall.ESRCH},
+		{"only older answers", nlmsg(unix.NLMSG_ERROR, 6, nlerr(0)), false, nil},
+		{"other message type", nlmsg(unix.RTM_NEWROUTE, 7, make([]byte, 12)), false, nil},
+		{"trailing bytes", join(nlmsg(unix.NLMSG_ERROR, 6, nlerr(0)), []byte{1, 2, 3}), false, nil},
+		{"length past the datagram", truncated, true, syscall.EBADMSG},
+		{"length below the header", short, true, syscall.EBADMSG},
+		{"error without errno", nlmsg(unix.NLMSG_ERROR, 7, []byte{0, 0}), true, syscall.EBADMSG},
+	}
+	for _, tt := range tests {
+		done, err := ack(tt.b, 7)
+		if done != tt.done || !errors.Is(err, tt.err) || (err == nil) != (tt.err == nil) {
+			t.Errorf("%s: ack = %v, %v; want %v, %v", tt.name, done, err, tt.done, tt.err)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package tun
+
+import "net"
+
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+)
+
+// Addresses returns the source and destination of a raw IP packet read
+// from (or about to be written to) the TUN interface. Both IPv4 and IPv6
+// are understood; anything else reports ok == false.
+func Addresses(packet []byte) (src, dst net.IP, ok bool) {
+	if len(packet) == 0 {
+		return nil, nil, false
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < ipv4HeaderLen {
+			return nil, nil, false
+		}
+		return net.IP(packet[12:16]), net.IP(packet[16:20]), true
+	case 6:
+		if len(packet) < ipv6HeaderLen {
+			return nil, nil, false
+		}
+		return net.IP(packet[8:24]), net.IP(packet[24:40]), true
+	}
+	return nil, nil, false
+}
@@ -3,6 +3,7 @@ package tun
 import (
 	"bufio"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -10,45 +11,77 @@ import (
 	"strings"
 )
 
-// RedirectGateway forces all internet traffic through the TUN interface.
+// RedirectGateway forces all internet traffic through the TUN interface,
+// IPv6 too with ipv6 (an IPv6 overlay address), so it does not leak
+// through the physical default route.
 // hubRealIP: The Public IP of your Server (to create the exception route).
-func RedirectGateway(ifaceName string, hubRealIP string) (func(), error) {
-	// 1. Detect Local Gateway (e.g., 192.168.1.1)
-	gw, err := GetDefaultGateway()
-	if err != nil {
-		return nil, fmt.Errorf("failed to detect default gateway: %v", err)
+func RedirectGateway(ifaceName string, hubRealIP string, ipv6 bool) (func(), error) {
+	hubIP := net.ParseIP(hubRealIP)
+	if hubIP == nil {
+		return nil, fmt.Errorf("invalid Hub address %q", hubRealIP)
+	}
+
+	// 1. Detect Local Gateway (e.g., 192.168.1.1) in the Hub's address family
+	var exception Route
+	if hubIP.To4() == nil {
+		gw, dev, err := GetDefaultGateway6()
+		if err != nil {
+			return nil, fmt.Errorf("failed to detect IPv6 default gateway: %v", err)
+		}
+		log.Printf("[ROUTE] Local Gateway detected: %s dev %s", gw, dev)
+		// IPv6 gateways are usually link-local, so the device is mandatory
+		exception = Route{Dst: hostRoute(hubIP), Gateway: net.ParseIP(gw), Dev: dev}
+	} else {
+		gw, err := GetDefaultGateway()
+		if err != nil {
+			return nil, fmt.Errorf("failed to detect default gateway: %v", err)
+		}
+		log.Printf("[ROUTE] Local Gateway detected: %s", gw)
+		exception = Route{Dst: hostRoute(hubIP), Gateway: net.ParseIP(gw)}
 	}
-	log.Printf("[ROUTE] Local Gateway detected: %s", gw)
 
 	log.Printf("[ROUTE] Redirecting all internet traffic via %s...", ifaceName)
 
 	// 2. Add Exception Route for Hub (Anti-Loop)
-	// Command: ip route add <HUB_IP> via <GW_IP>
+	// Route: <HUB_IP> via <GW_IP>
 	// This ensures encrypted VPN packets go through the physical WiFi, not the tunnel.
-	if err := runCmd("ip", "route", "add", hubRealIP, "via", gw); err != nil {
-		return nil, fmt.Errorf("failed to add exception route for Hub: %v", err)
+	if err := replaceRoute(exception); err != nil {
+		return nil, fmt.Errorf("failed to add exception route for Hub: %w", err)
 	}
 
 	// 3. Add the 0/1 and 128/1 override routes (The "0/1 Trick")
 	// These override the default gateway without deleting it.
-	if err := runCmd("ip", "route", "add", "0.0.0.0/1", "dev", ifaceName); err != nil {
-		// Rollback if fail
-		runCmd("ip", "route", "del", hubRealIP)
-		return nil, fmt.Errorf("failed to add 0/1 route: %v", err)
+	// Replace: routes left behind by a previous run are taken over.
+	prefixes := []string{"0.0.0.0/1", "128.0.0.0/1"}
+	if ipv6 {
+		// Same trick for IPv6; link-local and multicast keep their more
+		// specific routes
+		prefixes = append(prefixes, "::/1", "8000::/1")
+	}
+	var overrides []Route
+	for _, prefix := range prefixes {
+		_, dst, _ := net.ParseCIDR(prefix)
+		overrides = append(overrides, Route{Dst: dst, Dev: ifaceName})
 	}
-	if err := runCmd("ip", "route", "add", "128.0.0.0/1", "dev", ifaceName); err != nil {
-		// Rollback
-		runCmd("ip", "route", "del", "0.0.0.0/1")
-		runCmd("ip", "route", "del", hubRealIP)
-		return nil, fmt.Errorf("failed to add 128/1 route: %v", err)
+	for i, r := range overrides {
+		if err := replaceRoute(r); err != nil {
+			// Rollback if fail
+			for _, added := range overrides[:i] {
+				delRoute(added)
+			}
+			delRoute(exception)
+			return nil, fmt.Errorf("failed to add %s route: %w", r.Dst, err)
+		}
 	}
 
 	// 4. Return Cleanup Function
 	cleanup := func() {
 		log.Println("[ROUTE] Restoring default routes...")
-		runCmd("ip", "route", "del", "0.0.0.0/1")
-		runCmd("ip", "route", "del", "128.0.0.0/1")
-		runCmd("ip", "route", "del", hubRealIP)
+		for _, r := range append(overrides, exception) {
+			if err := delRoute(r); err != nil {
+				log.Printf("[ROUTE] %v", err)
+			}
+		}
 	}
 
 	return cleanup, nil
@@ -72,7 +105,7 @@ func GetDefaultGateway() (string, error) {
 		if len(fields) < 3 {
 			continue
 		}
-		
+
 		// Destination 00000000 means Default Gateway
 		if fields[1] == "00000000" {
 			// Gateway is in Hex (Little Endian). Example: 0101A8C0 -> 192.168.1.1
@@ -80,7 +113,7 @@ func GetDefaultGateway() (string, error) {
 			if gwHex == "00000000" {
 				continue // No gateway on this route
 			}
-			
+
 			ip, err := parseHexIP(gwHex)
 			if err != nil {
 				return "", err
@@ -91,6 +124,37 @@ func GetDefaultGateway() (string, error) {
 	return "", fmt.Errorf("no default gateway found")
 }
 
+// GetDefaultGateway6 parses /proc/net/ipv6_route to find the IPv6 default
+// gateway and the interface it is reachable on
+func GetDefaultGateway6() (string, string, error) {
+	file, err := os.Open("/proc/net/ipv6_route")
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Format: Dest DestLen Src SrcLen NextHop Metric RefCnt Use Flags Iface
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		if fields[0] != strings.Repeat("0", 32) || fields[1] != "00" {
+			continue
+		}
+		if fields[4] == strings.Repeat("0", 32) || fields[9] == "lo" {
+			continue // No next hop (e.g. unreachable default)
+		}
+		raw, err := hex.DecodeString(fields[4])
+		if err != nil || len(raw) != net.IPv6len {
+			return "", "", fmt.Errorf("invalid ipv6 gateway %q", fields[4])
+		}
+		return net.IP(raw).String(), fields[9], nil
+	}
+	return "", "", fmt.Errorf("no IPv6 default gateway found")
+}
+
 // parseHexIP converts Little Endian Hex string to net.IP
 func parseHexIP(hexStr string) (net.IP, error) {
 	bytes, err := hex.DecodeString(hexStr)
@@ -102,4 +166,52 @@ func parseHexIP(hexStr string) (net.IP, error) {
 	}
 	// Reverse bytes (Little Endian to Big Endian)
 	return net.IPv4(bytes[3], bytes[2], bytes[1], bytes[0]), nil
-}
\ No newline at end of file
+}
+
+// AddRoute sends traffic for a prefix (e.g. a remote LAN) through the TUN interface
+func AddRoute(ifaceName, prefix string) error {
+	_, dst, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return fmt.Errorf("invalid route %q: %v", prefix, err)
+	}
+	// Replace keeps the call idempotent if the route already exists
+	if err := replaceRoute(Route{Dst: dst, Dev: ifaceName}); err != nil {
+		return err
+	}
+	log.Printf("[ROUTE] %s via %s", prefix, ifaceName)
+	return nil
+}
+
+// DelRoute removes a route previously added with AddRoute
+func DelRoute(ifaceName, prefix string) error {
+	_, dst, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return fmt.Errorf("invalid route %q: %v", prefix, err)
+	}
+	if err := delRoute(Route{Dst: dst, Dev: ifaceName}); err != nil {
+		return err
+	}
+	log.Printf("[ROUTE] Removed %s", prefix)
+	return nil
+}
+
+// replaceRoute installs a route and records it in the journal
+func replaceRoute(r Route) error {
+	change := routeChange(r)
+	state.record(change)
+	if err := system().ReplaceRoute(r); err != nil {
+		state.forget(change)
+		return err
+	}
+	return nil
+}
+
+// delRoute removes a route and its journal entry; a route that is already
+// gone is not an error
+func delRoute(r Route) error {
+	if err := system().DelRoute(r); err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrNoDevice) {
+		return err
+	}
+	state.forget(routeChange(r))
+	return nil
+}
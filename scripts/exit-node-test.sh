@@ -0,0 +1,171 @@
+#!/bin/bash
+
+# ==========================================
+# Go-Mesh-Hub Exit Node Integration Test
+# ==========================================
+# Builds the binaries and runs a Hub and two Agents in network namespaces.
+# The "client" Agent browses the Internet (-global-exit) through the "exit"
+# Agent (-exit-node), so its traffic goes client -> Hub -> exit -> Internet
+# and the replies come back the same way.
+#
+#   gmh-client ---- gmh-hub ---- gmh-exit ---- gmh-inet
+#   172.31.1.2   172.31.1.1/2.1  172.31.2.2    198.51.100.1
+#                                198.51.100.2
+#
+# The Hub has no route to the "Internet" namespace, so the only way to
+# reach it is the exit Agent's NAT.
+#
+# Requires root, iproute2, iptables, python3 and curl.
+# Usage: sudo ./scripts/exit-node-test.sh
+# ==========================================
+
+set -e
+
+# --- Colors for UI ---
+GREEN='\033[0;32m'
+BLUE='\033[0;34m'
+RED='\033[0;31m'
+NC='\033[0m' # No Color
+
+log_info() { echo -e "${BLUE}[INFO]${NC} $1"; }
+log_success() { echo -e "${GREEN}[SUCCESS]${NC} $1"; }
+log_err() { echo -e "${RED}[ERROR]${NC} $1"; }
+
+PROJECT_DIR=$(cd "$(dirname "$0")/.." && pwd)
+WORK=$(mktemp -d)
+NAMESPACES="gmh-hub gmh-client gmh-exit gmh-inet"
+DUMMY_KEY="AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+
+for tool in ip iptables python3 curl; do
+    if ! command -v $tool &> /dev/null; then
+        log_err "$tool is required"
+        exit 1
+    fi
+done
+if [ "$(id -u)" -ne 0 ]; then
+    log_err "Run as root (network namespaces and TUN devices)"
+    exit 1
+fi
+
+cleanup() {
+    for pid in $(jobs -p); do
+        kill "$pid" 2> /dev/null || true
+    done
+    wait 2> /dev/null || true
+    for ns in $NAMESPACES; do
+        ip netns del "$ns" 2> /dev/null || true
+    done
+    if [ "$FAILED" = "1" ]; then
+        log_err "Logs kept in $WORK"
+    else
+        rm -rf "$WORK"
+    fi
+}
+trap cleanup EXIT
+
+fail() {
+    FAILED=1
+    log_err "$1"
+    exit 1
+}
+
+# 1. Build
+log_info "Building binaries in $WORK..."
+(cd "$PROJECT_DIR" && go build -o "$WORK/hub" ./cmd/hub && go build -o "$WORK/agent" ./cmd/agent)
+
+# 2. Network namespaces
+log_info "Creating namespaces..."
+for ns in $NAMESPACES; do
+    ip netns del "$ns" 2> /dev/null || true
+    ip netns add "$ns"
+    ip -n "$ns" link set lo up
+done
+
+ip link add h-c netns gmh-hub type veth peer name c-h netns gmh-client
+ip link add h-e netns gmh-hub type veth peer name e-h netns gmh-exit
+ip link add e-i netns gmh-exit type veth peer name i-e netns gmh-inet
+
+ip -n gmh-hub addr add 172.31.1.1/24 dev h-c
+ip -n gmh-hub addr add 172.31.2.1/24 dev h-e
+ip -n gmh-client addr add 172.31.1.2/24 dev c-h
+ip -n gmh-exit addr add 172.31.2.2/24 dev e-h
+ip -n gmh-exit addr add 198.51.100.2/24 dev e-i
+ip -n gmh-inet addr add 198.51.100.1/24 dev i-e
+for link in "gmh-hub h-c" "gmh-hub h-e" "gmh-client c-h" "gmh-exit e-h" "gmh-exit e-i" "gmh-inet i-e"; do
+    set -- $link
+    ip -n "$1" link set "$2" up
+done
+
+# The client's default gateway is the Hub's side; the exit reaches the
+# "Internet" directly
+ip -n gmh-client route add default via 172.31.1.1
+ip -n gmh-exit route add default via 198.51.100.1
+
+# 3. Keys: an Agent creates its key and prints the public half on start
+agent_key() {
+    ip netns exec "$1" timeout 2 "$WORK/agent" -key "$WORK/$1.key" -hub-ip 127.0.0.1 -hub-key "$DUMMY_KEY" 2>&1 \
+        | grep -o 'Agent public key: [^ ]*' | cut -d' ' -f4 || true
+}
+CLIENT_KEY=$(agent_key gmh-client)
+EXIT_KEY=$(agent_key gmh-exit)
+[ -n "$CLIENT_KEY" ] && [ -n "$EXIT_KEY" ] || fail "Could not create the Agent keys"
+
+cat > "$WORK/hub.yaml" << EOF
+key: $WORK/hub.key
+tun-ip: 10.0.0.1
+web-ip: 127.0.0.1
+history: ""
+authorized-peers: ""
+exit-node: [10.0.0.3]
+peers:
+  - name: client
+    public-key: $CLIENT_KEY
+    allowed-ips: [10.0.0.2/32]
+  - name: exit
+    public-key: $EXIT_KEY
+    allowed-ips: [10.0.0.3/32]
+EOF
+
+# 4. Start everything
+log_info "Starting the Internet server, the Hub and the Agents..."
+ip netns exec gmh-inet python3 -m http.server 8000 --bind 198.51.100.1 --directory "$WORK" > "$WORK/inet.log" 2>&1 &
+(cd "$WORK" && ip netns exec gmh-hub "$WORK/hub" -config "$WORK/hub.yaml" > "$WORK/hub.log" 2>&1) &
+sleep 1
+HUB_KEY=$(grep -o 'Hub public key: [^ ]*' "$WORK/hub.log" | cut -d' ' -f4)
+[ -n "$HUB_KEY" ] || fail "The Hub did not start"
+
+ip netns exec gmh-exit "$WORK/agent" -key "$WORK/gmh-exit.key" -hub-ip 172.31.2.1 -hub-key "$HUB_KEY" \
+    -tun-ip 10.0.0.3 -exit-node > "$WORK/exit.log" 2>&1 &
+ip netns exec gmh-client "$WORK/agent" -key "$WORK/gmh-client.key" -hub-ip 172.31.1.1 -hub-key "$HUB_KEY" \
+    -tun-ip 10.0.0.2 -global-exit > "$WORK/client.log" 2>&1 &
+sleep 3
+
+# 5. Checks
+log_info "Fetching a page from the Internet namespace through the exit Agent..."
+echo "hello from the internet" > "$WORK/index.txt"
+ip netns exec gmh-client curl -sf --max-time 5 http://198.51.100.1:8000/index.txt > "$WORK/page.txt" \
+    || fail "The client could not reach the Internet through the exit Agent"
+grep -q "hello from the internet" "$WORK/page.txt" || fail "Unexpected page: $(cat "$WORK/page.txt")"
+
+grep -q '^198\.51\.100\.2 ' "$WORK/inet.log" \
+    || fail "The request did not come from the exit Agent's address: $(cat "$WORK/inet.log")"
+log_success "Request and reply went through the exit Agent (masqueraded as 198.51.100.2)"
+
+ip netns exec gmh-hub curl -sf http://127.0.0.1:8080/api/v1/peers/10.0.0.2 | grep -q '"exit_node": "10.0.0.3"' \
+    || fail "The Hub does not report 10.0.0.3 as the client's Exit Node"
+# (IPv6 link-local router solicitations from the TUN devices are dropped, as always)
+if grep -q 'sent packet from 198\.51\.100\.1' "$WORK/hub.log"; then
+    fail "The Hub dropped replies as spoofed: $(grep 'sent packet from 198' "$WORK/hub.log")"
+fi
+log_success "The Hub reports the Exit Node of the client and accepted the replies"
+
+# 6. Without the exit Agent, the client has no way out
+log_info "Stopping the exit Agent..."
+pkill -f -- "-key $WORK/gmh-exit.key" || true
+sleep 1
+if ip netns exec gmh-client curl -sf --max-time 3 http://198.51.100.1:8000/index.txt > /dev/null; then
+    fail "The client still reached the Internet without its Exit Node"
+fi
+log_success "Traffic stops with the exit Agent: it never leaks through the Hub"
+
+log_success "Exit Node integration test passed"